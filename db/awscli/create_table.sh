@@ -22,4 +22,135 @@ docker-compose exec awscli aws dynamodb create-table \
     --key-schema \
         AttributeName=actorName,KeyType=HASH \
         AttributeName=eventIndex,KeyType=RANGE \
-    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
\ No newline at end of file
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name keys \
+    --attribute-definitions \
+        AttributeName=actorName,AttributeType=S \
+    --key-schema \
+        AttributeName=actorName,KeyType=HASH \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name payload_chunks \
+    --attribute-definitions \
+        AttributeName=chunkKey,AttributeType=S \
+        AttributeName=chunkId,AttributeType=S \
+    --key-schema \
+        AttributeName=chunkKey,KeyType=HASH \
+        AttributeName=chunkId,KeyType=RANGE \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+# EventsByTagで使うtagの表
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name journal_tags \
+    --attribute-definitions \
+        AttributeName=tag,AttributeType=S \
+        AttributeName=tagOffset,AttributeType=S \
+    --key-schema \
+        AttributeName=tag,KeyType=HASH \
+        AttributeName=tagOffset,KeyType=RANGE \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name sequences \
+    --attribute-definitions \
+        AttributeName=name,AttributeType=S \
+    --key-schema \
+        AttributeName=name,KeyType=HASH \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+# EventsSinceで使うGSI
+docker-compose exec awscli aws dynamodb update-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name journal \
+    --attribute-definitions \
+        AttributeName=globalSeqPartition,AttributeType=S \
+        AttributeName=globalSeq,AttributeType=N \
+    --global-secondary-index-updates \
+        '[{"Create":{"IndexName":"global-seq-index","KeySchema":[{"AttributeName":"globalSeqPartition","KeyType":"HASH"},{"AttributeName":"globalSeq","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"},"ProvisionedThroughput":{"ReadCapacityUnits":1,"WriteCapacityUnits":1}}}]'
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name persistence_ids \
+    --attribute-definitions \
+        AttributeName=journal,AttributeType=S \
+        AttributeName=actorName,AttributeType=S \
+    --key-schema \
+        AttributeName=journal,KeyType=HASH \
+        AttributeName=actorName,KeyType=RANGE \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+# StreamSubscriptionが読むstream
+docker-compose exec awscli aws dynamodb update-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name journal \
+    --stream-specification StreamEnabled=true,StreamViewType=NEW_IMAGE
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name checkpoints \
+    --attribute-definitions \
+        AttributeName=name,AttributeType=S \
+    --key-schema \
+        AttributeName=name,KeyType=HASH \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name projection_offsets \
+    --attribute-definitions \
+        AttributeName=projectionName,AttributeType=S \
+    --key-schema \
+        AttributeName=projectionName,KeyType=HASH \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name state \
+    --attribute-definitions \
+        AttributeName=actorName,AttributeType=S \
+    --key-schema \
+        AttributeName=actorName,KeyType=HASH \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name leases \
+    --attribute-definitions \
+        AttributeName=actorName,AttributeType=S \
+    --key-schema \
+        AttributeName=actorName,KeyType=HASH \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name actor_metadata \
+    --attribute-definitions \
+        AttributeName=actorName,AttributeType=S \
+    --key-schema \
+        AttributeName=actorName,KeyType=HASH \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+docker-compose exec awscli aws dynamodb create-table \
+    --endpoint-url=http://host.docker.internal:4566 \
+    --table-name journal_archive \
+    --attribute-definitions \
+        AttributeName=actorName,AttributeType=S \
+        AttributeName=eventIndex,AttributeType=N \
+    --key-schema \
+        AttributeName=actorName,KeyType=HASH \
+        AttributeName=eventIndex,KeyType=RANGE \
+    --provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+# WithTTL(p.DefaultTTLAttribute, ...)で書かれる期限
+for table in journal snapshot actor_metadata payload_chunks journal_tags; do
+    docker-compose exec awscli aws dynamodb update-time-to-live \
+        --endpoint-url=http://host.docker.internal:4566 \
+        --table-name $table \
+        --time-to-live-specification Enabled=true,AttributeName=expireAt
+done
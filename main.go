@@ -9,9 +9,6 @@ import (
 	console "github.com/asynkron/goconsole"
 	"github.com/asynkron/protoactor-go/actor"
 	"github.com/asynkron/protoactor-go/persistence"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"github.com/oklog/ulid/v2"
 	a "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/actor"
@@ -66,9 +63,11 @@ func main() {
 
 	// DynamoDBのrecordを削除
 	log.Print("deleting DynamoDB records...")
-	deleteDynamoDBRecords(client, "journal", "userAccountActor-1")
-	deleteDynamoDBRecords(client, "snapshot", "userAccountActor-1")
-	log.Print("done")
+	report, err := provider.PurgeActor(context.Background(), "userAccountActor-1")
+	if err != nil {
+		log.Printf("failed to purge userAccountActor-1: %s", err.Error())
+	}
+	log.Printf("done: %+v", report)
 }
 
 func getEmail(system *actor.ActorSystem, pid *actor.PID) {
@@ -95,38 +94,3 @@ func spawnUserAccount(system *actor.ActorSystem, props *actor.Props, id string)
 	}
 	return pid
 }
-
-func deleteDynamoDBRecords(client *dynamodb.Client, tableName string, actorName string) error {
-	// Scan operation parameters
-	params := &dynamodb.ScanInput{
-		TableName:        aws.String(tableName),
-		FilterExpression: aws.String("actorName = :actorName"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":actorName": &types.AttributeValueMemberS{Value: actorName},
-		},
-	}
-
-	// Scan the table to get all records with the specified actorName
-	result, err := client.Scan(context.TODO(), params)
-	if err != nil {
-		return err
-	}
-
-	// Iterate over the scanned records and delete them one by one
-	for _, item := range result.Items {
-		deleteParams := &dynamodb.DeleteItemInput{
-			TableName: aws.String(tableName),
-			Key: map[string]types.AttributeValue{
-				"actorName":  item["actorName"],
-				"eventIndex": item["eventIndex"],
-			},
-		}
-
-		_, err := client.DeleteItem(context.TODO(), deleteParams)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
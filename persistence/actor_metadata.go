@@ -0,0 +1,173 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	DefaultActorMetadataTable = "actor_metadata"
+
+	attrHighestEventIndex = "highestEventIndex"
+	attrDeletedToIndex    = "deletedToIndex"
+	attrLastSnapshotIndex = "lastSnapshotIndex"
+	attrCreatedAt         = "createdAt"
+	attrUpdatedAt         = "updatedAt"
+
+	// metadataCondition keeps an index of the metadata from moving back, e.g. when compaction deletes events
+	// while a later snapshot is written, or a stale writer writes an older event.
+	metadataCondition = "attribute_not_exists(#index) OR #index <= :index"
+)
+
+// ActorMetadata summarizes the journal and snapshots of an actor.
+// Indexes are -1 when there is no such event or snapshot.
+type ActorMetadata struct {
+	ActorName         string
+	HighestEventIndex int
+	DeletedToIndex    int
+	LastSnapshotIndex int
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	// ExpiresAt is when the metadata expires with WithTTL, or zero if it is kept forever.
+	ExpiresAt time.Time
+}
+
+// EventCount returns the number of events in the journal that have not been deleted.
+func (m ActorMetadata) EventCount() int {
+	return m.HighestEventIndex - m.DeletedToIndex
+}
+
+// actorMetadataTable keeps one metadata item per actor, updated in the same transaction as the items it describes,
+// so that the highest event index survives the deletion of events and is known without querying the journal.
+type actorMetadataTable struct {
+	table string
+	ttl   *ttlPolicy
+}
+
+// eventWritten returns the update of the metadata of actorName for writing the event at eventIndex.
+func (m *actorMetadataTable) eventWritten(actorName string, eventIndex int, now time.Time) types.TransactWriteItem {
+	return m.update(actorName, attrHighestEventIndex, eventIndex, now)
+}
+
+// snapshotWritten returns the update of the metadata of actorName for writing a snapshot at eventIndex.
+func (m *actorMetadataTable) snapshotWritten(actorName string, eventIndex int, now time.Time) types.TransactWriteItem {
+	return m.update(actorName, attrLastSnapshotIndex, eventIndex, now)
+}
+
+// eventsDeleted returns the update of the metadata of actorName for deleting the events up to eventIndex.
+func (m *actorMetadataTable) eventsDeleted(actorName string, eventIndex int, now time.Time) types.TransactWriteItem {
+	return m.update(actorName, attrDeletedToIndex, eventIndex, now)
+}
+
+// update sets attr to index unless the metadata records a higher index already. See transactWrite.
+func (m *actorMetadataTable) update(actorName string, attr string, index int, now time.Time) types.TransactWriteItem {
+	timestamp := &types.AttributeValueMemberS{Value: now.UTC().Format(time.RFC3339Nano)}
+	update := &types.Update{
+		TableName: aws.String(m.table),
+		Key: map[string]types.AttributeValue{
+			"actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+		UpdateExpression:         aws.String("SET #index = :index, updatedAt = :now, createdAt = if_not_exists(createdAt, :now)"),
+		ConditionExpression:      aws.String(metadataCondition),
+		ExpressionAttributeNames: map[string]string{"#index": attr},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":index": &types.AttributeValueMemberN{Value: strconv.Itoa(index)},
+			":now":   timestamp,
+		},
+	}
+	if m.ttl != nil {
+		if expiry, ok := m.ttl.expiry(actorName, now); ok {
+			update.UpdateExpression = aws.String(aws.ToString(update.UpdateExpression) + ", #ttl = :ttl")
+			update.ExpressionAttributeNames["#ttl"] = m.ttl.attribute
+			update.ExpressionAttributeValues[":ttl"] = expiry
+		}
+	}
+	return types.TransactWriteItem{Update: update}
+}
+
+// lastSnapshotIndex returns the last snapshot index of actorName, and false if the actor has no metadata item.
+// It reads only that index with an eventually consistent read, which costs half as much as load.
+func (m *actorMetadataTable) lastSnapshotIndex(ctx context.Context, client *dynamodb.Client, actorName string) (int, bool, error) {
+	out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(m.table),
+		Key: map[string]types.AttributeValue{
+			"actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+		ProjectionExpression: aws.String(attrLastSnapshotIndex),
+	})
+	if err != nil || out.Item == nil {
+		return -1, false, err
+	}
+	v, ok := out.Item[attrLastSnapshotIndex].(*types.AttributeValueMemberN)
+	if !ok {
+		return -1, true, nil
+	}
+	index, err := strconv.Atoi(v.Value)
+	return index, err == nil, err
+}
+
+// load returns the metadata of actorName, and false if the actor has no metadata item,
+// because it has not written yet or wrote before metadata was enabled.
+func (m *actorMetadataTable) load(ctx context.Context, client *dynamodb.Client, actorName string) (ActorMetadata, bool, error) {
+	out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(m.table),
+		Key: map[string]types.AttributeValue{
+			"actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return ActorMetadata{}, false, err
+	}
+	if out.Item == nil {
+		return ActorMetadata{}, false, nil
+	}
+
+	metadata := ActorMetadata{ActorName: actorName}
+	for attr, index := range map[string]*int{
+		attrHighestEventIndex: &metadata.HighestEventIndex,
+		attrDeletedToIndex:    &metadata.DeletedToIndex,
+		attrLastSnapshotIndex: &metadata.LastSnapshotIndex,
+	} {
+		*index = -1
+		if v, ok := out.Item[attr].(*types.AttributeValueMemberN); ok {
+			if *index, err = strconv.Atoi(v.Value); err != nil {
+				return ActorMetadata{}, false, err
+			}
+		}
+	}
+	for attr, t := range map[string]*time.Time{
+		attrCreatedAt: &metadata.CreatedAt,
+		attrUpdatedAt: &metadata.UpdatedAt,
+	} {
+		if v, ok := out.Item[attr].(*types.AttributeValueMemberS); ok {
+			if *t, err = time.Parse(time.RFC3339Nano, v.Value); err != nil {
+				return ActorMetadata{}, false, err
+			}
+		}
+	}
+	if m.ttl != nil {
+		if v, ok := out.Item[m.ttl.attribute].(*types.AttributeValueMemberN); ok {
+			expireAt, err := strconv.ParseInt(v.Value, 10, 64)
+			if err != nil {
+				return ActorMetadata{}, false, err
+			}
+			metadata.ExpiresAt = time.Unix(expireAt, 0).UTC()
+		}
+	}
+	return metadata, true, nil
+}
+
+// ActorMetadata returns the metadata of actorName, and false if it has none. It needs WithActorMetadata.
+func (e *EventStore) ActorMetadata(ctx context.Context, actorName string) (ActorMetadata, bool, error) {
+	if e.options.actorMetadata == nil {
+		return ActorMetadata{}, false, errors.New("actor metadata is not enabled")
+	}
+	return e.options.actorMetadata.load(ctx, e.client, actorName)
+}
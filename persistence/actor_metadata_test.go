@@ -0,0 +1,91 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+func TestProviderState_ActorMetadata(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	// 1件ごとに1秒進む時計
+	start := time.Date(2024, 4, 13, 4, 54, 29, 0, time.UTC)
+	now := start
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	opts := []p.Option{p.WithActorMetadata(p.DefaultActorMetadataTable), p.WithClock(clock)}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	actorName := "testMetadataActor"
+	_, ok, err := provider.ActorMetadata(ctx, actorName)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	for i, data := range []string{"event1", "event2", "event3", "event4", "event5"} {
+		provider.PersistEvent(actorName, i, &p.Event{Data: data})
+	}
+	provider.PersistSnapshot(actorName, 3, &p.Snapshot{Data: "snapshot"})
+
+	metadata, ok, err := provider.ActorMetadata(ctx, actorName)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 4, metadata.HighestEventIndex)
+	assert.Equal(t, -1, metadata.DeletedToIndex)
+	assert.Equal(t, 3, metadata.LastSnapshotIndex)
+	assert.Equal(t, 5, metadata.EventCount())
+	assert.True(t, metadata.CreatedAt.Equal(start.Add(2*time.Second)), metadata.CreatedAt)
+	assert.True(t, metadata.UpdatedAt.Equal(now), metadata.UpdatedAt)
+
+	// 古いindexのeventやsnapshotを書き直しても、indexは戻らない
+	provider.PersistEvent(actorName, 1, &p.Event{Data: "event2"})
+	provider.PersistSnapshot(actorName, 0, &p.Snapshot{Data: "old snapshot"})
+	metadata, _, err = provider.ActorMetadata(ctx, actorName)
+	require.NoError(t, err)
+	assert.Equal(t, 4, metadata.HighestEventIndex)
+	assert.Equal(t, 3, metadata.LastSnapshotIndex)
+
+	// 消したeventの分だけ数が減り、最大のindexは残る
+	provider.DeleteEvents(actorName, 2)
+	metadata, _, err = provider.ActorMetadata(ctx, actorName)
+	require.NoError(t, err)
+	assert.Equal(t, 4, metadata.HighestEventIndex)
+	assert.Equal(t, 2, metadata.DeletedToIndex)
+	assert.Equal(t, 2, metadata.EventCount())
+
+	// 消したeventからはreplayできない
+	err = persistError(func() { provider.GetEvents(actorName, 0, 0, func(e interface{}) {}) })
+	assert.ErrorIs(t, err, p.ErrJournalTruncated)
+	var data []string
+	provider.GetEvents(actorName, 3, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Equal(t, []string{"event4", "event5"}, data)
+
+	// snapshotより新しいeventがなければ何もreplayしない
+	data = nil
+	provider.GetEvents(actorName, 5, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Empty(t, data)
+
+	// クリーンアップ
+	provider.DeleteEvents(actorName, 4)
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorName)
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(p.DefaultActorMetadataTable),
+		Key:       map[string]types.AttributeValue{"actorName": &types.AttributeValueMemberS{Value: actorName}},
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,240 @@
+package persistence
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/oklog/ulid/v2"
+)
+
+const attrPayloadRef = "payloadRef"
+
+// ErrBlobNotFound is returned by a BlobStore when no object exists for the key.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps payloads that are too large to be stored in DynamoDB.
+// It follows the object API of S3, so an S3 or MinIO client can be adapted with a few lines.
+type BlobStore interface {
+	PutObject(ctx context.Context, key string, body []byte) error
+	GetObject(ctx context.Context, key string) ([]byte, error)
+	DeleteObject(ctx context.Context, key string) error
+}
+
+// FileBlobStore is a BlobStore and a SegmentStorage on the local filesystem.
+// Object keys are used as paths below the root directory.
+type FileBlobStore struct {
+	root string
+}
+
+func NewFileBlobStore(root string) *FileBlobStore {
+	return &FileBlobStore{root: root}
+}
+
+func (f *FileBlobStore) PutObject(_ context.Context, key string, body []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// 書き込み途中のファイルが読まれないように、renameで置き換える
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *FileBlobStore) GetObject(_ context.Context, key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+	return body, err
+}
+
+func (f *FileBlobStore) DeleteObject(_ context.Context, key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// S3と同じく、存在しないobjectの削除は成功とする
+		return nil
+	}
+	return err
+}
+
+// ListObjects returns the keys that start with prefix, in lexical order.
+func (f *FileBlobStore) ListObjects(_ context.Context, prefix string) ([]string, error) {
+	// prefixの最後の"/"までのdirectoryだけを走査する
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+	root, err := f.path(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return err
+		}
+		rel, err := filepath.Rel(f.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (f *FileBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid blob key: %s", key)
+	}
+	return filepath.Join(f.root, clean), nil
+}
+
+// offloadPayload writes the payload of an item to the blob store and replaces it with a reference.
+func (t *itemTable) offloadPayload(ctx context.Context, item map[string]types.AttributeValue, payload []byte) (map[string]types.AttributeValue, error) {
+	key := t.blobKey(item)
+	if err := t.options.blobStore.PutObject(ctx, key, payload); err != nil {
+		return nil, fmt.Errorf("put payload to blob store: %w", err)
+	}
+
+	checksum := sha256.Sum256(payload)
+	ref := make(map[string]types.AttributeValue, len(item))
+	for k, v := range item {
+		ref[k] = v
+	}
+	delete(ref, attrPayload)
+	ref[attrPayloadRef] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+		"key":      &types.AttributeValueMemberS{Value: key},
+		"size":     &types.AttributeValueMemberN{Value: strconv.Itoa(len(payload))},
+		"checksum": &types.AttributeValueMemberS{Value: hex.EncodeToString(checksum[:])},
+	}}
+	return ref, nil
+}
+
+// resolvePayloadRef reads a payload written by offloadPayload and verifies it against the reference.
+func (t *itemTable) resolvePayloadRef(ctx context.Context, ref *types.AttributeValueMemberM) ([]byte, error) {
+	if t.options.blobStore == nil {
+		return nil, fmt.Errorf("payload is in a blob store but no blob store is configured")
+	}
+	key, ok := ref.Value["key"].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, fmt.Errorf("payload reference has no key")
+	}
+	payload, err := t.options.blobStore.GetObject(ctx, key.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	if size, ok := ref.Value["size"].(*types.AttributeValueMemberN); !ok || size.Value != strconv.Itoa(len(payload)) {
+		return nil, fmt.Errorf("%w: size of %s differs", ErrChecksumMismatch, key.Value)
+	}
+	checksum := sha256.Sum256(payload)
+	if expected, ok := ref.Value["checksum"].(*types.AttributeValueMemberS); !ok || expected.Value != hex.EncodeToString(checksum[:]) {
+		return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, key.Value)
+	}
+	return payload, nil
+}
+
+// blobKey mirrors the key of the item and ends with a ULID, e.g. journal/userAccountActor-1/12/01HV3K8Z....
+// Every write gets its own blob, so a stale writer that writes the same index can not overwrite the blob of the current writer.
+func (t *itemTable) blobKey(item map[string]types.AttributeValue) string {
+	actorName := item["actorName"].(*types.AttributeValueMemberS).Value
+	eventIndex := item["eventIndex"].(*types.AttributeValueMemberN).Value
+	return t.table + "/" + url.PathEscape(actorName) + "/" + eventIndex + "/" + ulid.Make().String()
+}
+
+// deleteOffloadedBlob deletes the blob written for an item whose write failed. It is best effort,
+// because the write error matters more, and a blob left behind is never referred to.
+func (t *itemTable) deleteOffloadedBlob(ctx context.Context, item map[string]types.AttributeValue) {
+	if key, ok := payloadRefKey(item); ok {
+		_ = t.options.blobStore.DeleteObject(ctx, key)
+	}
+}
+
+// payloadRefKey returns the key of the blob an item refers to, if its payload is in the blob store.
+func payloadRefKey(item map[string]types.AttributeValue) (string, bool) {
+	ref, ok := item[attrPayloadRef].(*types.AttributeValueMemberM)
+	if !ok {
+		return "", false
+	}
+	key, ok := ref.Value["key"].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", false
+	}
+	return key.Value, true
+}
+
+// guardReplacedBlob makes put fail when the item it replaces refers to another blob than replaced, or to a blob at all
+// if replaced is empty. After put succeeds, the blob it replaced is known and can be deleted.
+func guardReplacedBlob(put *types.Put, replaced string) {
+	put.ExpressionAttributeNames = map[string]string{"#payloadRef": attrPayloadRef}
+	put.ReturnValuesOnConditionCheckFailure = types.ReturnValuesOnConditionCheckFailureAllOld
+	if replaced == "" {
+		put.ConditionExpression = aws.String("attribute_not_exists(#payloadRef)")
+		put.ExpressionAttributeValues = nil
+		return
+	}
+	put.ExpressionAttributeNames["#key"] = "key"
+	put.ConditionExpression = aws.String("#payloadRef.#key = :replaced")
+	put.ExpressionAttributeValues = map[string]types.AttributeValue{
+		":replaced": &types.AttributeValueMemberS{Value: replaced},
+	}
+}
+
+// replacedItem returns the current item when the write of an item failed the condition of guardReplacedBlob.
+// The item is the last write of a transaction.
+func replacedItem(err error) (map[string]types.AttributeValue, bool) {
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return failed.Item, true
+	}
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 {
+		reason := canceled.CancellationReasons[len(canceled.CancellationReasons)-1]
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return reason.Item, true
+		}
+	}
+	return nil, false
+}
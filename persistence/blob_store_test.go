@@ -0,0 +1,171 @@
+package persistence_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store := p.NewFileBlobStore(root)
+
+	key := "journal/testActor/1"
+	assert.NoError(t, store.PutObject(ctx, key, []byte("payload")))
+	_, err := os.Stat(filepath.Join(root, "journal", "testActor", "1"))
+	assert.NoError(t, err)
+
+	body, err := store.GetObject(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("payload"), body)
+
+	// 上書きできる
+	assert.NoError(t, store.PutObject(ctx, key, []byte("updated")))
+	body, err = store.GetObject(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("updated"), body)
+
+	assert.NoError(t, store.DeleteObject(ctx, key))
+	_, err = store.GetObject(ctx, key)
+	assert.ErrorIs(t, err, p.ErrBlobNotFound)
+	// 存在しないobjectの削除はエラーにならない
+	assert.NoError(t, store.DeleteObject(ctx, key))
+
+	// rootの外には書き込めない
+	assert.Error(t, store.PutObject(ctx, "../outside", []byte("payload")))
+}
+
+func TestEventStore_PersistEventWithBlobStore(t *testing.T) {
+	ctx := context.Background()
+	tableName := "journal"
+
+	client := InitializeDynamoDBClient()
+	blobStore := p.NewFileBlobStore(t.TempDir())
+	eventStore := p.NewEventStore(client, tableName, p.WithBlobStore(blobStore, 1024))
+
+	actorName := "testBlobActor"
+	eventIndex := 1
+	eventData := &p.Event{Data: largeSnapshot().Data}
+
+	eventStore.PersistEvent(actorName, eventIndex, eventData)
+
+	// DynamoDBには参照だけが保存されている
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": eventIndex,
+	})
+	assert.NoError(t, err)
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{Key: key, TableName: aws.String(tableName)})
+	assert.NoError(t, err)
+	assert.Nil(t, result.Item["payload"])
+	ref := result.Item["payloadRef"].(*types.AttributeValueMemberM)
+	blobKey := ref.Value["key"].(*types.AttributeValueMemberS).Value
+	assert.True(t, strings.HasPrefix(blobKey, "journal/testBlobActor/1/"), blobKey)
+
+	var events []interface{}
+	eventStore.GetEvents(actorName, eventIndex, 0, func(e interface{}) { events = append(events, e) })
+	assert.Len(t, events, 1)
+	assert.True(t, proto.Equal(eventData, events[0].(*p.Event)))
+
+	// blobが改ざんされていたら読まない
+	assert.NoError(t, blobStore.PutObject(ctx, blobKey, []byte("tampered")))
+	assert.Panics(t, func() {
+		eventStore.GetEvents(actorName, eventIndex, 0, func(e interface{}) {})
+	})
+
+	// クリーンアップ
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(tableName)})
+	assert.NoError(t, err)
+}
+
+func TestEventStore_BlobKeyPerWrite(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	blobStore := p.NewFileBlobStore(t.TempDir())
+	nodeA := p.NewLeases(client, p.DefaultLeaseTable, "node-a", time.Minute)
+	nodeB := p.NewLeases(client, p.DefaultLeaseTable, "node-b", time.Minute)
+	require.NoError(t, p.CreateTables(ctx, client, p.WithLeases(nodeA)))
+
+	actorName := "testBlobEpochActor"
+	deleteLease(t, client, actorName)
+	_, err := nodeA.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	// node-aが気付かないうちにnode-bがleaseを取る
+	takeOverLease(t, client, actorName, "node-b")
+	epoch, err := nodeB.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), epoch)
+
+	providerA := p.NewProviderState(client, p.WithLeases(nodeA), p.WithBlobStore(blobStore, 1024))
+	providerB := p.NewProviderState(client, p.WithLeases(nodeB), p.WithBlobStore(blobStore, 1024))
+	eventB := &p.Event{Data: largeSnapshot().Data}
+	providerB.PersistEvent(actorName, 0, eventB)
+
+	// 古いepochのnodeが同じindexに書いても、新しいnodeのblobは上書きされない
+	err = persistError(func() {
+		providerA.PersistEvent(actorName, 0, &p.Event{Data: largeSnapshot().Data + "stale"})
+	})
+	var stale *p.StaleWriterError
+	require.ErrorAs(t, err, &stale)
+
+	var events []interface{}
+	providerB.GetEvents(actorName, 0, 0, func(e interface{}) { events = append(events, e) })
+	require.Len(t, events, 1)
+	assert.True(t, proto.Equal(eventB, events[0].(*p.Event)))
+
+	// 書き込めなかったblobは残らない
+	keys, err := blobStore.ListObjects(ctx, p.DefaultJournalTable+"/"+actorName+"/0/")
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	// クリーンアップ
+	deleteLease(t, client, actorName)
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+}
+
+func TestEventStore_OverwriteDeletesBlob(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	blobStore := p.NewFileBlobStore(t.TempDir())
+	require.NoError(t, p.CreateTables(ctx, client))
+
+	actorName := "testBlobOverwriteActor"
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+	provider := p.NewProviderState(client, p.WithBlobStore(blobStore, 1024))
+	prefix := p.DefaultJournalTable + "/" + actorName + "/0/"
+
+	provider.PersistEvent(actorName, 0, &p.Event{Data: largeSnapshot().Data})
+	event := &p.Event{Data: largeSnapshot().Data + "rewritten"}
+	provider.PersistEvent(actorName, 0, event)
+
+	// 上書きされたitemのblobは消える
+	keys, err := blobStore.ListObjects(ctx, prefix)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+	var events []interface{}
+	provider.GetEvents(actorName, 0, 0, func(e interface{}) { events = append(events, e) })
+	require.Len(t, events, 1)
+	assert.True(t, proto.Equal(event, events[0].(*p.Event)))
+
+	// blobに置かない大きさのpayloadで上書きしても、前のblobは消える
+	provider.PersistEvent(actorName, 0, &p.Event{Data: "small"})
+	keys, err = blobStore.ListObjects(ctx, prefix)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+}
@@ -0,0 +1,164 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	DefaultChunkTable = "payload_chunks"
+	// DefaultChunkSize leaves room below the 400 KB item limit for keys and metadata attributes.
+	DefaultChunkSize = 350 * 1024
+
+	attrChunks          = "chunks"
+	attrPayloadSize     = "payloadSize"
+	attrPayloadChecksum = "payloadChecksum"
+
+	// TransactWriteItems accepts at most 100 items and 4 MB in total.
+	maxTransactItems = 100
+	maxTransactBytes = 4 * 1024 * 1024
+)
+
+var (
+	// ErrMissingChunk is returned when a chunked payload can not be reassembled because chunks are missing.
+	ErrMissingChunk = errors.New("chunk of payload is missing")
+	// ErrChecksumMismatch is returned when a reassembled payload does not match the checksum it was written with.
+	ErrChecksumMismatch = errors.New("payload checksum mismatch")
+)
+
+// chunkPayload splits the payload of an item into chunk items and returns the manifest item that replaces it.
+func (t *itemTable) chunkPayload(item map[string]types.AttributeValue, payload []byte) (map[string]types.AttributeValue, []types.TransactWriteItem, error) {
+	if len(payload) > maxTransactBytes-t.options.chunkSize {
+		return nil, nil, fmt.Errorf("payload of %d bytes is too large to be written in one transaction", len(payload))
+	}
+
+	chunkKey := t.chunkKey(item)
+	eventIndex := item["eventIndex"].(*types.AttributeValueMemberN).Value
+	checksum := sha256.Sum256(payload)
+
+	var writes []types.TransactWriteItem
+	for i, offset := 0, 0; offset < len(payload); i, offset = i+1, offset+t.options.chunkSize {
+		end := min(offset+t.options.chunkSize, len(payload))
+		writes = append(writes, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(t.options.chunkTable),
+				Item: map[string]types.AttributeValue{
+					"chunkKey": &types.AttributeValueMemberS{Value: chunkKey},
+					"chunkId":  &types.AttributeValueMemberS{Value: chunkID(eventIndex, i)},
+					"data":     &types.AttributeValueMemberB{Value: payload[offset:end]},
+				},
+			},
+		})
+	}
+	if len(writes)+1 > maxTransactItems {
+		return nil, nil, fmt.Errorf("payload of %d bytes needs too many chunks", len(payload))
+	}
+
+	manifest := make(map[string]types.AttributeValue, len(item))
+	for k, v := range item {
+		manifest[k] = v
+	}
+	delete(manifest, attrPayload)
+	manifest[attrChunks] = &types.AttributeValueMemberN{Value: strconv.Itoa(len(writes))}
+	manifest[attrPayloadSize] = &types.AttributeValueMemberN{Value: strconv.Itoa(len(payload))}
+	manifest[attrPayloadChecksum] = &types.AttributeValueMemberS{Value: hex.EncodeToString(checksum[:])}
+	return manifest, writes, nil
+}
+
+// readChunks reassembles a payload written by chunkPayload and verifies it against the manifest.
+func (t *itemTable) readChunks(ctx context.Context, item map[string]types.AttributeValue, chunksAttr *types.AttributeValueMemberN) ([]byte, error) {
+	if t.options.chunkTable == "" {
+		return nil, fmt.Errorf("payload is chunked but no chunk table is configured")
+	}
+	chunks, err := strconv.Atoi(chunksAttr.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	eventIndex := item["eventIndex"].(*types.AttributeValueMemberN).Value
+	prefix := chunkID(eventIndex, 0)[:21]
+	paginator := dynamodb.NewQueryPaginator(t.client, &dynamodb.QueryInput{
+		TableName:              aws.String(t.options.chunkTable),
+		KeyConditionExpression: aws.String("chunkKey = :chunkKey AND begins_with(chunkId, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":chunkKey": &types.AttributeValueMemberS{Value: t.chunkKey(item)},
+			":prefix":   &types.AttributeValueMemberS{Value: prefix},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+
+	var buf bytes.Buffer
+	next := 0
+	for paginator.HasMorePages() && next < chunks {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range page.Items {
+			// snapshotを上書きした場合、前回の余分なchunkが残っていることがある
+			if next == chunks {
+				break
+			}
+			id := chunk["chunkId"].(*types.AttributeValueMemberS).Value
+			if id != chunkID(eventIndex, next) {
+				return nil, fmt.Errorf("%w: expected %s, found %s", ErrMissingChunk, chunkID(eventIndex, next), id)
+			}
+			buf.Write(chunk["data"].(*types.AttributeValueMemberB).Value)
+			next++
+		}
+	}
+	if next != chunks {
+		return nil, fmt.Errorf("%w: found %d of %d chunks", ErrMissingChunk, next, chunks)
+	}
+
+	checksum := sha256.Sum256(buf.Bytes())
+	if expected, ok := item[attrPayloadChecksum].(*types.AttributeValueMemberS); !ok || expected.Value != hex.EncodeToString(checksum[:]) {
+		return nil, ErrChecksumMismatch
+	}
+	return buf.Bytes(), nil
+}
+
+// deleteChunks deletes the chunk items of a chunked item.
+func (t *itemTable) deleteChunks(ctx context.Context, item map[string]types.AttributeValue, chunksAttr *types.AttributeValueMemberN) error {
+	if t.options.chunkTable == "" {
+		return nil
+	}
+	chunks, err := strconv.Atoi(chunksAttr.Value)
+	if err != nil {
+		return err
+	}
+	eventIndex := item["eventIndex"].(*types.AttributeValueMemberN).Value
+	for i := 0; i < chunks; i++ {
+		_, err := t.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(t.options.chunkTable),
+			Key: map[string]types.AttributeValue{
+				"chunkKey": &types.AttributeValueMemberS{Value: t.chunkKey(item)},
+				"chunkId":  &types.AttributeValueMemberS{Value: chunkID(eventIndex, i)},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("delete chunk: %w", err)
+		}
+	}
+	return nil
+}
+
+// chunkKey shares the key of the chunked item, so the chunks of one actor live in one partition.
+func (t *itemTable) chunkKey(item map[string]types.AttributeValue) string {
+	return t.table + "#" + item["actorName"].(*types.AttributeValueMemberS).Value
+}
+
+// chunkID sorts chunks by event index and chunk index.
+func chunkID(eventIndex string, chunk int) string {
+	index, _ := strconv.Atoi(eventIndex)
+	return fmt.Sprintf("%020d#%05d", index, chunk)
+}
@@ -0,0 +1,131 @@
+package persistence
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// Codec compresses payload bytes before they are written to DynamoDB.
+// The codec name is stored with each item, so it must never change once data has been written.
+type Codec interface {
+	Name() string
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(NoneCodec())
+	RegisterCodec(GzipCodec())
+	RegisterCodec(ZstdCodec())
+}
+
+// RegisterCodec makes a codec available for decoding items written with its name.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// LookupCodec returns the codec registered under name.
+// An empty name means the item was written without compression.
+func LookupCodec(name string) (Codec, error) {
+	if name == "" {
+		name = CodecNone
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec: %s", name)
+	}
+	return codec, nil
+}
+
+type noneCodec struct{}
+
+// NoneCodec stores payloads as they are.
+func NoneCodec() Codec {
+	return noneCodec{}
+}
+
+func (noneCodec) Name() string                      { return CodecNone }
+func (noneCodec) Encode(src []byte) ([]byte, error) { return src, nil }
+func (noneCodec) Decode(src []byte) ([]byte, error) { return src, nil }
+
+type gzipCodec struct{}
+
+// GzipCodec compresses payloads with gzip at the default level.
+func GzipCodec() Codec {
+	return gzipCodec{}
+}
+
+func (gzipCodec) Name() string { return CodecGzip }
+
+func (gzipCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+var (
+	zstdOnce     sync.Once
+	zstdInstance *zstdCodec
+)
+
+// ZstdCodec compresses payloads with zstd.
+// The encoder and decoder are shared, since EncodeAll and DecodeAll are safe for concurrent use.
+func ZstdCodec() Codec {
+	zstdOnce.Do(func() {
+		// nil writer/reader never fail with default options
+		encoder, _ := zstd.NewWriter(nil)
+		decoder, _ := zstd.NewReader(nil)
+		zstdInstance = &zstdCodec{encoder: encoder, decoder: decoder}
+	})
+	return zstdInstance
+}
+
+func (z *zstdCodec) Name() string { return CodecZstd }
+
+func (z *zstdCodec) Encode(src []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(src, nil), nil
+}
+
+func (z *zstdCodec) Decode(src []byte) ([]byte, error) {
+	return z.decoder.DecodeAll(src, nil)
+}
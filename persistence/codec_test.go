@@ -0,0 +1,76 @@
+package persistence_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/proto"
+)
+
+func largeSnapshot() *p.Snapshot {
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, `{"id":"%06d","email":"user%06d@example.com","status":"active"},`, i, i)
+	}
+	return &p.Snapshot{Type: "UserAccounts", Data: sb.String()}
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	payload, err := proto.Marshal(largeSnapshot())
+	assert.NoError(t, err)
+
+	for _, codec := range []p.Codec{p.NoneCodec(), p.GzipCodec(), p.ZstdCodec()} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			encoded, err := codec.Encode(payload)
+			assert.NoError(t, err)
+			if codec.Name() != p.CodecNone {
+				assert.Less(t, len(encoded), len(payload))
+			}
+
+			decoded, err := codec.Decode(encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, payload, decoded)
+		})
+	}
+}
+
+func TestLookupCodec(t *testing.T) {
+	// codec attributeのない古いitemは無圧縮として読む
+	codec, err := p.LookupCodec("")
+	assert.NoError(t, err)
+	assert.Equal(t, p.CodecNone, codec.Name())
+
+	codec, err = p.LookupCodec(p.CodecZstd)
+	assert.NoError(t, err)
+	assert.Equal(t, p.CodecZstd, codec.Name())
+
+	_, err = p.LookupCodec("lz4")
+	assert.Error(t, err)
+}
+
+// go test -bench Codec -run ^$ ./persistence
+// item-bytesがDynamoDBに書き込まれるpayloadのサイズ
+func BenchmarkCodec(b *testing.B) {
+	payload, err := proto.Marshal(largeSnapshot())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, codec := range []p.Codec{p.NoneCodec(), p.GzipCodec(), p.ZstdCodec()} {
+		b.Run(codec.Name(), func(b *testing.B) {
+			var encoded []byte
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				encoded, err = codec.Encode(payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(encoded)), "item-bytes")
+			b.ReportMetric(float64(len(encoded))/float64(len(payload)), "ratio")
+		})
+	}
+}
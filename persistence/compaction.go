@@ -0,0 +1,151 @@
+package persistence
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	DefaultArchiveTable = "journal_archive"
+
+	meterName = "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	// batchWriteSize is the item limit of BatchWriteItem.
+	batchWriteSize = 25
+)
+
+// Archiver keeps journal items before compaction deletes them. Items are passed as they are stored,
+// so chunked and blob payloads still refer to the chunk table and the blob store, which compaction leaves in place.
+type Archiver interface {
+	Archive(ctx context.Context, actorName string, items []map[string]types.AttributeValue) error
+}
+
+// TableArchiver copies journal items to a table with the schema of the journal.
+type TableArchiver struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func NewTableArchiver(client *dynamodb.Client, table string) *TableArchiver {
+	return &TableArchiver{client: client, table: table}
+}
+
+func (a *TableArchiver) Archive(ctx context.Context, _ string, items []map[string]types.AttributeValue) error {
+	requests := make([]types.WriteRequest, 0, len(items))
+	for _, item := range items {
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+	return batchWrite(ctx, a.client, a.table, requests)
+}
+
+// compactor deletes the events that a snapshot makes unnecessary for recovery, in the background.
+// Requests for an actor that is waiting for its turn are merged, so at most one compaction per actor is pending,
+// and at most concurrency compactions run at a time.
+type compactor struct {
+	store        *EventStore
+	safetyMargin int
+	archiver     Archiver
+	slots        chan struct{}
+	metrics      compactionMetrics
+
+	mu      sync.Mutex
+	pending map[string]int
+	running sync.WaitGroup
+}
+
+type compactionMetrics struct {
+	runs     metric.Int64Counter
+	deleted  metric.Int64Counter
+	archived metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+func newCompactor(store *EventStore, o *options) *compactor {
+	meter := o.meterProvider.Meter(meterName)
+	c := &compactor{
+		store:        store,
+		safetyMargin: o.compaction.safetyMargin,
+		archiver:     o.compaction.archiver,
+		slots:        make(chan struct{}, max(o.compaction.concurrency, 1)),
+		pending:      map[string]int{},
+	}
+	// 計装の作成に失敗しても、noopの計装が返るので使い続けられる
+	c.metrics.runs, _ = meter.Int64Counter("persistence.compaction.runs",
+		metric.WithDescription("Compactions of the journal of an actor, by outcome."))
+	c.metrics.deleted, _ = meter.Int64Counter("persistence.compaction.events.deleted",
+		metric.WithDescription("Events deleted from the journal by compaction."))
+	c.metrics.archived, _ = meter.Int64Counter("persistence.compaction.events.archived",
+		metric.WithDescription("Events archived by compaction before they were deleted."))
+	c.metrics.duration, _ = meter.Float64Histogram("persistence.compaction.duration",
+		metric.WithDescription("Duration of a compaction."), metric.WithUnit("s"))
+	return c
+}
+
+// snapshotPersisted schedules the compaction of the events of actorName covered by a snapshot at snapshotIndex.
+func (c *compactor) snapshotPersisted(actorName string, snapshotIndex int) {
+	// recoveryはsnapshotのindexのeventからreplayするので、そのeventは必ず残す
+	upTo := snapshotIndex - max(c.safetyMargin, 1)
+	if upTo < 0 {
+		return
+	}
+
+	c.mu.Lock()
+	if pending, ok := c.pending[actorName]; ok {
+		c.pending[actorName] = max(pending, upTo)
+		c.mu.Unlock()
+		return
+	}
+	c.pending[actorName] = upTo
+	c.mu.Unlock()
+
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		c.slots <- struct{}{}
+		defer func() { <-c.slots }()
+
+		c.mu.Lock()
+		upTo := c.pending[actorName]
+		delete(c.pending, actorName)
+		c.mu.Unlock()
+		c.compact(context.Background(), actorName, upTo)
+	}()
+}
+
+// compact deletes the events of actorName up to upTo. With WithSoftDelete the events are tombstoned like DeleteEvents does,
+// and as they stay in the journal, they are not archived.
+func (c *compactor) compact(ctx context.Context, actorName string, upTo int) {
+	start := time.Now()
+	var deleted int
+	var err error
+	archiver := c.archiver
+	if soft := c.store.options.softDelete; soft != nil {
+		archiver = nil
+		deleted, err = c.store.TombstoneEvents(ctx, actorName, upTo, soft.reason)
+	} else {
+		deleted, err = c.store.deleteEvents(ctx, actorName, upTo, archiver)
+	}
+
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+		log.Printf("compact journal of %s up to %d: %s", actorName, upTo, err)
+	}
+	c.metrics.runs.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	c.metrics.deleted.Add(ctx, int64(deleted))
+	if archiver != nil {
+		c.metrics.archived.Add(ctx, int64(deleted))
+	}
+	c.metrics.duration.Record(ctx, time.Since(start).Seconds())
+}
+
+// wait waits for the scheduled compactions to finish.
+func (c *compactor) wait() {
+	c.running.Wait()
+}
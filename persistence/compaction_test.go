@@ -0,0 +1,199 @@
+package persistence_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestProviderState_Compaction(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	reader := sdkmetric.NewManualReader()
+	opts := []p.Option{
+		p.WithCompaction(1, 2),
+		p.WithCompactionArchive(p.NewTableArchiver(client, p.DefaultArchiveTable)),
+		p.WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	actorName := "testCompactionActor"
+	for i, data := range []string{"event1", "event2", "event3", "event4", "event5", "event6"} {
+		provider.PersistEvent(actorName, i, &p.Event{Data: data})
+	}
+	provider.PersistSnapshot(actorName, 4, &p.Snapshot{Data: "snapshot"})
+	provider.WaitForCompactions()
+
+	// snapshotのindexのeventから後は残る
+	var data []string
+	provider.GetEvents(actorName, 4, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Equal(t, []string{"event5", "event6"}, data)
+
+	snapshot, eventIndex, ok := provider.GetSnapshot(actorName)
+	require.True(t, ok)
+	assert.Equal(t, "snapshot", snapshot.(*p.Snapshot).Data)
+	assert.Equal(t, 4, eventIndex)
+
+	// 消したeventはarchiveに残る
+	archived, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(p.DefaultArchiveTable),
+		KeyConditionExpression: aws.String("actorName = :actorName"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	require.NoError(t, err)
+	assert.Len(t, archived.Items, 4)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	sums := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok {
+				for _, dp := range sum.DataPoints {
+					sums[m.Name] += dp.Value
+				}
+			}
+		}
+	}
+	assert.Equal(t, int64(1), sums["persistence.compaction.runs"])
+	assert.Equal(t, int64(4), sums["persistence.compaction.events.deleted"])
+	assert.Equal(t, int64(4), sums["persistence.compaction.events.archived"])
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorName)
+	deleteActorItems(t, client, p.DefaultArchiveTable, actorName)
+}
+
+func TestProviderState_CompactionWhileWriting(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	opts := []p.Option{p.WithCompaction(1, 1), p.WithActorMetadata(p.DefaultActorMetadataTable)}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	// compactionとeventの書き込みが同じmetadataのitemを更新しても、書き込みは失敗しない
+	actorName := "testCompactionWriteActor"
+	for i := 0; i < 30; i++ {
+		require.NoError(t, provider.AppendEvent(ctx, actorName, i, &p.Event{Data: strconv.Itoa(i)}))
+		if i%3 == 0 {
+			require.NoError(t, provider.SaveSnapshot(ctx, actorName, i, &p.Snapshot{Data: strconv.Itoa(i)}))
+		}
+	}
+	provider.WaitForCompactions()
+
+	metadata, ok, err := provider.ActorMetadata(ctx, actorName)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 29, metadata.HighestEventIndex)
+	assert.Equal(t, 27, metadata.LastSnapshotIndex)
+	var data []string
+	provider.GetEvents(actorName, 27, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Equal(t, []string{"27", "28", "29"}, data)
+
+	// クリーンアップ
+	_, err = provider.PurgeActor(ctx, actorName)
+	require.NoError(t, err)
+}
+
+func TestProviderState_CompactionWithSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	opts := []p.Option{p.WithCompaction(1, 1), p.WithSoftDelete("compaction")}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	actorName := "testSoftCompactionActor"
+	for i, data := range []string{"event1", "event2", "event3", "event4", "event5"} {
+		provider.PersistEvent(actorName, i, &p.Event{Data: data})
+	}
+	provider.PersistSnapshot(actorName, 3, &p.Snapshot{Data: "snapshot"})
+	provider.WaitForCompactions()
+
+	// compactionはeventを消さずにtombstoneする
+	var reasons []string
+	require.NoError(t, p.NewEventStore(client, p.DefaultJournalTable).ReadEventsIncludingDeleted(ctx, actorName, 0, 0, func(envelope p.EventEnvelope) error {
+		reason := ""
+		if envelope.Metadata.Tombstone != nil {
+			reason = envelope.Metadata.Tombstone.Reason
+		}
+		reasons = append(reasons, reason)
+		return nil
+	}))
+	assert.Equal(t, []string{"compaction", "compaction", "compaction", "", ""}, reasons)
+
+	var data []string
+	provider.GetEvents(actorName, 3, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Equal(t, []string{"event4", "event5"}, data)
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorName)
+}
+
+func TestProviderState_CompactionWithoutSnapshot(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	for _, metadata := range []bool{false, true} {
+		t.Run("metadata="+strconv.FormatBool(metadata), func(t *testing.T) {
+			opts := []p.Option{p.WithCompaction(1, 2)}
+			if metadata {
+				opts = append(opts, p.WithActorMetadata(p.DefaultActorMetadataTable))
+			}
+			require.NoError(t, p.CreateTables(ctx, client, opts...))
+			provider := p.NewProviderState(client, opts...)
+
+			actorName := "testCompactionWithoutSnapshotActor"
+			for i, data := range []string{"event1", "event2", "event3", "event4", "event5", "event6"} {
+				provider.PersistEvent(actorName, i, &p.Event{Data: data})
+			}
+			provider.PersistSnapshot(actorName, 4, &p.Snapshot{Data: "snapshot"})
+			provider.WaitForCompactions()
+
+			// snapshotが使えないと最初からreplayすることになるが、消したeventを飛ばして続けない
+			migrations := p.NewSnapshotMigrations()
+			migrations.Register(snapshotTypeName, 1, func(interface{}) (interface{}, error) {
+				return nil, errors.New("broken migration")
+			})
+			recovering := p.NewProviderState(client, append(opts, p.WithSnapshotMigrations(migrations), p.WithIgnoreUnmigratableSnapshots())...)
+			_, _, ok := recovering.GetSnapshot(actorName)
+			require.False(t, ok)
+			var replayed []interface{}
+			err := persistError(func() {
+				recovering.GetEvents(actorName, 0, 0, func(e interface{}) {
+					replayed = append(replayed, e)
+				})
+			})
+			assert.ErrorIs(t, err, p.ErrJournalTruncated)
+			assert.Empty(t, replayed)
+
+			// クリーンアップ
+			_, err = provider.PurgeActor(ctx, actorName)
+			require.NoError(t, err)
+		})
+	}
+}
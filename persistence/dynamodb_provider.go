@@ -1,6 +1,11 @@
 package persistence
 
 import (
+	"context"
+	"errors"
+	"log"
+	"math"
+
 	"github.com/asynkron/protoactor-go/persistence"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -9,18 +14,27 @@ import (
 
 // ProviderState is an object containing the implementation for the provider
 type ProviderState struct {
-	snapshotStore persistence.SnapshotStore
-	eventStore    persistence.EventStore
+	snapshotStore *SnapshotStore
+	eventStore    *EventStore
+	options       *options
+	compactor     *compactor
 }
 
 // NewProviderState creates a new instance of ProviderState
-func NewProviderState(client *dynamodb.Client) *ProviderState {
-	snapshotStoreTable := "snapshot"
-	eventStoreTable := "journal"
-	return &ProviderState{
-		snapshotStore: NewSnapshotStore(client, snapshotStoreTable),
-		eventStore:    NewEventStore(client, eventStoreTable),
+func NewProviderState(client *dynamodb.Client, opts ...Option) *ProviderState {
+	snapshotStoreTable := DefaultSnapshotTable
+	eventStoreTable := DefaultJournalTable
+	// storeが同じoptionsを共有しないと、cacheやcounterなどの状態を持つoptionが別々になる
+	o := newOptions(opts)
+	p := &ProviderState{
+		snapshotStore: newSnapshotStore(client, snapshotStoreTable, o),
+		eventStore:    newEventStore(client, eventStoreTable, o),
+		options:       o,
+	}
+	if p.options.compaction != nil {
+		p.compactor = newCompactor(p.eventStore, p.options)
 	}
+	return p
 }
 
 // GetState returns the current state of the provider
@@ -37,12 +51,71 @@ func (p *ProviderState) GetSnapshotInterval() int {
 	return 3
 }
 
+// ForgetActor destroys the data key of the actor, so that its encrypted events and snapshots can no longer be read.
+// This is how personal data is erased from an append-only journal. The cached snapshot of the actor is dropped as well.
+func (p *ProviderState) ForgetActor(ctx context.Context, actorName string) error {
+	if p.options.keyStore == nil {
+		return errors.New("encryption is not enabled")
+	}
+	if err := p.options.keyStore.ForgetActor(ctx, actorName); err != nil {
+		return err
+	}
+	if p.snapshotStore.cache != nil {
+		p.snapshotStore.cache.invalidate(actorName, math.MaxInt)
+	}
+	return nil
+}
+
+// EventsByTag returns the next page of events tagged with tag after fromOffset. See EventStore.EventsByTag.
+func (p *ProviderState) EventsByTag(ctx context.Context, tag string, fromOffset string) (*TaggedEventsPage, error) {
+	return p.eventStore.EventsByTag(ctx, tag, fromOffset)
+}
+
+// EventsSince returns the next page of events of all actors after globalSeq. See EventStore.EventsSince.
+func (p *ProviderState) EventsSince(ctx context.Context, globalSeq int64) (*SequencedEventsPage, error) {
+	return p.eventStore.EventsSince(ctx, globalSeq)
+}
+
+// ActorMetadata returns the journal metadata of actorName. See EventStore.ActorMetadata.
+func (p *ProviderState) ActorMetadata(ctx context.Context, actorName string) (ActorMetadata, bool, error) {
+	return p.eventStore.ActorMetadata(ctx, actorName)
+}
+
 func (p *ProviderState) GetSnapshot(actorName string) (snapshot interface{}, eventIndex int, ok bool) {
 	return p.snapshotStore.GetSnapshot(actorName)
 }
 
+// LoadSnapshot returns the latest snapshot of actorName like GetSnapshot, and returns the error instead of panicking.
+// See SnapshotStore.LoadSnapshot.
+func (p *ProviderState) LoadSnapshot(ctx context.Context, actorName string) (SnapshotEnvelope, bool, error) {
+	return p.snapshotStore.LoadSnapshot(ctx, actorName)
+}
+
+// PersistSnapshot saves a snapshot like SaveSnapshot, and logs the error if it fails instead of crashing the actor.
 func (p *ProviderState) PersistSnapshot(actorName string, snapshotIndex int, snapshot protoreflect.ProtoMessage) {
-	p.snapshotStore.PersistSnapshot(actorName, snapshotIndex, snapshot)
+	if err := p.SaveSnapshot(context.Background(), actorName, snapshotIndex, snapshot); err != nil {
+		log.Printf("persist snapshot %d of %s: %s", snapshotIndex, actorName, err)
+	}
+}
+
+// SaveSnapshot writes the snapshot of actorName at snapshotIndex, and then schedules the compaction of the journal
+// with WithCompaction. The journal is not compacted after a snapshot that failed.
+// The snapshot can be any message the serializers support. See SnapshotStore.SaveSnapshot.
+func (p *ProviderState) SaveSnapshot(ctx context.Context, actorName string, snapshotIndex int, snapshot interface{}) error {
+	if err := p.snapshotStore.SaveSnapshot(ctx, actorName, snapshotIndex, snapshot); err != nil {
+		return err
+	}
+	if p.compactor != nil {
+		p.compactor.snapshotPersisted(actorName, snapshotIndex)
+	}
+	return nil
+}
+
+// WaitForCompactions waits for the compactions scheduled by PersistSnapshot to finish, e.g. before the process exits.
+func (p *ProviderState) WaitForCompactions() {
+	if p.compactor != nil {
+		p.compactor.wait()
+	}
 }
 
 func (p *ProviderState) DeleteSnapshots(actorName string, inclusiveToIndex int) {
@@ -57,6 +130,22 @@ func (p *ProviderState) PersistEvent(actorName string, eventIndex int, event pro
 	p.eventStore.PersistEvent(actorName, eventIndex, event)
 }
 
+// AppendEvent writes the event of actorName at eventIndex and returns the error instead of panicking.
+// The event can be any message the serializers support. See EventStore.AppendEvent.
+func (p *ProviderState) AppendEvent(ctx context.Context, actorName string, eventIndex int, event interface{}) error {
+	return p.eventStore.AppendEvent(ctx, actorName, eventIndex, event)
+}
+
 func (p *ProviderState) DeleteEvents(actorName string, inclusiveToIndex int) {
 	p.eventStore.DeleteEvents(actorName, inclusiveToIndex)
+}
+
+// TombstoneEvents hides the events of actorName up to inclusiveToIndex with reason. See EventStore.TombstoneEvents.
+func (p *ProviderState) TombstoneEvents(ctx context.Context, actorName string, inclusiveToIndex int, reason string) (int, error) {
+	return p.eventStore.TombstoneEvents(ctx, actorName, inclusiveToIndex, reason)
+}
+
+// PurgeEvents removes the events of actorName up to inclusiveToIndex, including tombstoned ones. See EventStore.PurgeEvents.
+func (p *ProviderState) PurgeEvents(ctx context.Context, actorName string, inclusiveToIndex int) (int, error) {
+	return p.eventStore.PurgeEvents(ctx, actorName, inclusiveToIndex)
 }
\ No newline at end of file
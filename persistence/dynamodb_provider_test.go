@@ -11,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
 
 	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
@@ -267,3 +268,73 @@ func TestDeleteEvents(t *testing.T) {
 	ps := p.NewProviderState(client)
 	ps.DeleteEvents("testActor", 1)
 }
+
+func TestForgetActor(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	keyProvider, err := p.NewStaticKeyProvider("test-key", make([]byte, 32))
+	assert.NoError(t, err)
+	opts := []p.Option{p.WithEncryption(p.NewKeyStore(client, p.DefaultKeyTable, keyProvider))}
+	assert.NoError(t, p.CreateTables(ctx, client, opts...))
+	ps := p.NewProviderState(client, opts...)
+
+	actorName := "testForgottenActor"
+	ps.PersistEvent(actorName, 1, &p.Event{Data: "user@example.com"})
+
+	// payloadは暗号化されている
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": 1,
+	})
+	assert.NoError(t, err)
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{Key: key, TableName: aws.String("journal")})
+	assert.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "AES-256-GCM"}, result.Item["encryption"])
+	assert.NotContains(t, string(result.Item["payload"].(*types.AttributeValueMemberB).Value), "user@example.com")
+
+	var events []interface{}
+	ps.GetEvents(actorName, 1, 0, func(e interface{}) { events = append(events, e) })
+	assert.Len(t, events, 1)
+
+	// 鍵を破棄すると、eventは読めなくなり、代わりのeventがreplayされる
+	assert.NoError(t, ps.ForgetActor(ctx, actorName))
+	events = nil
+	ps.GetEvents(actorName, 1, 0, func(e interface{}) { events = append(events, e) })
+	assert.Equal(t, []interface{}{&p.SkippedEvent{ActorName: actorName, EventIndex: 1, Reason: p.SkipForgotten}}, events)
+
+	// クリーンアップ
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String("journal")})
+	assert.NoError(t, err)
+}
+
+func TestForgetActor_Recovery(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	keyProvider, err := p.NewStaticKeyProvider("test-key", make([]byte, 32))
+	require.NoError(t, err)
+	opts := []p.Option{p.WithEncryption(p.NewKeyStore(client, p.DefaultKeyTable, keyProvider))}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	ps := p.NewProviderState(client, opts...)
+
+	actorName := "testForgottenRecoveryActor"
+	runJournalActor(t, ps, actorName, &p.Event{Data: "event1"}, &p.Event{Data: "event2"})
+	require.NoError(t, ps.ForgetActor(ctx, actorName))
+
+	// 読めないeventも1つずつreplayされるので、次のeventは続きのindexに書かれる
+	replayed := runJournalActor(t, ps, actorName, &p.Event{Data: "event3"})
+	assert.Equal(t, []interface{}{
+		&p.SkippedEvent{ActorName: actorName, EventIndex: 0, Reason: p.SkipForgotten},
+		&p.SkippedEvent{ActorName: actorName, EventIndex: 1, Reason: p.SkipForgotten},
+	}, replayed)
+	var indexes []int
+	require.NoError(t, p.NewEventStore(client, p.DefaultJournalTable, opts...).ReadEvents(ctx, actorName, 0, 0, func(envelope p.EventEnvelope) error {
+		indexes = append(indexes, envelope.EventIndex)
+		assert.Equal(t, "event3", envelope.Event.(*p.Event).Data)
+		return nil
+	}))
+	assert.Equal(t, []int{2}, indexes)
+
+	// クリーンアップ
+	require.NoError(t, ps.ForgetActor(ctx, actorName))
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+}
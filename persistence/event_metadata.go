@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	attrWrittenAt = "writtenAt"
+	attrWriterID  = "writerId"
+	attrEventType = "eventType"
+	attrTags      = "tags"
+)
+
+// Tagger returns the tags stored with an event, e.g. the aggregate type or a correlation ID.
+type Tagger func(event interface{}) []string
+
+// EventMetadata is what the journal records about an event besides its payload.
+// Events written before metadata existed have only the schema version.
+type EventMetadata struct {
+	WrittenAt     time.Time
+	WriterID      string
+	EventType     string
+	Tags          []string
+	Headers       map[string]string
+	SchemaVersion int
+	// WriterEpoch is the lease epoch the event was written under, or 0 without leases.
+	WriterEpoch int64
+	// Tombstone is set on events hidden by TombstoneEvents, when they are read with ReadEventsIncludingDeleted.
+	Tombstone *Tombstone
+}
+
+// EventEnvelope is an event replayed with its position in the journal and its metadata.
+// Events upcast from one stored event share its index and metadata.
+type EventEnvelope struct {
+	ActorName  string
+	EventIndex int
+	Event      interface{}
+	Metadata   EventMetadata
+}
+
+// defaultWriterID identifies the node by its hostname, which is the pod name on Kubernetes.
+func defaultWriterID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
+
+// metadataAttributes returns the metadata attributes of a journal item for event.
+func (o *options) metadataAttributes(actorName string, event interface{}) map[string]types.AttributeValue {
+	writtenAt := o.clock()
+	attrs := map[string]types.AttributeValue{
+		attrWrittenAt:     &types.AttributeValueMemberS{Value: writtenAt.UTC().Format(time.RFC3339Nano)},
+		attrEventType:     &types.AttributeValueMemberS{Value: typeName(event)},
+		attrSchemaVersion: &types.AttributeValueMemberN{Value: strconv.Itoa(o.upcasters.CurrentVersion(typeName(event)))},
+	}
+	if o.writerID != "" {
+		attrs[attrWriterID] = &types.AttributeValueMemberS{Value: o.writerID}
+	}
+	if o.tagger != nil {
+		// DynamoDBのstring setは空にできないので、tagがなければ属性ごと省く
+		if tags := uniqueTags(o.tagger(event)); len(tags) > 0 {
+			attrs[attrTags] = &types.AttributeValueMemberSS{Value: tags}
+		}
+	}
+	if o.headerCapture != nil {
+		if headers, ok := o.headerCapture.headersAttribute(actorName); ok {
+			attrs[attrHeaders] = headers
+		}
+	}
+	return attrs
+}
+
+// uniqueTags removes repeated tags, which a string set can not hold, keeping the first of each.
+func uniqueTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	unique := tags[:0:0]
+	for _, tag := range tags {
+		if !seen[tag] {
+			seen[tag] = true
+			unique = append(unique, tag)
+		}
+	}
+	return unique
+}
+
+// readMetadata reads the metadata attributes of a journal item.
+func readMetadata(item map[string]types.AttributeValue) (EventMetadata, error) {
+	version, err := schemaVersion(item)
+	if err != nil {
+		return EventMetadata{}, err
+	}
+	metadata := EventMetadata{SchemaVersion: version}
+	if v, ok := item[attrWrittenAt].(*types.AttributeValueMemberS); ok {
+		metadata.WrittenAt, err = time.Parse(time.RFC3339Nano, v.Value)
+		if err != nil {
+			return EventMetadata{}, err
+		}
+	}
+	if v, ok := item[attrWriterID].(*types.AttributeValueMemberS); ok {
+		metadata.WriterID = v.Value
+	}
+	if v, ok := item[attrEventType].(*types.AttributeValueMemberS); ok {
+		metadata.EventType = v.Value
+	}
+	if v, ok := item[attrTags].(*types.AttributeValueMemberSS); ok {
+		metadata.Tags = v.Value
+	}
+	if v, ok := item[attrWriterEpoch].(*types.AttributeValueMemberN); ok {
+		metadata.WriterEpoch, err = strconv.ParseInt(v.Value, 10, 64)
+		if err != nil {
+			return EventMetadata{}, err
+		}
+	}
+	metadata.Headers = readHeaders(item)
+	return metadata, nil
+}
@@ -0,0 +1,127 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEventStore_PersistEventWithMetadata(t *testing.T) {
+	ctx := context.Background()
+	tableName := "journal"
+
+	client := InitializeDynamoDBClient()
+	writtenAt := time.Date(2024, 4, 13, 4, 54, 29, 123000000, time.FixedZone("JST", 9*60*60))
+	opts := []p.Option{
+		p.WithClock(func() time.Time { return writtenAt }),
+		p.WithWriterID("node-1"),
+		p.WithTagger(func(event interface{}) []string {
+			if e := event.(*p.Event); e.Type != "" {
+				return []string{"user", e.Type}
+			}
+			return nil
+		}),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	eventStore := p.NewEventStore(client, tableName, opts...)
+
+	actorName := "testMetadataActor"
+	eventStore.PersistEvent(actorName, 1, &p.Event{Type: "CreateUserAccount"})
+	eventStore.PersistEvent(actorName, 2, &p.Event{})
+
+	// 書き込まれた属性の検証
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": 1,
+	})
+	require.NoError(t, err)
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{Key: key, TableName: aws.String(tableName)})
+	require.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "2024-04-12T19:54:29.123Z"}, result.Item["writtenAt"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "node-1"}, result.Item["writerId"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "persistence.Event"}, result.Item["eventType"])
+	assert.ElementsMatch(t, []string{"user", "CreateUserAccount"}, result.Item["tags"].(*types.AttributeValueMemberSS).Value)
+
+	var envelopes []p.EventEnvelope
+	eventStore.GetEventEnvelopes(actorName, 1, 0, func(envelope p.EventEnvelope) {
+		envelopes = append(envelopes, envelope)
+	})
+	require.Len(t, envelopes, 2)
+
+	assert.Equal(t, actorName, envelopes[0].ActorName)
+	assert.Equal(t, 1, envelopes[0].EventIndex)
+	assert.True(t, proto.Equal(&p.Event{Type: "CreateUserAccount"}, envelopes[0].Event.(*p.Event)))
+	assert.True(t, writtenAt.Equal(envelopes[0].Metadata.WrittenAt))
+	assert.Equal(t, "node-1", envelopes[0].Metadata.WriterID)
+	assert.Equal(t, "persistence.Event", envelopes[0].Metadata.EventType)
+	assert.ElementsMatch(t, []string{"user", "CreateUserAccount"}, envelopes[0].Metadata.Tags)
+	assert.Equal(t, 1, envelopes[0].Metadata.SchemaVersion)
+
+	// tagがないeventにはtags属性を書かない
+	assert.Equal(t, 2, envelopes[1].EventIndex)
+	assert.Empty(t, envelopes[1].Metadata.Tags)
+
+	// 重複したtagは1つにまとめて書く
+	eventStore.PersistEvent(actorName, 3, &p.Event{Type: "user"})
+	envelopes = nil
+	eventStore.GetEventEnvelopes(actorName, 3, 0, func(envelope p.EventEnvelope) {
+		envelopes = append(envelopes, envelope)
+	})
+	require.Len(t, envelopes, 1)
+	assert.Equal(t, []string{"user"}, envelopes[0].Metadata.Tags)
+
+	// クリーンアップ
+	for _, eventIndex := range []int{1, 2, 3} {
+		key, err := attributevalue.MarshalMap(map[string]interface{}{
+			"actorName":  actorName,
+			"eventIndex": eventIndex,
+		})
+		require.NoError(t, err)
+		_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(tableName)})
+		require.NoError(t, err)
+	}
+}
+
+func TestEventStore_GetEventEnvelopesWithoutMetadata(t *testing.T) {
+	ctx := context.Background()
+	tableName := "journal"
+
+	client := InitializeDynamoDBClient()
+	eventStore := p.NewEventStore(client, tableName)
+
+	// metadataが導入される前のitem
+	actorName := "testLegacyMetadataActor"
+	av, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": 1,
+		"payload":    encodeEvent(&p.Event{Data: "event1"}),
+	})
+	require.NoError(t, err)
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{Item: av, TableName: aws.String(tableName)})
+	require.NoError(t, err)
+
+	var envelopes []p.EventEnvelope
+	eventStore.GetEventEnvelopes(actorName, 1, 1, func(envelope p.EventEnvelope) {
+		envelopes = append(envelopes, envelope)
+	})
+	require.Len(t, envelopes, 1)
+	assert.Equal(t, p.EventMetadata{SchemaVersion: 1}, envelopes[0].Metadata)
+
+	// クリーンアップ
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": 1,
+	})
+	require.NoError(t, err)
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(tableName)})
+	require.NoError(t, err)
+}
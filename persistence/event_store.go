@@ -2,29 +2,169 @@ package persistence
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
+// deleteBatchSize leaves room for the update of the actor metadata in a transaction.
+const deleteBatchSize = maxTransactItems - 1
+
+// ErrJournalTruncated is returned by a replay that starts at an event that has been deleted from the journal,
+// e.g. by compaction after a snapshot that recovery could not use. Replaying the rest would give the actor
+// a wrong state and a next event index that overwrites events that are still in the journal.
+var ErrJournalTruncated = errors.New("journal truncated")
+
 type EventStore struct {
-	client *dynamodb.Client
-	table  string
+	itemTable
 }
 
-func NewEventStore(client *dynamodb.Client, table string) *EventStore {
+func NewEventStore(client *dynamodb.Client, table string, opts ...Option) *EventStore {
+	return newEventStore(client, table, newOptions(opts))
+}
+
+// newEventStore creates an EventStore that shares o with the other stores of a ProviderState.
+func newEventStore(client *dynamodb.Client, table string, o *options) *EventStore {
 	return &EventStore{
-		client: client,
-		table:  table,
+		itemTable: itemTable{
+			client:         client,
+			table:          table,
+			options:        o,
+			legacyManifest: string((&Event{}).ProtoReflect().Descriptor().FullName()),
+		},
 	}
 }
 
+// SkippedEvent is replayed by GetEvents in place of a stored event that can not be replayed.
+// persistence.Mixin counts the replayed events to find the index of its next event, so every stored event
+// is replayed as one message, and actors ignore the SkippedEvents they receive.
+type SkippedEvent struct {
+	ActorName  string
+	EventIndex int
+	Reason     SkipReason
+}
+
+// SkipReason is why an event was replayed as a SkippedEvent.
+type SkipReason string
+
+const (
+	// SkipForgotten is an event of an actor whose data key was destroyed by ForgetActor.
+	SkipForgotten SkipReason = "forgotten"
+	// SkipDropped is an event an upcaster turned into no events.
+	SkipDropped SkipReason = "dropped"
+	// SkipTombstoned is an event hidden by TombstoneEvents.
+	SkipTombstoned SkipReason = "tombstoned"
+)
+
+// GetEvents replays the events of actorName as persistence.Mixin expects them, one message per stored event.
 func (e *EventStore) GetEvents(actorName string, eventIndexStart int, eventIndexEnd int, callback func(e interface{})) {
+	last := -1
+	err := e.replay(context.Background(), actorName, eventIndexStart, eventIndexEnd, func(envelope EventEnvelope) error {
+		if envelope.EventIndex == last {
+			return fmt.Errorf("%w: event %d of %s", ErrSplitUpcast, envelope.EventIndex, actorName)
+		}
+		last = envelope.EventIndex
+		if e.options.headerCapture != nil && len(envelope.Metadata.Headers) > 0 {
+			// replay中のactorがHeaderCapture.Headersで元のheaderを参照できるようにする
+			e.options.headerCapture.set(actorName, envelope.Metadata.Headers)
+			defer e.options.headerCapture.clear(actorName)
+		}
+		callback(envelope.Event)
+		return nil
+	})
+	if err != nil {
+		// TODO: エラーハンドリング
+		panic(err)
+	}
+}
+
+// GetEventEnvelopes replays events like GetEvents, together with their index and metadata.
+// Events split by an upcaster are replayed with the index of the stored event.
+func (e *EventStore) GetEventEnvelopes(actorName string, eventIndexStart int, eventIndexEnd int, callback func(envelope EventEnvelope)) {
+	err := e.replay(context.Background(), actorName, eventIndexStart, eventIndexEnd, func(envelope EventEnvelope) error {
+		callback(envelope)
+		return nil
+	})
+	if err != nil {
+		// TODO: エラーハンドリング
+		panic(err)
+	}
+}
+
+// replay reads the events of actorName for recovery, with a SkippedEvent for each stored event that can not be replayed.
+// Unless WithArchiveReplay reads them from the archive, it fails with ErrJournalTruncated if events from eventIndexStart on
+// have been deleted. The actor metadata records how far events were deleted; without it, the journal is truncated
+// if its first event from eventIndexStart on is a later one.
+func (e *EventStore) replay(ctx context.Context, actorName string, eventIndexStart int, eventIndexEnd int, callback func(envelope EventEnvelope) error) error {
+	known := false
+	if e.options.actorMetadata != nil {
+		metadata, ok, err := e.options.actorMetadata.load(ctx, e.client, actorName)
+		if err != nil {
+			return err
+		}
+		if ok && metadata.DeletedToIndex >= eventIndexStart && e.options.archiveReplay == nil {
+			return fmt.Errorf("%w: events of %s up to %d are deleted, but recovery starts at %d", ErrJournalTruncated, actorName, metadata.DeletedToIndex, eventIndexStart)
+		}
+		// snapshotより新しいeventがなければ、journalを読まない
+		if ok && metadata.HighestEventIndex < eventIndexStart {
+			return nil
+		}
+		known = ok
+	}
+	if !known && e.options.archiveReplay == nil {
+		first, found, err := e.firstEventIndex(ctx, actorName, eventIndexStart)
+		if err != nil {
+			return err
+		}
+		if found && first > eventIndexStart {
+			return fmt.Errorf("%w: journal of %s starts at %d, but recovery starts at %d", ErrJournalTruncated, actorName, first, eventIndexStart)
+		}
+	}
+	return e.readEvents(ctx, actorName, eventIndexStart, eventIndexEnd, false, callback)
+}
+
+// ReadEvents reads the events of actorName from eventIndexStart to eventIndexEnd, or to the last event if eventIndexEnd is 0,
+// reading all pages of the journal. It stops at the first error, including one returned by callback.
+// Unlike a replay for recovery, it reads the events that are left when events from eventIndexStart on have been deleted.
+// With WithArchiveReplay, events compacted out of the journal are read from the archive first.
+// Events hidden by TombstoneEvents and events of a forgotten actor are skipped.
+func (e *EventStore) ReadEvents(ctx context.Context, actorName string, eventIndexStart int, eventIndexEnd int, callback func(envelope EventEnvelope) error) error {
+	return e.readEvents(ctx, actorName, eventIndexStart, eventIndexEnd, false, skipping(callback))
+}
+
+// skipping leaves the SkippedEvents of a replay out, for readers that do not count events.
+func skipping(callback func(envelope EventEnvelope) error) func(envelope EventEnvelope) error {
+	return func(envelope EventEnvelope) error {
+		if _, ok := envelope.Event.(*SkippedEvent); ok {
+			return nil
+		}
+		return callback(envelope)
+	}
+}
+
+func (e *EventStore) readEvents(ctx context.Context, actorName string, eventIndexStart int, eventIndexEnd int, includeDeleted bool, callback func(envelope EventEnvelope) error) error {
+	var archived *replayCheck
+	if e.options.archiveReplay != nil {
+		if e.options.ttl != nil {
+			archived = e.newArchiveCheck(actorName, eventIndexStart)
+		}
+		next, err := e.readArchive(ctx, actorName, eventIndexStart, eventIndexEnd, includeDeleted, archived, callback)
+		if err != nil {
+			return err
+		}
+		if eventIndexEnd != 0 && next > eventIndexEnd {
+			return nil
+		}
+		// archiveから読んだeventの続きをjournalから読む
+		eventIndexStart = next
+	}
+
 	// Snapshotからreplayされるとき、eventIndexEndは0で指定されるよう。
 	// その場合は、INFINITYを使用して全Event取得できるようにしないと、DynamoDBのBETWEENでerrorになる
 	var keyConditionExpression string
@@ -50,49 +190,371 @@ func (e *EventStore) GetEvents(actorName string, eventIndexStart int, eventIndex
 		ExpressionAttributeValues: expressionAttributeValues,
 	}
 
-	resp, err := e.client.Query(context.Background(), input)
-	if err != nil {
-		panic(err)
+	var check *replayCheck
+	if e.options.ttl != nil {
+		var err error
+		if check, err = e.newReplayCheck(ctx, actorName, eventIndexStart, eventIndexEnd); err != nil {
+			return err
+		}
+		if archived != nil {
+			check.follow(archived)
+		}
 	}
 
-	for _, item := range resp.Items {
-		eventData, ok := item["payload"].(*types.AttributeValueMemberB)
-		if !ok {
-			// TODO: エラーハンドリング
-			continue
+	paginator := dynamodb.NewQueryPaginator(e.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if check != nil {
+				replay, err := check.item(item)
+				if err != nil {
+					return err
+				}
+				if !replay {
+					continue
+				}
+			}
+			envelopes, err := e.decodeEnvelopes(ctx, item, includeDeleted)
+			if err != nil {
+				return err
+			}
+			for _, envelope := range envelopes {
+				if err := callback(envelope); err != nil {
+					return err
+				}
+			}
 		}
-		event := &Event{}
-		err := proto.Unmarshal(eventData.Value, event)
+	}
+	if check != nil {
+		return check.done()
+	}
+	return nil
+}
+
+// readArchive reads the archived events of actorName like ReadEvents, if the journal has been truncated below eventIndexStart,
+// and returns the index to continue reading the journal at. Archived items keep their expiry, and check skips
+// the expired ones like in the journal.
+func (e *EventStore) readArchive(ctx context.Context, actorName string, eventIndexStart int, eventIndexEnd int, includeDeleted bool, check *replayCheck, callback func(envelope EventEnvelope) error) (int, error) {
+	truncated, err := e.truncatedBelow(ctx, actorName, eventIndexStart)
+	if err != nil || !truncated {
+		return eventIndexStart, err
+	}
+	return e.options.archiveReplay.replay(ctx, actorName, eventIndexStart, eventIndexEnd, func(item map[string]types.AttributeValue) error {
+		if check != nil {
+			replay, err := check.item(item)
+			if err != nil || !replay {
+				return err
+			}
+		}
+		envelopes, err := e.decodeEnvelopes(ctx, item, includeDeleted)
 		if err != nil {
-			// TODO: エラーハンドリング
-			panic(err)
+			return err
+		}
+		for _, envelope := range envelopes {
+			if err := callback(envelope); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// truncatedBelow reports whether the event at eventIndex may have been deleted from the journal.
+// The actor metadata records it; without metadata, the journal is truncated if it does not start with that event.
+func (e *EventStore) truncatedBelow(ctx context.Context, actorName string, eventIndex int) (bool, error) {
+	if e.options.actorMetadata != nil {
+		metadata, ok, err := e.options.actorMetadata.load(ctx, e.client, actorName)
+		if err != nil || ok {
+			return ok && metadata.DeletedToIndex >= eventIndex, err
 		}
-		callback(event)
 	}
+	first, found, err := e.firstEventIndex(ctx, actorName, eventIndex)
+	return !found || first > eventIndex, err
 }
 
-func (e *EventStore) PersistEvent(actorName string, eventIndex int, event protoreflect.ProtoMessage) {
-	payload, err := proto.Marshal(event)
+// firstEventIndex returns the index of the first event of actorName in the journal from eventIndex on, and false if there is none.
+func (e *EventStore) firstEventIndex(ctx context.Context, actorName string, eventIndex int) (int, bool, error) {
+	out, err := e.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(e.table),
+		KeyConditionExpression: aws.String("actorName = :actorName AND eventIndex >= :start"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+			":start":     &types.AttributeValueMemberN{Value: strconv.Itoa(eventIndex)},
+		},
+		ProjectionExpression: aws.String("eventIndex"),
+		ConsistentRead:       aws.Bool(true),
+		Limit:                aws.Int32(1),
+	})
+	if err != nil || len(out.Items) == 0 {
+		return 0, false, err
+	}
+	first, err := itemEventIndex(out.Items[0])
+	return first, err == nil, err
+}
+
+// envelopes decodes a journal item into the events it holds after upcasting.
+// The events of a forgotten actor can not be read and are treated as if they did not exist, and so are tombstoned events.
+func (e *EventStore) envelopes(ctx context.Context, item map[string]types.AttributeValue) ([]EventEnvelope, error) {
+	envelopes, err := e.decodeEnvelopes(ctx, item, false)
+	if err != nil || len(envelopes) != 1 {
+		return envelopes, err
+	}
+	if _, ok := envelopes[0].Event.(*SkippedEvent); ok {
+		return nil, nil
+	}
+	return envelopes, nil
+}
+
+// decodeEnvelopes decodes a journal item like envelopes, and a tombstoned item as well if includeDeleted is set.
+// An event that can not be read, or is tombstoned and includeDeleted is not set, is returned as a SkippedEvent.
+func (e *EventStore) decodeEnvelopes(ctx context.Context, item map[string]types.AttributeValue, includeDeleted bool) ([]EventEnvelope, error) {
+	actorName := item["actorName"].(*types.AttributeValueMemberS).Value
+	eventIndex, err := strconv.Atoi(item["eventIndex"].(*types.AttributeValueMemberN).Value)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	tombstone, err := readTombstone(item)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := readMetadata(item)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Tombstone = tombstone
+	if tombstone != nil && !includeDeleted {
+		return []EventEnvelope{skippedEnvelope(actorName, eventIndex, SkipTombstoned, metadata)}, nil
+	}
+
+	event, err := e.decodePayload(ctx, actorName, item)
+	if errors.Is(err, ErrActorForgotten) {
+		// 鍵が破棄されたactorのeventは読めないが、indexを数えられるように代わりのeventを返す
+		return []EventEnvelope{skippedEnvelope(actorName, eventIndex, SkipForgotten, metadata)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode event %d of %s: %w", eventIndex, actorName, err)
 	}
+	events, err := e.options.upcasters.Upcast(event, metadata.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return []EventEnvelope{skippedEnvelope(actorName, eventIndex, SkipDropped, metadata)}, nil
+	}
+
+	envelopes := make([]EventEnvelope, 0, len(events))
+	for _, event := range events {
+		envelopes = append(envelopes, EventEnvelope{
+			ActorName:  actorName,
+			EventIndex: eventIndex,
+			Event:      event,
+			Metadata:   metadata,
+		})
+	}
+	return envelopes, nil
+}
 
-	item := map[string]types.AttributeValue{
-		"actorName":  &types.AttributeValueMemberS{Value: actorName},
-		"eventIndex": &types.AttributeValueMemberN{Value: strconv.Itoa(eventIndex)},
-		"payload":    &types.AttributeValueMemberB{Value: payload},
+// skippedEnvelope returns the envelope of a SkippedEvent in place of a stored event.
+func skippedEnvelope(actorName string, eventIndex int, reason SkipReason, metadata EventMetadata) EventEnvelope {
+	return EventEnvelope{
+		ActorName:  actorName,
+		EventIndex: eventIndex,
+		Event:      &SkippedEvent{ActorName: actorName, EventIndex: eventIndex, Reason: reason},
+		Metadata:   metadata,
 	}
+}
 
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(e.table),
-		Item:      item,
+func (e *EventStore) PersistEvent(actorName string, eventIndex int, event protoreflect.ProtoMessage) {
+	if err := e.AppendEvent(context.TODO(), actorName, eventIndex, event); err != nil {
+		panic(err)
 	}
+}
 
-	_, err = e.client.PutItem(context.TODO(), input)
+// AppendEvent writes event as the event of actorName at eventIndex. Unlike PersistEvent, the event can be any
+// message the serializers of WithSerializers support, e.g. a Go struct with a custom serializer.
+func (e *EventStore) AppendEvent(ctx context.Context, actorName string, eventIndex int, event interface{}) error {
+	item, err := e.encodePayload(ctx, actorName, event)
 	if err != nil {
+		return err
+	}
+	item["actorName"] = &types.AttributeValueMemberS{Value: actorName}
+	item["eventIndex"] = &types.AttributeValueMemberN{Value: strconv.Itoa(eventIndex)}
+	for k, v := range e.options.metadataAttributes(actorName, event) {
+		item[k] = v
+	}
+	if e.options.globalSequence != nil {
+		seq, err := e.options.globalSequence.allocate(ctx, e.client, e.table, e.options.clock())
+		if err != nil {
+			return err
+		}
+		item[attrGlobalSeq] = &types.AttributeValueMemberN{Value: strconv.FormatInt(seq, 10)}
+		item[attrGlobalSeqPartition] = &types.AttributeValueMemberS{Value: e.table}
+	}
+
+	related, err := e.tagWrites(item)
+	if err != nil {
+		return err
+	}
+	if e.options.actorMetadata != nil {
+		related = append(related, e.options.actorMetadata.eventWritten(actorName, eventIndex, e.options.clock()))
+	}
+	if err := e.putItem(ctx, item, related...); err != nil {
+		return err
+	}
+
+	// eventの書き込み後に登録するので、登録済みのactorは必ずeventを持つ
+	if e.options.persistenceIDs != nil {
+		if err := e.options.persistenceIDs.register(ctx, e.client, e.table, actorName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteEvents deletes the events of actorName up to inclusiveToIndex, together with their chunks and blobs.
+// Journal items are deleted in transactions with the update of the actor metadata, so the metadata records
+// how far events are deleted even if the deletion is interrupted.
+// With WithSoftDelete, the events are tombstoned by TombstoneEvents instead.
+func (e *EventStore) DeleteEvents(actorName string, inclusiveToIndex int) {
+	if e.options.softDelete != nil {
+		if _, err := e.TombstoneEvents(context.TODO(), actorName, inclusiveToIndex, e.options.softDelete.reason); err != nil {
+			// TODO: エラーハンドリング
+			panic(err)
+		}
+		return
+	}
+	if _, err := e.deleteEvents(context.TODO(), actorName, inclusiveToIndex, nil); err != nil {
+		// TODO: エラーハンドリング
 		panic(err)
 	}
+}
+
+// deleteEvents deletes the events of actorName up to inclusiveToIndex and returns how many items it deleted.
+// With an archiver, the items are archived before they are deleted. A SegmentArchiver gets the payloads inline,
+// so that segments can be replayed on their own, and the chunks and blobs are deleted; other archivers refer to them,
+// so they are kept.
+func (e *EventStore) deleteEvents(ctx context.Context, actorName string, inclusiveToIndex int, archiver Archiver) (int, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(e.table),
+		KeyConditionExpression: aws.String("actorName = :actorName AND eventIndex <= :to"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+			":to":        &types.AttributeValueMemberN{Value: strconv.Itoa(inclusiveToIndex)},
+		},
+	}
+	if archiver == nil {
+		input.ProjectionExpression = aws.String(strings.Join([]string{"actorName", "eventIndex", attrChunks, attrPayloadRef, attrTags, attrWrittenAt}, ", "))
+	}
 
+	deleted := 0
+	paginator := dynamodb.NewQueryPaginator(e.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return deleted, err
+		}
+		deletePayloads := archiver == nil
+		if archiver != nil && len(page.Items) > 0 {
+			archived := page.Items
+			if _, ok := archiver.(*SegmentArchiver); ok {
+				if archived, err = e.inlinePayloads(ctx, page.Items); err != nil {
+					return deleted, err
+				}
+				deletePayloads = true
+			}
+			if err := archiver.Archive(ctx, actorName, archived); err != nil {
+				return deleted, fmt.Errorf("archive events of %s: %w", actorName, err)
+			}
+		}
+		for start := 0; start < len(page.Items); start += deleteBatchSize {
+			end := min(start+deleteBatchSize, len(page.Items))
+			if err := e.deleteItems(ctx, actorName, page.Items[start:end], deletePayloads); err != nil {
+				return deleted, err
+			}
+			deleted += end - start
+		}
+	}
+	return deleted, nil
+}
+
+// inlinePayloads returns copies of items with their payloads read from chunks or the blob store back into the payload attribute.
+func (e *EventStore) inlinePayloads(ctx context.Context, items []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	inlined := make([]map[string]types.AttributeValue, 0, len(items))
+	for _, item := range items {
+		_, chunked := item[attrChunks]
+		_, offloaded := item[attrPayloadRef]
+		if !chunked && !offloaded {
+			inlined = append(inlined, item)
+			continue
+		}
+		payload, err := e.payloadBytes(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		copied := make(map[string]types.AttributeValue, len(item))
+		for k, v := range item {
+			copied[k] = v
+		}
+		for _, attr := range []string{attrChunks, attrPayloadSize, attrPayloadChecksum, attrPayloadRef} {
+			delete(copied, attr)
+		}
+		copied[attrPayload] = &types.AttributeValueMemberB{Value: payload}
+		inlined = append(inlined, copied)
+	}
+	return inlined, nil
 }
 
-func (e *EventStore) DeleteEvents(actorName string, inclusiveToIndex int) {}
+// deleteItems deletes journal items in one transaction, then their rows of the tag table,
+// and then the chunks and blobs of their payloads if deletePayloads is set.
+func (e *EventStore) deleteItems(ctx context.Context, actorName string, items []map[string]types.AttributeValue, deletePayloads bool) error {
+	writes := make([]types.TransactWriteItem, 0, len(items)+1)
+	for _, item := range items {
+		writes = append(writes, types.TransactWriteItem{
+			Delete: &types.Delete{
+				TableName: aws.String(e.table),
+				Key: map[string]types.AttributeValue{
+					"actorName":  item["actorName"],
+					"eventIndex": item["eventIndex"],
+				},
+			},
+		})
+	}
+	if e.options.actorMetadata != nil {
+		last, err := strconv.Atoi(items[len(items)-1]["eventIndex"].(*types.AttributeValueMemberN).Value)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, e.options.actorMetadata.eventsDeleted(actorName, last, e.options.clock()))
+	}
+	if err := transactWrite(ctx, e.client, writes); err != nil {
+		return fmt.Errorf("delete events of %s: %w", actorName, err)
+	}
+	if e.options.tagger != nil {
+		if err := deleteTagRows(ctx, e.client, e.tagTable(), items); err != nil {
+			return err
+		}
+	}
+
+	if !deletePayloads {
+		return nil
+	}
+	// journalのitemを消した後なので、途中で失敗しても残るのは参照されないpayloadだけ
+	for _, item := range items {
+		if chunks, ok := item[attrChunks].(*types.AttributeValueMemberN); ok {
+			if err := e.deleteChunks(ctx, item, chunks); err != nil {
+				return err
+			}
+		}
+		if ref, ok := item[attrPayloadRef].(*types.AttributeValueMemberM); ok && e.options.blobStore != nil {
+			if key, ok := ref.Value["key"].(*types.AttributeValueMemberS); ok {
+				if err := e.options.blobStore.DeleteObject(ctx, key.Value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/asynkron/protoactor-go/actor"
+	"github.com/asynkron/protoactor-go/persistence"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
 	"google.golang.org/protobuf/proto"
 )
@@ -47,6 +52,68 @@ func encodeEvent(event *p.Event) []byte {
 	return data
 }
 
+type getReplayed struct{}
+
+// journalActor persists the events it receives and records the messages it replayed when it recovered.
+type journalActor struct {
+	persistence.Mixin
+	replayed []interface{}
+}
+
+func (a *journalActor) Receive(ctx actor.Context) {
+	switch msg := ctx.Message().(type) {
+	case *p.Event:
+		if a.Recovering() {
+			a.replayed = append(a.replayed, msg)
+		} else {
+			a.PersistReceive(msg)
+		}
+	case *p.SkippedEvent:
+		a.replayed = append(a.replayed, msg)
+	case *getReplayed:
+		ctx.Respond(a.replayed)
+	}
+}
+
+// runJournalActor spawns a journalActor on provider, sends it events and stops it, and returns what it replayed.
+func runJournalActor(t *testing.T, provider *p.ProviderState, actorName string, events ...*p.Event) []interface{} {
+	system := actor.NewActorSystem()
+	props := actor.PropsFromProducer(func() actor.Actor {
+		return &journalActor{}
+	}, actor.WithReceiverMiddleware(persistence.Using(provider)))
+	pid, err := system.Root.SpawnNamed(props, actorName)
+	require.NoError(t, err)
+	for _, event := range events {
+		system.Root.Send(pid, event)
+	}
+	replayed, err := system.Root.RequestFuture(pid, &getReplayed{}, time.Second).Result()
+	require.NoError(t, err)
+	require.NoError(t, system.Root.StopFuture(pid).Wait())
+	return replayed.([]interface{})
+}
+
+// deleteActorItems deletes all items of actorName from table.
+func deleteActorItems(t *testing.T, client *dynamodb.Client, table string, actorName string) {
+	result, err := client.Query(context.Background(), &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String("actorName = :actorName"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+	})
+	assert.NoError(t, err)
+	for _, item := range result.Items {
+		_, err := client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(table),
+			Key: map[string]types.AttributeValue{
+				"actorName":  item["actorName"],
+				"eventIndex": item["eventIndex"],
+			},
+		})
+		assert.NoError(t, err)
+	}
+}
+
 func TestEventStore_GetEvents(t *testing.T) {
 	tableName := "testEventTable"
 
@@ -0,0 +1,146 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	DefaultSequenceTable = "sequences"
+	// GlobalSeqIndex is the GSI of the journal table that EventsSince queries.
+	GlobalSeqIndex = "global-seq-index"
+
+	attrGlobalSeq          = "globalSeq"
+	attrGlobalSeqPartition = "globalSeqPartition"
+
+	eventsSincePageSize = 100
+
+	// DefaultGlobalSequenceWindow is how long EventsSince holds back new events by default.
+	DefaultGlobalSequenceWindow = 5 * time.Second
+)
+
+// globalSequence hands out global sequence numbers from blocks allocated on a counter item.
+// Allocating a block at a time keeps writers from contending on the counter for every event.
+//
+// A writer can write a lower number after another writer wrote a higher one. So that readers do not pass
+// numbers that are still to be written, a block is used for at most half of window after it was allocated,
+// and EventsSince holds back events written within window. The other half covers the write itself,
+// the propagation to the index and the clock skew between writers.
+type globalSequence struct {
+	table     string
+	blockSize int64
+	window    time.Duration
+
+	mu          sync.Mutex
+	next        int64
+	last        int64
+	allocatedAt time.Time
+}
+
+// allocate returns the next sequence number of the counter named counter.
+func (s *globalSequence) allocate(ctx context.Context, client *dynamodb.Client, counter string, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 古いblockの残りの番号は、readerが既に先に進んでいるかもしれないので捨てる
+	if s.next == 0 || s.next > s.last || now.Sub(s.allocatedAt) >= s.window/2 {
+		out, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(s.table),
+			Key: map[string]types.AttributeValue{
+				"name": &types.AttributeValueMemberS{Value: counter},
+			},
+			UpdateExpression:         aws.String("ADD #value :block"),
+			ExpressionAttributeNames: map[string]string{"#value": "value"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":block": &types.AttributeValueMemberN{Value: strconv.FormatInt(s.blockSize, 10)},
+			},
+			ReturnValues: types.ReturnValueUpdatedNew,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("allocate global sequence: %w", err)
+		}
+		value, ok := out.Attributes["value"].(*types.AttributeValueMemberN)
+		if !ok {
+			return 0, errors.New("allocate global sequence: counter has no value")
+		}
+		last, err := strconv.ParseInt(value.Value, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		s.next, s.last, s.allocatedAt = last-s.blockSize+1, last, now
+	}
+
+	seq := s.next
+	s.next++
+	return seq, nil
+}
+
+// SequencedEvent is an event found by EventsSince with its global sequence number.
+type SequencedEvent struct {
+	EventEnvelope
+	GlobalSeq int64
+}
+
+// SequencedEventsPage is a page of EventsSince.
+// NextSeq continues with the next page, and equals the requested sequence number when there are no more events for now.
+type SequencedEventsPage struct {
+	Events  []SequencedEvent
+	NextSeq int64
+}
+
+// EventsSince returns the next page of events of all actors with a global sequence number greater than globalSeq, in the order of the numbers.
+//
+// Every writer allocates a block of numbers, so numbers are unique but not gapless, and a writer with an older block
+// can write an event with a lower number after one with a higher number. To not skip such an event, the page ends
+// before the first event written within the window of WithGlobalSequenceWindow, so new events are read that much later.
+// All events of the journal share one GSI partition, which limits the write throughput of the index.
+func (e *EventStore) EventsSince(ctx context.Context, globalSeq int64) (*SequencedEventsPage, error) {
+	resp, err := e.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(e.table),
+		IndexName:              aws.String(GlobalSeqIndex),
+		KeyConditionExpression: aws.String("globalSeqPartition = :partition AND globalSeq > :seq"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":partition": &types.AttributeValueMemberS{Value: e.table},
+			":seq":       &types.AttributeValueMemberN{Value: strconv.FormatInt(globalSeq, 10)},
+		},
+		Limit: aws.Int32(eventsSincePageSize),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := &SequencedEventsPage{NextSeq: globalSeq}
+	visibleUntil := e.options.clock().Add(-e.options.globalSequence.window)
+	for _, item := range resp.Items {
+		metadata, err := readMetadata(item)
+		if err != nil {
+			return nil, err
+		}
+		if metadata.WrittenAt.After(visibleUntil) {
+			// これより小さい番号のeventがまだ書かれるかもしれないので、ここで止める
+			break
+		}
+		seq, err := strconv.ParseInt(item[attrGlobalSeq].(*types.AttributeValueMemberN).Value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		page.NextSeq = seq
+
+		envelopes, err := e.envelopes(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		for _, envelope := range envelopes {
+			page.Events = append(page.Events, SequencedEvent{EventEnvelope: envelope, GlobalSeq: seq})
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,152 @@
+package persistence_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+func TestProviderState_EventsSinceWithConcurrentActors(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	opts := []p.Option{p.WithGlobalSequence(p.DefaultSequenceTable, 10), p.WithGlobalSequenceWindow(time.Second)}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+
+	// 2つのnodeが同じcounterからblockを取り合う
+	nodes := []*p.ProviderState{
+		p.NewProviderState(client, opts...),
+		p.NewProviderState(client, opts...),
+	}
+
+	const actors = 20
+	const eventsPerActor = 5
+	var wg sync.WaitGroup
+	for i := 0; i < actors; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			node := nodes[i%len(nodes)]
+			actorName := fmt.Sprintf("testSeqActor-%d", i)
+			for eventIndex := 0; eventIndex < eventsPerActor; eventIndex++ {
+				node.PersistEvent(actorName, eventIndex, &p.Event{Data: fmt.Sprintf("%d-%d", i, eventIndex)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 全eventをsequence順に読む。GSIは結果整合なので、揃うまで読み直す
+	var events []p.SequencedEvent
+	require.Eventually(t, func() bool {
+		events = nil
+		var seq int64
+		for {
+			page, err := nodes[0].EventsSince(ctx, seq)
+			require.NoError(t, err)
+			if page.NextSeq == seq {
+				break
+			}
+			for _, e := range page.Events {
+				if strings.HasPrefix(e.ActorName, "testSeqActor-") {
+					events = append(events, e)
+				}
+			}
+			seq = page.NextSeq
+		}
+		return len(events) == actors*eventsPerActor
+	}, 10*time.Second, 200*time.Millisecond)
+
+	seen := map[int64]bool{}
+	lastIndex := map[string]int{}
+	for i, e := range events {
+		assert.False(t, seen[e.GlobalSeq], "duplicate global sequence %d", e.GlobalSeq)
+		seen[e.GlobalSeq] = true
+		if i > 0 {
+			assert.Greater(t, e.GlobalSeq, events[i-1].GlobalSeq)
+		}
+
+		// 1つのactorのeventは、eventIndexの順に番号が振られる
+		if last, ok := lastIndex[e.ActorName]; ok {
+			assert.Greater(t, e.EventIndex, last)
+		}
+		lastIndex[e.ActorName] = e.EventIndex
+	}
+
+	// クリーンアップ
+	for i := 0; i < actors; i++ {
+		deleteActorItems(t, client, p.DefaultJournalTable, fmt.Sprintf("testSeqActor-%d", i))
+	}
+}
+
+func TestProviderState_EventsSinceHoldsBackNewEvents(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	var mu sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	opts := []p.Option{p.WithGlobalSequence(p.DefaultSequenceTable, 10), p.WithGlobalSequenceWindow(2 * time.Second), p.WithClock(clock)}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	nodeA := p.NewProviderState(client, opts...)
+	nodeB := p.NewProviderState(client, opts...)
+
+	actorA, actorB := "testSeqWindowActor-a", "testSeqWindowActor-b"
+	nodeA.PersistEvent(actorA, 0, &p.Event{Data: "a0"})
+	nodeB.PersistEvent(actorB, 0, &p.Event{Data: "b0"})
+	// node-aのblockは古くなったので、node-bより小さい番号は使われない
+	advance(time.Second)
+	nodeA.PersistEvent(actorA, 1, &p.Event{Data: "a1"})
+
+	readAll := func() []p.SequencedEvent {
+		var events []p.SequencedEvent
+		var seq int64
+		for {
+			page, err := nodeA.EventsSince(ctx, seq)
+			require.NoError(t, err)
+			if page.NextSeq == seq {
+				return events
+			}
+			for _, e := range page.Events {
+				if strings.HasPrefix(e.ActorName, "testSeqWindowActor-") {
+					events = append(events, e)
+				}
+			}
+			seq = page.NextSeq
+		}
+	}
+
+	// windowの間は、後から小さい番号が書かれるかもしれないので読まれない
+	assert.Empty(t, readAll())
+
+	advance(3 * time.Second)
+	var events []p.SequencedEvent
+	require.Eventually(t, func() bool {
+		events = readAll()
+		return len(events) == 3
+	}, 10*time.Second, 200*time.Millisecond)
+	var data []string
+	for _, e := range events {
+		data = append(data, e.Event.(*p.Event).Data)
+	}
+	assert.Equal(t, []string{"a0", "b0", "a1"}, data)
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorA)
+	deleteActorItems(t, client, p.DefaultJournalTable, actorB)
+}
@@ -0,0 +1,107 @@
+package persistence
+
+import (
+	"sync"
+
+	"github.com/asynkron/protoactor-go/actor"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	HeaderCorrelationID = "correlation-id"
+	HeaderCausationID   = "causation-id"
+	HeaderTraceID       = "trace-id"
+	HeaderUserID        = "user-id"
+
+	attrHeaders = "headers"
+)
+
+// HeaderCapture carries headers of the message an actor is handling to the events it persists.
+// Its ReceiverMiddleware captures the headers before the actor receives a message, and the store
+// reads them when PersistReceive writes an event. While events are replayed, Headers returns the
+// headers stored with the event being replayed.
+type HeaderCapture struct {
+	keys []string
+
+	mu      sync.RWMutex
+	headers map[string]map[string]string
+}
+
+// NewHeaderCapture captures the given header keys, or the correlation, causation, trace and user IDs without keys.
+func NewHeaderCapture(keys ...string) *HeaderCapture {
+	if len(keys) == 0 {
+		keys = []string{HeaderCorrelationID, HeaderCausationID, HeaderTraceID, HeaderUserID}
+	}
+	return &HeaderCapture{
+		keys:    keys,
+		headers: map[string]map[string]string{},
+	}
+}
+
+// ReceiverMiddleware is used with actor.WithReceiverMiddleware, next to persistence.Using.
+func (c *HeaderCapture) ReceiverMiddleware(next actor.ReceiverFunc) actor.ReceiverFunc {
+	return func(ctx actor.ReceiverContext, envelope *actor.MessageEnvelope) {
+		headers := map[string]string{}
+		for _, key := range c.keys {
+			if v := envelope.GetHeader(key); v != "" {
+				headers[key] = v
+			}
+		}
+		if len(headers) == 0 {
+			next(ctx, envelope)
+			return
+		}
+
+		actorName := ctx.Self().Id
+		c.set(actorName, headers)
+		defer c.clear(actorName)
+		next(ctx, envelope)
+	}
+}
+
+// Headers returns the captured headers of the message the actor is handling or the event it is replaying.
+func (c *HeaderCapture) Headers(actorName string) map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.headers[actorName]
+}
+
+func (c *HeaderCapture) set(actorName string, headers map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers[actorName] = headers
+}
+
+func (c *HeaderCapture) clear(actorName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.headers, actorName)
+}
+
+// headersAttribute stores the captured headers of actorName as a map attribute.
+func (c *HeaderCapture) headersAttribute(actorName string) (types.AttributeValue, bool) {
+	headers := c.Headers(actorName)
+	if len(headers) == 0 {
+		return nil, false
+	}
+	m := make(map[string]types.AttributeValue, len(headers))
+	for k, v := range headers {
+		m[k] = &types.AttributeValueMemberS{Value: v}
+	}
+	return &types.AttributeValueMemberM{Value: m}, true
+}
+
+// readHeaders reads the headers attribute of a journal item.
+func readHeaders(item map[string]types.AttributeValue) map[string]string {
+	m, ok := item[attrHeaders].(*types.AttributeValueMemberM)
+	if !ok {
+		return nil
+	}
+	headers := make(map[string]string, len(m.Value))
+	for k, v := range m.Value {
+		if s, ok := v.(*types.AttributeValueMemberS); ok {
+			headers[k] = s.Value
+		}
+	}
+	return headers
+}
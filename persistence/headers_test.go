@@ -0,0 +1,110 @@
+package persistence_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asynkron/protoactor-go/actor"
+	"github.com/asynkron/protoactor-go/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/proto"
+)
+
+type getHeaders struct{}
+
+// withHeaders wraps message in an envelope with headers, as a sender middleware of the calling service would do.
+func withHeaders(message interface{}, headers map[string]string, sender *actor.PID) *actor.MessageEnvelope {
+	envelope := &actor.MessageEnvelope{Message: message, Sender: sender}
+	for k, v := range headers {
+		envelope.SetHeader(k, v)
+	}
+	return envelope
+}
+
+func TestHeaderCapture_ReceiverMiddleware(t *testing.T) {
+	system := actor.NewActorSystem()
+	capture := p.NewHeaderCapture()
+
+	props := actor.PropsFromFunc(func(ctx actor.Context) {
+		if _, ok := ctx.Message().(*getHeaders); ok {
+			ctx.Respond(capture.Headers(ctx.Self().Id))
+		}
+	}, actor.WithReceiverMiddleware(capture.ReceiverMiddleware))
+	pid := system.Root.Spawn(props)
+
+	future := actor.NewFuture(system, time.Second)
+	system.Root.Send(pid, withHeaders(&getHeaders{}, map[string]string{
+		p.HeaderCorrelationID: "correlation-1",
+		p.HeaderUserID:        "user-1",
+		"other":               "ignored",
+	}, future.PID()))
+	result, err := future.Result()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{p.HeaderCorrelationID: "correlation-1", p.HeaderUserID: "user-1"}, result)
+
+	// 処理が終わったらheaderは残らない
+	assert.Eventually(t, func() bool { return capture.Headers(pid.Id) == nil }, time.Second, 10*time.Millisecond)
+}
+
+// auditedActor persists events and records the headers they were written or replayed with.
+type auditedActor struct {
+	persistence.Mixin
+	capture *p.HeaderCapture
+	headers []map[string]string
+}
+
+func (a *auditedActor) Receive(ctx actor.Context) {
+	switch msg := ctx.Message().(type) {
+	case *p.Event:
+		if !a.Recovering() {
+			a.PersistReceive(msg)
+		}
+		a.headers = append(a.headers, a.capture.Headers(ctx.Self().Id))
+	case *getHeaders:
+		ctx.Respond(a.headers)
+	}
+}
+
+func TestProviderState_PersistEventWithHeaders(t *testing.T) {
+	system := actor.NewActorSystem()
+	client := InitializeDynamoDBClient()
+	capture := p.NewHeaderCapture()
+	provider := p.NewProviderState(client, p.WithHeaderCapture(capture))
+
+	props := actor.PropsFromProducer(func() actor.Actor {
+		return &auditedActor{capture: capture}
+	}, actor.WithReceiverMiddleware(persistence.Using(provider), capture.ReceiverMiddleware))
+
+	actorName := "testHeaderActor"
+	pid, err := system.Root.SpawnNamed(props, actorName)
+	require.NoError(t, err)
+	headers := map[string]string{p.HeaderCorrelationID: "correlation-1", p.HeaderCausationID: "command-1"}
+	system.Root.Send(pid, withHeaders(&p.Event{Data: "event1"}, headers, nil))
+	_, err = system.Root.RequestFuture(pid, &getHeaders{}, time.Second).Result()
+	require.NoError(t, err)
+	require.NoError(t, system.Root.StopFuture(pid).Wait())
+
+	// 保存されたheaderの検証
+	eventStore := p.NewEventStore(client, p.DefaultJournalTable)
+	var envelopes []p.EventEnvelope
+	eventStore.GetEventEnvelopes(actorName, 0, 0, func(envelope p.EventEnvelope) {
+		envelopes = append(envelopes, envelope)
+	})
+	require.Len(t, envelopes, 1)
+	assert.True(t, proto.Equal(&p.Event{Data: "event1"}, envelopes[0].Event.(*p.Event)))
+	assert.Equal(t, headers, envelopes[0].Metadata.Headers)
+
+	// replay中も元のheaderが見える
+	pid, err = system.Root.SpawnNamed(props, actorName)
+	require.NoError(t, err)
+	result, err := system.Root.RequestFuture(pid, &getHeaders{}, time.Second).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{headers}, result)
+	require.NoError(t, system.Root.StopFuture(pid).Wait())
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorName)
+}
@@ -0,0 +1,93 @@
+package persistence
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyProvider wraps and unwraps per-actor data keys with a master key.
+// A KMS backed implementation only has to satisfy this interface.
+type KeyProvider interface {
+	KeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error)
+}
+
+type staticKeyProvider struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+// NewStaticKeyProvider returns a KeyProvider using masterKey, which must be 16, 24 or 32 bytes long.
+func NewStaticKeyProvider(keyID string, masterKey []byte) (KeyProvider, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &staticKeyProvider{keyID: keyID, aead: aead}, nil
+}
+
+// NewFileKeyProvider reads a hex or base64 encoded master key from path.
+// The file name is used as the key ID.
+func NewFileKeyProvider(path string) (KeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(string(data))
+
+	masterKey, err := hex.DecodeString(text)
+	if err != nil {
+		masterKey, err = base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("master key in %s is neither hex nor base64", path)
+		}
+	}
+	return NewStaticKeyProvider(filepath.Base(path), masterKey)
+}
+
+func (k *staticKeyProvider) KeyID() string {
+	return k.keyID
+}
+
+func (k *staticKeyProvider) WrapKey(_ context.Context, dataKey []byte) ([]byte, error) {
+	return seal(k.aead, dataKey, []byte(k.keyID))
+}
+
+func (k *staticKeyProvider) UnwrapKey(_ context.Context, wrappedKey []byte) ([]byte, error) {
+	return open(k.aead, wrappedKey, []byte(k.keyID))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext and prepends the random nonce to the ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
@@ -0,0 +1,68 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+func TestStaticKeyProvider_WrapKey(t *testing.T) {
+	ctx := context.Background()
+	masterKey := make([]byte, 32)
+	provider, err := p.NewStaticKeyProvider("test-key", masterKey)
+	assert.NoError(t, err)
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := provider.WrapKey(ctx, dataKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, dataKey, wrapped)
+
+	unwrapped, err := provider.UnwrapKey(ctx, wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	// 別のmaster keyではunwrapできない
+	otherKey := make([]byte, 32)
+	otherKey[0] = 1
+	other, err := p.NewStaticKeyProvider("test-key", otherKey)
+	assert.NoError(t, err)
+	_, err = other.UnwrapKey(ctx, wrapped)
+	assert.Error(t, err)
+
+	_, err = p.NewStaticKeyProvider("short-key", []byte("short"))
+	assert.Error(t, err)
+}
+
+func TestNewFileKeyProvider(t *testing.T) {
+	ctx := context.Background()
+	masterKey := []byte("0123456789abcdef0123456789abcdef")
+	dir := t.TempDir()
+
+	hexPath := filepath.Join(dir, "master-hex.key")
+	assert.NoError(t, os.WriteFile(hexPath, []byte(hex.EncodeToString(masterKey)+"\n"), 0o600))
+	base64Path := filepath.Join(dir, "master-base64.key")
+	assert.NoError(t, os.WriteFile(base64Path, []byte(base64.StdEncoding.EncodeToString(masterKey)), 0o600))
+
+	hexProvider, err := p.NewFileKeyProvider(hexPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "master-hex.key", hexProvider.KeyID())
+	base64Provider, err := p.NewFileKeyProvider(base64Path)
+	assert.NoError(t, err)
+
+	wrapped, err := hexProvider.WrapKey(ctx, []byte("data key"))
+	assert.NoError(t, err)
+	// key IDもadditional dataに含まれるので、同じ鍵でもIDが違えばunwrapできない
+	_, err = base64Provider.UnwrapKey(ctx, wrapped)
+	assert.Error(t, err)
+
+	invalidPath := filepath.Join(dir, "invalid.key")
+	assert.NoError(t, os.WriteFile(invalidPath, []byte("not a key!"), 0o600))
+	_, err = p.NewFileKeyProvider(invalidPath)
+	assert.Error(t, err)
+}
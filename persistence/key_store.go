@@ -0,0 +1,174 @@
+package persistence
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/oklog/ulid/v2"
+)
+
+// ErrActorForgotten is returned when the data key an item was encrypted with has been destroyed.
+var ErrActorForgotten = errors.New("data key of the actor has been destroyed")
+
+const dataKeySize = 32
+
+// KeyStore keeps one data key per actor in a DynamoDB table.
+// Data keys are stored wrapped by the KeyProvider and cached unwrapped in memory.
+// Destroying the key of an actor makes all of its encrypted events and snapshots unreadable (crypto-shredding).
+type KeyStore struct {
+	client   *dynamodb.Client
+	table    string
+	provider KeyProvider
+
+	mu    sync.Mutex
+	cache map[string]*dataKey
+}
+
+type dataKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func NewKeyStore(client *dynamodb.Client, table string, provider KeyProvider) *KeyStore {
+	return &KeyStore{
+		client:   client,
+		table:    table,
+		provider: provider,
+		cache:    map[string]*dataKey{},
+	}
+}
+
+// ForgetActor destroys the data key of the actor.
+// Keys cached by other processes stay usable until those processes restart.
+func (k *KeyStore) ForgetActor(ctx context.Context, actorName string) error {
+	_, err := k.forget(ctx, actorName)
+	return err
+}
+
+// forget destroys the data key of the actor like ForgetActor, and reports whether it existed.
+func (k *KeyStore) forget(ctx context.Context, actorName string) (bool, error) {
+	existed, err := deleteItem(ctx, k.client, k.table, map[string]types.AttributeValue{
+		"actorName": &types.AttributeValueMemberS{Value: actorName},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	k.mu.Lock()
+	delete(k.cache, actorName)
+	k.mu.Unlock()
+	return existed, nil
+}
+
+// currentKey returns the data key used for new writes, creating it on first use.
+func (k *KeyStore) currentKey(ctx context.Context, actorName string) (*dataKey, error) {
+	key, err := k.loadKey(ctx, actorName)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, ErrActorForgotten) {
+		return nil, err
+	}
+
+	plain := make([]byte, dataKeySize)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, err
+	}
+	wrapped, err := k.provider.WrapKey(ctx, plain)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+	id := ulid.Make().String()
+
+	_, err = k.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(k.table),
+		Item: map[string]types.AttributeValue{
+			"actorName":   &types.AttributeValueMemberS{Value: actorName},
+			"dataKeyId":   &types.AttributeValueMemberS{Value: id},
+			"wrappedKey":  &types.AttributeValueMemberB{Value: wrapped},
+			"masterKeyId": &types.AttributeValueMemberS{Value: k.provider.KeyID()},
+			"createdAt":   &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(actorName)"),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// 他のprocessが先に作成した
+		return k.loadKey(ctx, actorName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k.cacheKey(actorName, id, plain)
+}
+
+// keyFor returns the data key with the given id, or ErrActorForgotten if it no longer exists.
+func (k *KeyStore) keyFor(ctx context.Context, actorName string, id string) (*dataKey, error) {
+	key, err := k.loadKey(ctx, actorName)
+	if err != nil {
+		return nil, err
+	}
+	if key.id != id {
+		// 過去に削除された鍵で暗号化されている
+		return nil, ErrActorForgotten
+	}
+	return key, nil
+}
+
+func (k *KeyStore) loadKey(ctx context.Context, actorName string) (*dataKey, error) {
+	k.mu.Lock()
+	key, ok := k.cache[actorName]
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	result, err := k.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(k.table),
+		Key: map[string]types.AttributeValue{
+			"actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrActorForgotten
+	}
+
+	id, ok := result.Item["dataKeyId"].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, fmt.Errorf("data key of %s has no dataKeyId", actorName)
+	}
+	wrapped, ok := result.Item["wrappedKey"].(*types.AttributeValueMemberB)
+	if !ok {
+		return nil, fmt.Errorf("data key of %s has no wrappedKey", actorName)
+	}
+	plain, err := k.provider.UnwrapKey(ctx, wrapped.Value)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key of %s: %w", actorName, err)
+	}
+	return k.cacheKey(actorName, id.Value, plain)
+}
+
+func (k *KeyStore) cacheKey(actorName string, id string, plain []byte) (*dataKey, error) {
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	key := &dataKey{id: id, aead: aead}
+
+	k.mu.Lock()
+	k.cache[actorName] = key
+	k.mu.Unlock()
+	return key, nil
+}
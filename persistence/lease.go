@@ -0,0 +1,381 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/asynkron/protoactor-go/actor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	DefaultLeaseTable = "leases"
+
+	// attrWriterEpoch is the epoch of the lease an event or snapshot was written under.
+	attrWriterEpoch = "writerEpoch"
+)
+
+var (
+	// ErrLeaseHeld is returned by Acquire when another owner holds an unexpired lease.
+	ErrLeaseHeld = errors.New("lease is held by another owner")
+	// ErrLeaseLost is returned when an actor writes without holding its lease.
+	ErrLeaseLost = errors.New("lease lost")
+)
+
+// StaleWriterError rejects a write under a lease epoch that is no longer current, because another owner has
+// acquired the lease since, e.g. while this process was paused. It matches ErrLeaseLost with errors.Is.
+type StaleWriterError struct {
+	ActorName    string
+	Epoch        int64
+	CurrentEpoch int64
+	CurrentOwner string
+}
+
+func (e *StaleWriterError) Error() string {
+	return fmt.Sprintf("stale writer of %s: epoch %d, but %s holds epoch %d", e.ActorName, e.Epoch, e.CurrentOwner, e.CurrentEpoch)
+}
+
+func (e *StaleWriterError) Unwrap() error {
+	return ErrLeaseLost
+}
+
+// LeaseLost is sent to an actor when its lease could not be renewed. The actor should stop,
+// because its events and snapshots are refused from then on.
+type LeaseLost struct {
+	ActorName string
+	Epoch     int64
+}
+
+// lease is a lease held by this owner. Every acquisition is a new lease with its own epoch, renewer and holder,
+// so that the holder of a lease this owner acquired again is told it has lost it.
+type lease struct {
+	epoch     int64
+	expiresAt time.Time
+	stop      context.CancelFunc
+	lost      func()
+}
+
+// supersede stops renewing the lease and tells its holder that it has lost the lease.
+func (held *lease) supersede() {
+	if held.stop != nil {
+		held.stop()
+	}
+	if held.lost != nil {
+		held.lost()
+	}
+}
+
+// Leases makes an actor the single writer of its persistence ID across nodes.
+// A lease records its owner, its expiry and an epoch that increases with every acquisition, in a table with an
+// "actorName" hash key. Its ReceiverMiddleware acquires the lease before the actor recovers and renews it in the background.
+// With WithLeases, writes are conditional on the owner and epoch of the lease, so a writer that lost its lease is fenced off
+// even if it has not noticed yet.
+type Leases struct {
+	client        *dynamodb.Client
+	table         string
+	owner         string
+	ttl           time.Duration
+	renewInterval time.Duration
+	clock         func() time.Time
+
+	mu   sync.Mutex
+	held map[string]*lease
+	// incarnationsは、ReceiverMiddlewareで起動したactorごとに取ったleaseのepochを持つ
+	incarnations map[*actor.PID]int64
+}
+
+// NewLeases creates leases owned by owner, which must be unique per process, e.g. the hostname and the process ID.
+// Leases expire after ttl unless they are renewed, which happens every third of ttl.
+func NewLeases(client *dynamodb.Client, table string, owner string, ttl time.Duration) *Leases {
+	return &Leases{
+		client:        client,
+		table:         table,
+		owner:         owner,
+		ttl:           ttl,
+		renewInterval: ttl / 3,
+		clock:         time.Now,
+		held:          map[string]*lease{},
+		incarnations:  map[*actor.PID]int64{},
+	}
+}
+
+// Acquire takes the lease of actorName if it is free, expired or already owned by this owner, and returns its new epoch,
+// which Release takes. If this owner already held the lease, its previous holder gets *LeaseLost with the previous epoch,
+// because its writes are refused from then on.
+func (l *Leases) Acquire(ctx context.Context, actorName string) (int64, error) {
+	now := l.clock()
+	expiresAt := now.Add(l.ttl)
+	out, err := l.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(l.table),
+		Key:                      leaseKey(actorName),
+		UpdateExpression:         aws.String("SET #owner = :owner, expiresAt = :expiresAt ADD epoch :one"),
+		ConditionExpression:      aws.String("attribute_not_exists(actorName) OR expiresAt < :now OR #owner = :owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner":     &types.AttributeValueMemberS{Value: l.owner},
+			":expiresAt": unixMilli(expiresAt),
+			":now":       unixMilli(now),
+			":one":       &types.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return 0, fmt.Errorf("%w: %s", ErrLeaseHeld, actorName)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("acquire lease of %s: %w", actorName, err)
+	}
+	epoch, err := strconv.ParseInt(out.Attributes["epoch"].(*types.AttributeValueMemberN).Value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	old, ok := l.held[actorName]
+	l.held[actorName] = &lease{epoch: epoch, expiresAt: expiresAt}
+	l.mu.Unlock()
+	if ok {
+		old.supersede()
+	}
+	return epoch, nil
+}
+
+// Release gives up the lease of actorName acquired at epoch, so that another owner can acquire it without waiting
+// for it to expire. A lease this owner has acquired again since is not released. The epoch is kept in the table,
+// so that the next owner gets a higher one.
+func (l *Leases) Release(ctx context.Context, actorName string, epoch int64) error {
+	l.mu.Lock()
+	held, ok := l.held[actorName]
+	if ok && held.epoch == epoch {
+		delete(l.held, actorName)
+	}
+	l.mu.Unlock()
+	if !ok || held.epoch != epoch {
+		return nil
+	}
+	if held.stop != nil {
+		held.stop()
+	}
+
+	_, err := l.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(l.table),
+		Key:                      leaseKey(actorName),
+		UpdateExpression:         aws.String("SET expiresAt = :zero"),
+		ConditionExpression:      aws.String("#owner = :owner AND epoch = :epoch"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: l.owner},
+			":epoch": &types.AttributeValueMemberN{Value: strconv.FormatInt(epoch, 10)},
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// 既に他のownerに取られている
+		return nil
+	}
+	return err
+}
+
+// Held returns the epoch of the lease of actorName, and false if this owner does not hold it or it has expired.
+func (l *Leases) Held(actorName string) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	held, ok := l.held[actorName]
+	if !ok || !l.clock().Before(held.expiresAt) {
+		return 0, false
+	}
+	return held.epoch, true
+}
+
+// renew extends the lease of actorName if this owner still holds it at epoch.
+func (l *Leases) renew(ctx context.Context, actorName string, epoch int64) error {
+	expiresAt := l.clock().Add(l.ttl)
+	_, err := l.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(l.table),
+		Key:                      leaseKey(actorName),
+		UpdateExpression:         aws.String("SET expiresAt = :expiresAt"),
+		ConditionExpression:      aws.String("#owner = :owner AND epoch = :epoch"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner":     &types.AttributeValueMemberS{Value: l.owner},
+			":epoch":     &types.AttributeValueMemberN{Value: strconv.FormatInt(epoch, 10)},
+			":expiresAt": unixMilli(expiresAt),
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if held, ok := l.held[actorName]; ok && held.epoch == epoch {
+		held.expiresAt = expiresAt
+	}
+	return nil
+}
+
+// keepRenewing renews the lease of actorName until ctx is done, and calls lost when it can not be renewed.
+// Failed renewals are retried until the lease expires.
+func (l *Leases) keepRenewing(ctx context.Context, actorName string, epoch int64, lost func()) {
+	ticker := time.NewTicker(l.renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := l.renew(ctx, actorName, epoch)
+		if ctx.Err() != nil || err == nil {
+			continue
+		}
+		if _, ok := l.Held(actorName); ok && !errors.Is(err, ErrLeaseLost) {
+			// 一時的なエラーなら、期限が切れるまで再試行する
+			continue
+		}
+
+		l.mu.Lock()
+		if held, ok := l.held[actorName]; ok && held.epoch == epoch {
+			delete(l.held, actorName)
+		}
+		l.mu.Unlock()
+		lost()
+		return
+	}
+}
+
+// conditionCheck returns a check that fails a write transaction of actorName unless this owner still holds its lease,
+// and the epoch the write is made under.
+func (l *Leases) conditionCheck(actorName string) (types.TransactWriteItem, int64, error) {
+	epoch, ok := l.Held(actorName)
+	if !ok {
+		return types.TransactWriteItem{}, 0, fmt.Errorf("%w: %s", ErrLeaseLost, actorName)
+	}
+	return types.TransactWriteItem{
+		ConditionCheck: &types.ConditionCheck{
+			TableName:                aws.String(l.table),
+			Key:                      leaseKey(actorName),
+			ConditionExpression:      aws.String("#owner = :owner AND epoch = :epoch"),
+			ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":owner": &types.AttributeValueMemberS{Value: l.owner},
+				":epoch": &types.AttributeValueMemberN{Value: strconv.FormatInt(epoch, 10)},
+			},
+			// 拒否されたときに、今のownerとepochをerrorに入れる
+			ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+		},
+	}, epoch, nil
+}
+
+// staleWriterError describes a failed condition check of the lease of actorName, with the lease item it failed on.
+func staleWriterError(actorName string, epoch int64, current map[string]types.AttributeValue) *StaleWriterError {
+	err := &StaleWriterError{ActorName: actorName, Epoch: epoch}
+	if v, ok := current["epoch"].(*types.AttributeValueMemberN); ok {
+		err.CurrentEpoch, _ = strconv.ParseInt(v.Value, 10, 64)
+	}
+	if v, ok := current["owner"].(*types.AttributeValueMemberS); ok {
+		err.CurrentOwner = v.Value
+	}
+	return err
+}
+
+// ReceiverMiddleware is used with actor.WithReceiverMiddleware before persistence.Using.
+// It acquires the lease when the actor starts, before it recovers, and stops the actor if the lease is held elsewhere.
+// It sends *LeaseLost to the actor when the lease is lost, and releases the lease when the actor stops.
+func (l *Leases) ReceiverMiddleware(next actor.ReceiverFunc) actor.ReceiverFunc {
+	return func(ctx actor.ReceiverContext, envelope *actor.MessageEnvelope) {
+		switch envelope.Message.(type) {
+		case *actor.Started:
+			self, system := ctx.Self(), ctx.ActorSystem()
+			actorName := self.Id
+			// 再起動したactorは、前に取ったleaseを失ったとは通知せずに取り直す
+			l.forget(self)
+			epoch, err := l.Acquire(context.Background(), actorName)
+			if err != nil {
+				log.Printf("stop %s: %s", actorName, err)
+				ctx.(actor.Context).Stop(self)
+				return
+			}
+
+			var once sync.Once
+			lost := func() {
+				once.Do(func() {
+					system.Root.Send(self, &LeaseLost{ActorName: actorName, Epoch: epoch})
+				})
+			}
+			l.mu.Lock()
+			held, ok := l.held[actorName]
+			current := ok && held.epoch == epoch
+			if current {
+				renewCtx, stop := context.WithCancel(context.Background())
+				held.stop = stop
+				held.lost = lost
+				l.incarnations[self] = epoch
+				go l.keepRenewing(renewCtx, actorName, epoch, lost)
+			}
+			l.mu.Unlock()
+			if !current {
+				// 登録する前に、同じownerの別のincarnationに取り直された
+				lost()
+			}
+			next(ctx, envelope)
+
+		case *actor.Stopped:
+			next(ctx, envelope)
+			self := ctx.Self()
+			l.mu.Lock()
+			epoch, ok := l.incarnations[self]
+			delete(l.incarnations, self)
+			l.mu.Unlock()
+			if !ok {
+				return
+			}
+			if err := l.Release(context.Background(), self.Id, epoch); err != nil {
+				log.Printf("release lease of %s: %s", self.Id, err)
+			}
+
+		default:
+			next(ctx, envelope)
+		}
+	}
+}
+
+// forget stops renewing the lease the incarnation self acquired in ReceiverMiddleware, without releasing it.
+func (l *Leases) forget(self *actor.PID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	epoch, ok := l.incarnations[self]
+	if !ok {
+		return
+	}
+	delete(l.incarnations, self)
+	if held, ok := l.held[self.Id]; ok && held.epoch == epoch {
+		if held.stop != nil {
+			held.stop()
+		}
+		delete(l.held, self.Id)
+	}
+}
+
+func leaseKey(actorName string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"actorName": &types.AttributeValueMemberS{Value: actorName},
+	}
+}
+
+func unixMilli(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.UnixMilli(), 10)}
+}
@@ -0,0 +1,245 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asynkron/protoactor-go/actor"
+	"github.com/asynkron/protoactor-go/persistence"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+// takeOverLease gives the lease of actorName to owner behind the back of its holder, as a node with a skewed clock would.
+func takeOverLease(t *testing.T, client *dynamodb.Client, actorName string, owner string) {
+	_, err := client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+		TableName:                aws.String(p.DefaultLeaseTable),
+		Key:                      map[string]types.AttributeValue{"actorName": &types.AttributeValueMemberS{Value: actorName}},
+		UpdateExpression:         aws.String("SET #owner = :owner ADD epoch :one"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+			":one":   &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	require.NoError(t, err)
+}
+
+// persistError returns the error a store method panicked with in f.
+func persistError(f func()) (err error) {
+	defer func() {
+		err, _ = recover().(error)
+	}()
+	f()
+	return nil
+}
+
+func deleteLease(t *testing.T, client *dynamodb.Client, actorName string) {
+	_, err := client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(p.DefaultLeaseTable),
+		Key:       map[string]types.AttributeValue{"actorName": &types.AttributeValueMemberS{Value: actorName}},
+	})
+	require.NoError(t, err)
+}
+
+func TestLeases(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	nodeA := p.NewLeases(client, p.DefaultLeaseTable, "node-a", time.Second)
+	nodeB := p.NewLeases(client, p.DefaultLeaseTable, "node-b", time.Second)
+	require.NoError(t, p.CreateTables(ctx, client, p.WithLeases(nodeA)))
+
+	actorName := "testLeaseActor"
+	deleteLease(t, client, actorName)
+
+	epoch, err := nodeA.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), epoch)
+	_, err = nodeB.Acquire(ctx, actorName)
+	assert.ErrorIs(t, err, p.ErrLeaseHeld)
+
+	// leaseを持つnodeだけが書き込める
+	providerA := p.NewProviderState(client, p.WithLeases(nodeA))
+	providerB := p.NewProviderState(client, p.WithLeases(nodeB))
+	providerA.PersistEvent(actorName, 0, &p.Event{Data: "event1"})
+	assert.PanicsWithError(t, "lease lost: "+actorName, func() {
+		providerB.PersistEvent(actorName, 1, &p.Event{Data: "event2"})
+	})
+
+	// 期限が切れたら他のnodeが取れて、epochが増える
+	time.Sleep(1100 * time.Millisecond)
+	_, ok := nodeA.Held(actorName)
+	assert.False(t, ok)
+	epoch, err = nodeB.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), epoch)
+	providerB.PersistEvent(actorName, 1, &p.Event{Data: "event2"})
+
+	// 気付かないうちに取られたleaseでは書き込めない
+	takeOverLease(t, client, actorName, "node-a")
+	_, ok = nodeB.Held(actorName)
+	assert.True(t, ok)
+	err = persistError(func() {
+		providerB.PersistEvent(actorName, 2, &p.Event{Data: "event3"})
+	})
+	var stale *p.StaleWriterError
+	require.ErrorAs(t, err, &stale)
+	assert.Equal(t, &p.StaleWriterError{ActorName: actorName, Epoch: 2, CurrentEpoch: 3, CurrentOwner: "node-a"}, stale)
+	assert.ErrorIs(t, err, p.ErrLeaseLost)
+
+	// eventには書き込んだときのepochが残る
+	var epochs []int64
+	p.NewEventStore(client, p.DefaultJournalTable).GetEventEnvelopes(actorName, 0, 0, func(envelope p.EventEnvelope) {
+		epochs = append(epochs, envelope.Metadata.WriterEpoch)
+	})
+	assert.Equal(t, []int64{1, 2}, epochs)
+
+	// 解放すると、期限を待たずに取れる
+	_, err = nodeB.Acquire(ctx, actorName)
+	assert.ErrorIs(t, err, p.ErrLeaseHeld)
+	deleteLease(t, client, actorName)
+	epoch, err = nodeA.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	require.NoError(t, nodeA.Release(ctx, actorName, epoch))
+	epoch, err = nodeB.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	require.NoError(t, nodeB.Release(ctx, actorName, epoch))
+
+	// 同じnodeで取り直したleaseは、前のepochで解放しても解放されない
+	previous, err := nodeB.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	epoch, err = nodeB.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	require.NoError(t, nodeB.Release(ctx, actorName, previous))
+	held, ok := nodeB.Held(actorName)
+	assert.True(t, ok)
+	assert.Equal(t, epoch, held)
+	_, err = nodeA.Acquire(ctx, actorName)
+	assert.ErrorIs(t, err, p.ErrLeaseHeld)
+	require.NoError(t, nodeB.Release(ctx, actorName, epoch))
+
+	// クリーンアップ
+	deleteLease(t, client, actorName)
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+}
+
+// leasedActor reports when it loses its lease.
+type leasedActor struct {
+	persistence.Mixin
+	lost chan *p.LeaseLost
+}
+
+func (a *leasedActor) Receive(ctx actor.Context) {
+	switch msg := ctx.Message().(type) {
+	case *p.LeaseLost:
+		a.lost <- msg
+		ctx.Stop(ctx.Self())
+	case *p.Event:
+		if !a.Recovering() {
+			a.PersistReceive(msg)
+		}
+	}
+}
+
+func TestLeases_ReceiverMiddleware(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	leases := p.NewLeases(client, p.DefaultLeaseTable, "node-a", 600*time.Millisecond)
+	require.NoError(t, p.CreateTables(ctx, client, p.WithLeases(leases)))
+	provider := p.NewProviderState(client, p.WithLeases(leases))
+
+	actorName := "testLeasedActor"
+	deleteLease(t, client, actorName)
+	lost := make(chan *p.LeaseLost, 1)
+	props := actor.PropsFromProducer(func() actor.Actor {
+		return &leasedActor{lost: lost}
+	}, actor.WithReceiverMiddleware(leases.ReceiverMiddleware, persistence.Using(provider)))
+
+	system := actor.NewActorSystem()
+	pid, err := system.Root.SpawnNamed(props, actorName)
+	require.NoError(t, err)
+	system.Root.Send(pid, &p.Event{Data: "event1"})
+
+	// 起動時に取ったleaseは、期限を過ぎても更新され続ける
+	time.Sleep(time.Second)
+	epoch, ok := leases.Held(actorName)
+	assert.True(t, ok)
+
+	// 他のnodeに取られると通知される
+	takeOverLease(t, client, actorName, "node-b")
+	select {
+	case msg := <-lost:
+		assert.Equal(t, &p.LeaseLost{ActorName: actorName, Epoch: epoch}, msg)
+	case <-time.After(2 * time.Second):
+		t.Fatal("lease lost was not notified")
+	}
+
+	// 他のnodeが持っている間は、起動してもすぐに止まる
+	_, err = system.Root.SpawnNamed(props, actorName)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := system.ProcessRegistry.GetLocal(actorName)
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok = leases.Held(actorName)
+	assert.False(t, ok)
+
+	// クリーンアップ
+	deleteLease(t, client, actorName)
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorName)
+}
+
+func TestLeases_ReceiverMiddlewareSameNode(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	leases := p.NewLeases(client, p.DefaultLeaseTable, "node-a", time.Minute)
+	require.NoError(t, p.CreateTables(ctx, client, p.WithLeases(leases)))
+	provider := p.NewProviderState(client, p.WithLeases(leases))
+
+	actorName := "testLeasedSameNodeActor"
+	deleteLease(t, client, actorName)
+	lost := make(chan *p.LeaseLost, 1)
+	props := actor.PropsFromProducer(func() actor.Actor {
+		return &leasedActor{lost: lost}
+	}, actor.WithReceiverMiddleware(leases.ReceiverMiddleware, persistence.Using(provider)))
+
+	system := actor.NewActorSystem()
+	_, err := system.Root.SpawnNamed(props, actorName)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, ok := leases.Held(actorName)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	previous, _ := leases.Held(actorName)
+
+	// 同じnodeで取り直されると、前のincarnationに通知される
+	epoch, err := leases.Acquire(ctx, actorName)
+	require.NoError(t, err)
+	select {
+	case msg := <-lost:
+		assert.Equal(t, &p.LeaseLost{ActorName: actorName, Epoch: previous}, msg)
+	case <-time.After(2 * time.Second):
+		t.Fatal("lease lost was not notified")
+	}
+
+	// 前のincarnationが止まっても、新しいleaseは解放されない
+	assert.Eventually(t, func() bool {
+		_, ok := system.ProcessRegistry.GetLocal(actorName)
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	held, ok := leases.Held(actorName)
+	assert.True(t, ok)
+	assert.Equal(t, epoch, held)
+	_, err = p.NewLeases(client, p.DefaultLeaseTable, "node-b", time.Minute).Acquire(ctx, actorName)
+	assert.ErrorIs(t, err, p.ErrLeaseHeld)
+
+	// クリーンアップ
+	require.NoError(t, leases.Release(ctx, actorName, epoch))
+	deleteLease(t, client, actorName)
+}
@@ -0,0 +1,479 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// SerializerDynamoDBMap is recorded as the serializer of items whose payload is a native DynamoDB map.
+const SerializerDynamoDBMap = "dynamodb-map"
+
+const (
+	anyTypeKey  = "@type"
+	anyValueKey = "@value"
+	anyBytesKey = "@bytes"
+)
+
+// MarshalAttributeValue converts a proto message into a DynamoDB map attribute.
+// Fields are keyed by their proto names, and well-known types are stored the way protojson writes them,
+// e.g. a google.protobuf.Timestamp becomes an RFC 3339 string. The result can be filtered with expressions.
+func MarshalAttributeValue(message proto.Message) (*types.AttributeValueMemberM, error) {
+	av, err := marshalMessage(message.ProtoReflect())
+	if err != nil {
+		return nil, err
+	}
+	m, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return nil, fmt.Errorf("%s is not stored as a map", message.ProtoReflect().Descriptor().FullName())
+	}
+	return m, nil
+}
+
+// UnmarshalAttributeValue restores a message written by MarshalAttributeValue.
+// Attributes that have no field in the message are ignored, so fields can be removed from the schema.
+func UnmarshalAttributeValue(av types.AttributeValue, message proto.Message) error {
+	proto.Reset(message)
+	return unmarshalMessage(av, message.ProtoReflect())
+}
+
+func marshalMessage(m protoreflect.Message) (types.AttributeValue, error) {
+	switch m.Descriptor().FullName() {
+	case "google.protobuf.Timestamp", "google.protobuf.Duration", "google.protobuf.FieldMask":
+		// protojsonのJSON文字列表現をそのまま使う
+		data, err := protojson.Marshal(m.Interface())
+		if err != nil {
+			return nil, err
+		}
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		return &types.AttributeValueMemberS{Value: s}, nil
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		fd := m.Descriptor().Fields().ByName("value")
+		return marshalSingular(fd, m.Get(fd))
+	case "google.protobuf.Struct":
+		return marshalMap(m.Descriptor().Fields().ByName("fields"), m.Get(m.Descriptor().Fields().ByName("fields")).Map())
+	case "google.protobuf.ListValue":
+		return marshalList(m.Descriptor().Fields().ByName("values"), m.Get(m.Descriptor().Fields().ByName("values")).List())
+	case "google.protobuf.Value":
+		fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("kind"))
+		if fd == nil || fd.Name() == "null_value" {
+			return &types.AttributeValueMemberNULL{Value: true}, nil
+		}
+		return marshalSingular(fd, m.Get(fd))
+	case "google.protobuf.Any":
+		return marshalAny(m)
+	}
+
+	attrs := map[string]types.AttributeValue{}
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		var av types.AttributeValue
+		switch {
+		case fd.IsList():
+			av, err = marshalList(fd, v.List())
+		case fd.IsMap():
+			av, err = marshalMap(fd, v.Map())
+		default:
+			av, err = marshalSingular(fd, v)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", fd.FullName(), err)
+			return false
+		}
+		attrs[string(fd.Name())] = av
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &types.AttributeValueMemberM{Value: attrs}, nil
+}
+
+// marshalAny stores the embedded message as a map with its type URL.
+// Messages whose type is not linked into the binary are kept as bytes.
+func marshalAny(m protoreflect.Message) (types.AttributeValue, error) {
+	fields := m.Descriptor().Fields()
+	typeURL := m.Get(fields.ByName("type_url")).String()
+	value := m.Get(fields.ByName("value")).Bytes()
+
+	mt, err := protoregistry.GlobalTypes.FindMessageByURL(typeURL)
+	if err != nil {
+		return &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			anyTypeKey:  &types.AttributeValueMemberS{Value: typeURL},
+			anyBytesKey: &types.AttributeValueMemberB{Value: value},
+		}}, nil
+	}
+	embedded := mt.New()
+	if err := proto.Unmarshal(value, embedded.Interface()); err != nil {
+		return nil, err
+	}
+	av, err := marshalMessage(embedded)
+	if err != nil {
+		return nil, err
+	}
+	attrs, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		// Timestampなどmap以外になる型は@valueに入れる
+		attrs = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{anyValueKey: av}}
+	}
+	attrs.Value[anyTypeKey] = &types.AttributeValueMemberS{Value: typeURL}
+	return attrs, nil
+}
+
+func marshalList(fd protoreflect.FieldDescriptor, list protoreflect.List) (types.AttributeValue, error) {
+	values := make([]types.AttributeValue, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		av, err := marshalSingular(fd, list.Get(i))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, av)
+	}
+	return &types.AttributeValueMemberL{Value: values}, nil
+}
+
+func marshalMap(fd protoreflect.FieldDescriptor, m protoreflect.Map) (types.AttributeValue, error) {
+	attrs := make(map[string]types.AttributeValue, m.Len())
+	var err error
+	m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+		var av types.AttributeValue
+		av, err = marshalSingular(fd.MapValue(), v)
+		if err != nil {
+			return false
+		}
+		// map keyはbool、整数、文字列のいずれかなので、文字列にして保存する
+		attrs[k.String()] = av
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &types.AttributeValueMemberM{Value: attrs}, nil
+}
+
+func marshalSingular(fd protoreflect.FieldDescriptor, v protoreflect.Value) (types.AttributeValue, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return &types.AttributeValueMemberBOOL{Value: v.Bool()}, nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return &types.AttributeValueMemberN{Value: strconv.FormatInt(v.Int(), 10)}, nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return &types.AttributeValueMemberN{Value: strconv.FormatUint(v.Uint(), 10)}, nil
+	case protoreflect.FloatKind:
+		return marshalFloat(v.Float(), 32), nil
+	case protoreflect.DoubleKind:
+		return marshalFloat(v.Float(), 64), nil
+	case protoreflect.StringKind:
+		return &types.AttributeValueMemberS{Value: v.String()}, nil
+	case protoreflect.BytesKind:
+		return &types.AttributeValueMemberB{Value: v.Bytes()}, nil
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return &types.AttributeValueMemberS{Value: string(ev.Name())}, nil
+		}
+		// 未知の値は番号のまま残す
+		return &types.AttributeValueMemberN{Value: strconv.Itoa(int(v.Enum()))}, nil
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return marshalMessage(v.Message())
+	}
+	return nil, fmt.Errorf("unsupported kind %s", fd.Kind())
+}
+
+// marshalFloat uses strings for values the number type of DynamoDB can not hold.
+func marshalFloat(f float64, bitSize int) types.AttributeValue {
+	switch {
+	case math.IsNaN(f):
+		return &types.AttributeValueMemberS{Value: "NaN"}
+	case math.IsInf(f, 1):
+		return &types.AttributeValueMemberS{Value: "Infinity"}
+	case math.IsInf(f, -1):
+		return &types.AttributeValueMemberS{Value: "-Infinity"}
+	case f != 0 && (math.Abs(f) >= 1e126 || math.Abs(f) < 1e-130):
+		// DynamoDBのNumberは1E-130から9.9999999999999999999999999999999999999E+125まで
+		return &types.AttributeValueMemberS{Value: strconv.FormatFloat(f, 'g', -1, bitSize)}
+	}
+	return &types.AttributeValueMemberN{Value: strconv.FormatFloat(f, 'g', -1, bitSize)}
+}
+
+func unmarshalMessage(av types.AttributeValue, m protoreflect.Message) error {
+	switch m.Descriptor().FullName() {
+	case "google.protobuf.Timestamp", "google.protobuf.Duration", "google.protobuf.FieldMask":
+		s, ok := av.(*types.AttributeValueMemberS)
+		if !ok {
+			return fmt.Errorf("%s must be a string, got %T", m.Descriptor().FullName(), av)
+		}
+		data, err := json.Marshal(s.Value)
+		if err != nil {
+			return err
+		}
+		return protojson.Unmarshal(data, m.Interface())
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		fd := m.Descriptor().Fields().ByName("value")
+		v, err := unmarshalSingular(av, fd)
+		if err != nil {
+			return err
+		}
+		m.Set(fd, v)
+		return nil
+	case "google.protobuf.Struct":
+		fd := m.Descriptor().Fields().ByName("fields")
+		return unmarshalMap(av, fd, m.Mutable(fd).Map())
+	case "google.protobuf.ListValue":
+		fd := m.Descriptor().Fields().ByName("values")
+		return unmarshalList(av, fd, m.Mutable(fd).List())
+	case "google.protobuf.Value":
+		return unmarshalValue(av, m)
+	case "google.protobuf.Any":
+		return unmarshalAny(av, m)
+	}
+
+	attrs, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return fmt.Errorf("%s must be a map, got %T", m.Descriptor().FullName(), av)
+	}
+	fields := m.Descriptor().Fields()
+	for name, fav := range attrs.Value {
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			continue
+		}
+		var err error
+		switch {
+		case fd.IsList():
+			err = unmarshalList(fav, fd, m.Mutable(fd).List())
+		case fd.IsMap():
+			err = unmarshalMap(fav, fd, m.Mutable(fd).Map())
+		case fd.Message() != nil:
+			err = unmarshalMessage(fav, m.Mutable(fd).Message())
+		default:
+			var v protoreflect.Value
+			v, err = unmarshalSingular(fav, fd)
+			if err == nil {
+				m.Set(fd, v)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", fd.FullName(), err)
+		}
+	}
+	return nil
+}
+
+func unmarshalValue(av types.AttributeValue, m protoreflect.Message) error {
+	fields := m.Descriptor().Fields()
+	switch v := av.(type) {
+	case *types.AttributeValueMemberNULL:
+		m.Set(fields.ByName("null_value"), protoreflect.ValueOfEnum(0))
+	case *types.AttributeValueMemberN:
+		f, err := strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return err
+		}
+		m.Set(fields.ByName("number_value"), protoreflect.ValueOfFloat64(f))
+	case *types.AttributeValueMemberS:
+		m.Set(fields.ByName("string_value"), protoreflect.ValueOfString(v.Value))
+	case *types.AttributeValueMemberBOOL:
+		m.Set(fields.ByName("bool_value"), protoreflect.ValueOfBool(v.Value))
+	case *types.AttributeValueMemberM:
+		return unmarshalMessage(av, m.Mutable(fields.ByName("struct_value")).Message())
+	case *types.AttributeValueMemberL:
+		return unmarshalMessage(av, m.Mutable(fields.ByName("list_value")).Message())
+	default:
+		return fmt.Errorf("google.protobuf.Value can not hold %T", av)
+	}
+	return nil
+}
+
+func unmarshalAny(av types.AttributeValue, m protoreflect.Message) error {
+	attrs, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return fmt.Errorf("google.protobuf.Any must be a map, got %T", av)
+	}
+	typeURL, ok := attrs.Value[anyTypeKey].(*types.AttributeValueMemberS)
+	if !ok {
+		return fmt.Errorf("google.protobuf.Any has no %s", anyTypeKey)
+	}
+	fields := m.Descriptor().Fields()
+	m.Set(fields.ByName("type_url"), protoreflect.ValueOfString(typeURL.Value))
+
+	if raw, ok := attrs.Value[anyBytesKey].(*types.AttributeValueMemberB); ok {
+		m.Set(fields.ByName("value"), protoreflect.ValueOfBytes(raw.Value))
+		return nil
+	}
+
+	mt, err := protoregistry.GlobalTypes.FindMessageByURL(typeURL.Value)
+	if err != nil {
+		return err
+	}
+	embedded := mt.New()
+	value, ok := attrs.Value[anyValueKey]
+	if !ok {
+		value = attrs
+	}
+	if err := unmarshalMessage(value, embedded); err != nil {
+		return err
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(embedded.Interface())
+	if err != nil {
+		return err
+	}
+	m.Set(fields.ByName("value"), protoreflect.ValueOfBytes(data))
+	return nil
+}
+
+func unmarshalList(av types.AttributeValue, fd protoreflect.FieldDescriptor, list protoreflect.List) error {
+	values, ok := av.(*types.AttributeValueMemberL)
+	if !ok {
+		return fmt.Errorf("repeated field must be a list, got %T", av)
+	}
+	for _, elem := range values.Value {
+		if fd.Message() != nil {
+			v := list.NewElement()
+			if err := unmarshalMessage(elem, v.Message()); err != nil {
+				return err
+			}
+			list.Append(v)
+			continue
+		}
+		v, err := unmarshalSingular(elem, fd)
+		if err != nil {
+			return err
+		}
+		list.Append(v)
+	}
+	return nil
+}
+
+func unmarshalMap(av types.AttributeValue, fd protoreflect.FieldDescriptor, m protoreflect.Map) error {
+	attrs, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return fmt.Errorf("map field must be a map, got %T", av)
+	}
+	for k, elem := range attrs.Value {
+		key, err := unmarshalMapKey(k, fd.MapKey())
+		if err != nil {
+			return err
+		}
+		if fd.MapValue().Message() != nil {
+			v := m.NewValue()
+			if err := unmarshalMessage(elem, v.Message()); err != nil {
+				return err
+			}
+			m.Set(key, v)
+			continue
+		}
+		v, err := unmarshalSingular(elem, fd.MapValue())
+		if err != nil {
+			return err
+		}
+		m.Set(key, v)
+	}
+	return nil
+}
+
+func unmarshalMapKey(s string, fd protoreflect.FieldDescriptor) (protoreflect.MapKey, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s).MapKey(), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(b).MapKey(), err
+	}
+	v, err := unmarshalSingular(&types.AttributeValueMemberN{Value: s}, fd)
+	if err != nil {
+		return protoreflect.MapKey{}, err
+	}
+	return v.MapKey(), nil
+}
+
+// unmarshalSingular converts a scalar attribute. Message fields are handled by unmarshalMessage.
+func unmarshalSingular(av types.AttributeValue, fd protoreflect.FieldDescriptor) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if v, ok := av.(*types.AttributeValueMemberBOOL); ok {
+			return protoreflect.ValueOfBool(v.Value), nil
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		if v, ok := av.(*types.AttributeValueMemberN); ok {
+			i, err := strconv.ParseInt(v.Value, 10, 32)
+			return protoreflect.ValueOfInt32(int32(i)), err
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if v, ok := av.(*types.AttributeValueMemberN); ok {
+			i, err := strconv.ParseInt(v.Value, 10, 64)
+			return protoreflect.ValueOfInt64(i), err
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		if v, ok := av.(*types.AttributeValueMemberN); ok {
+			i, err := strconv.ParseUint(v.Value, 10, 32)
+			return protoreflect.ValueOfUint32(uint32(i)), err
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if v, ok := av.(*types.AttributeValueMemberN); ok {
+			i, err := strconv.ParseUint(v.Value, 10, 64)
+			return protoreflect.ValueOfUint64(i), err
+		}
+	case protoreflect.FloatKind:
+		f, err := unmarshalFloat(av, 32)
+		return protoreflect.ValueOfFloat32(float32(f)), err
+	case protoreflect.DoubleKind:
+		f, err := unmarshalFloat(av, 64)
+		return protoreflect.ValueOfFloat64(f), err
+	case protoreflect.StringKind:
+		if v, ok := av.(*types.AttributeValueMemberS); ok {
+			return protoreflect.ValueOfString(v.Value), nil
+		}
+	case protoreflect.BytesKind:
+		if v, ok := av.(*types.AttributeValueMemberB); ok {
+			return protoreflect.ValueOfBytes(v.Value), nil
+		}
+	case protoreflect.EnumKind:
+		switch v := av.(type) {
+		case *types.AttributeValueMemberS:
+			ev := fd.Enum().Values().ByName(protoreflect.Name(v.Value))
+			if ev == nil {
+				return protoreflect.Value{}, fmt.Errorf("unknown value %s of %s", v.Value, fd.Enum().FullName())
+			}
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		case *types.AttributeValueMemberN:
+			i, err := strconv.ParseInt(v.Value, 10, 32)
+			return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), err
+		}
+	}
+	return protoreflect.Value{}, fmt.Errorf("%s field can not hold %T", fd.Kind(), av)
+}
+
+func unmarshalFloat(av types.AttributeValue, bitSize int) (float64, error) {
+	switch v := av.(type) {
+	case *types.AttributeValueMemberN:
+		return strconv.ParseFloat(v.Value, bitSize)
+	case *types.AttributeValueMemberS:
+		switch v.Value {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+		return strconv.ParseFloat(v.Value, bitSize)
+	}
+	return 0, fmt.Errorf("float field can not hold %T", av)
+}
@@ -0,0 +1,314 @@
+package persistence_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	_ "google.golang.org/protobuf/types/known/durationpb"
+	_ "google.golang.org/protobuf/types/known/fieldmaskpb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// sampleDescriptor builds a message type covering scalars, enums, repeated fields, maps, oneofs and well-known types.
+func sampleDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     typ.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	repeated := func(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		return f
+	}
+	oneof := func(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		f.OneofIndex = proto.Int32(0)
+		return f
+	}
+	mapEntry := func(name string, key descriptorpb.FieldDescriptorProto_Type, value descriptorpb.FieldDescriptorProto_Type, valueType string) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{
+			Name:    proto.String(name),
+			Field:   []*descriptorpb.FieldDescriptorProto{field("key", 1, key, ""), field("value", 2, value, valueType)},
+			Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+		}
+	}
+
+	const (
+		tString  = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		tInt32   = descriptorpb.FieldDescriptorProto_TYPE_INT32
+		tInt64   = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		tUint32  = descriptorpb.FieldDescriptorProto_TYPE_UINT32
+		tUint64  = descriptorpb.FieldDescriptorProto_TYPE_UINT64
+		tSint64  = descriptorpb.FieldDescriptorProto_TYPE_SINT64
+		tFixed64 = descriptorpb.FieldDescriptorProto_TYPE_FIXED64
+		tFloat   = descriptorpb.FieldDescriptorProto_TYPE_FLOAT
+		tDouble  = descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+		tBool    = descriptorpb.FieldDescriptorProto_TYPE_BOOL
+		tBytes   = descriptorpb.FieldDescriptorProto_TYPE_BYTES
+		tEnum    = descriptorpb.FieldDescriptorProto_TYPE_ENUM
+		tMessage = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	)
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("native_test.proto"),
+		Package: proto.String("nativetest"),
+		Syntax:  proto.String("proto3"),
+		Dependency: []string{
+			"google/protobuf/any.proto",
+			"google/protobuf/duration.proto",
+			"google/protobuf/field_mask.proto",
+			"google/protobuf/struct.proto",
+			"google/protobuf/timestamp.proto",
+			"google/protobuf/wrappers.proto",
+		},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Color"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("COLOR_UNSPECIFIED"), Number: proto.Int32(0)},
+				{Name: proto.String("RED"), Number: proto.Int32(1)},
+				{Name: proto.String("BLUE"), Number: proto.Int32(2)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Nested"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("label", 1, tString, ""),
+					repeated(field("values", 2, tInt32, "")),
+				},
+			},
+			{
+				Name: proto.String("Sample"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, tString, ""),
+					field("i32", 2, tInt32, ""),
+					field("i64", 3, tInt64, ""),
+					field("u32", 4, tUint32, ""),
+					field("u64", 5, tUint64, ""),
+					field("s64", 6, tSint64, ""),
+					field("f64", 7, tFixed64, ""),
+					field("f", 8, tFloat, ""),
+					field("d", 9, tDouble, ""),
+					field("b", 10, tBool, ""),
+					field("data", 11, tBytes, ""),
+					field("color", 12, tEnum, ".nativetest.Color"),
+					field("nested", 13, tMessage, ".nativetest.Nested"),
+					repeated(field("tags", 14, tString, "")),
+					repeated(field("children", 15, tMessage, ".nativetest.Nested")),
+					repeated(field("counts", 16, tMessage, ".nativetest.Sample.CountsEntry")),
+					repeated(field("by_id", 17, tMessage, ".nativetest.Sample.ByIdEntry")),
+					repeated(field("flags", 18, tMessage, ".nativetest.Sample.FlagsEntry")),
+					oneof(field("text", 19, tString, "")),
+					oneof(field("inner", 20, tMessage, ".nativetest.Nested")),
+					oneof(field("number", 21, tInt64, "")),
+					field("occurred_at", 22, tMessage, ".google.protobuf.Timestamp"),
+					field("timeout", 23, tMessage, ".google.protobuf.Duration"),
+					field("attributes", 24, tMessage, ".google.protobuf.Struct"),
+					field("value", 25, tMessage, ".google.protobuf.Value"),
+					field("nickname", 26, tMessage, ".google.protobuf.StringValue"),
+					field("limit", 27, tMessage, ".google.protobuf.Int64Value"),
+					field("detail", 28, tMessage, ".google.protobuf.Any"),
+					field("mask", 29, tMessage, ".google.protobuf.FieldMask"),
+					repeated(field("scores", 30, tDouble, "")),
+					repeated(field("colors", 31, tEnum, ".nativetest.Color")),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					mapEntry("CountsEntry", tString, tInt64, ""),
+					mapEntry("ByIdEntry", tInt32, tMessage, ".nativetest.Nested"),
+					mapEntry("FlagsEntry", tBool, tString, ""),
+				},
+				OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("choice")}},
+			},
+		},
+	}
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+	return fd.Messages().ByName("Sample")
+}
+
+func newSample(t *testing.T, md protoreflect.MessageDescriptor, json string) proto.Message {
+	m := dynamicpb.NewMessage(md)
+	require.NoError(t, protojson.Unmarshal([]byte(json), m))
+	return m
+}
+
+func TestMarshalAttributeValue_RoundTrip(t *testing.T) {
+	md := sampleDescriptor(t)
+
+	cases := map[string]string{
+		"scalars": `{
+			"name": "sample", "i32": -32, "i64": "-9007199254740993", "u32": 4294967295,
+			"u64": "18446744073709551615", "s64": "-64", "f64": "64", "f": 1.1, "d": 0.1,
+			"b": true, "data": "AAEC/w==", "color": "BLUE"
+		}`,
+		"repeated": `{
+			"tags": ["a", "", "c"],
+			"children": [{"label": "first", "values": [1, 2]}, {}],
+			"scores": [1.5, -2.25, 1e300, 5e-324],
+			"colors": ["RED", "COLOR_UNSPECIFIED", "BLUE"]
+		}`,
+		"maps": `{
+			"counts": {"a": "1", "b": "-2"},
+			"by_id": {"-1": {"label": "minus"}, "42": {"values": [4, 2]}},
+			"flags": {"true": "yes", "false": "no"}
+		}`,
+		"oneof string":  `{"text": "chosen"}`,
+		"oneof message": `{"inner": {"label": "chosen"}}`,
+		"oneof empty":   `{"inner": {}}`,
+		"oneof number":  `{"number": "0"}`,
+		"well-known types": `{
+			"occurred_at": "2024-04-13T04:54:29.123456789Z",
+			"timeout": "-3600.000000001s",
+			"attributes": {"s": "x", "n": 1.5, "b": false, "z": null, "l": [1, "two", {"three": 3}], "o": {}},
+			"value": [null, true],
+			"nickname": "",
+			"limit": "9223372036854775807",
+			"mask": "name,occurredAt",
+			"detail": {"@type": "type.googleapis.com/persistence.Event", "id": "1", "occurredAt": "1970-01-01T00:00:00Z"}
+		}`,
+		"nested timestamp in any": `{
+			"detail": {"@type": "type.googleapis.com/google.protobuf.Timestamp", "value": "2000-01-01T00:00:00Z"}
+		}`,
+	}
+	for name, json := range cases {
+		t.Run(name, func(t *testing.T) {
+			message := newSample(t, md, json)
+
+			av, err := p.MarshalAttributeValue(message)
+			require.NoError(t, err)
+
+			restored := dynamicpb.NewMessage(md)
+			require.NoError(t, p.UnmarshalAttributeValue(av, restored))
+			assert.True(t, proto.Equal(message, restored), "expected %v, got %v", message, restored)
+		})
+	}
+}
+
+func TestMarshalAttributeValue_Readable(t *testing.T) {
+	md := sampleDescriptor(t)
+	message := newSample(t, md, `{
+		"name": "sample", "i64": "12", "color": "RED", "tags": ["a"],
+		"counts": {"a": "1"}, "occurred_at": "2024-04-13T04:54:29Z", "nickname": "nick"
+	}`)
+
+	av, err := p.MarshalAttributeValue(message)
+	require.NoError(t, err)
+
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "sample"}, av.Value["name"])
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "12"}, av.Value["i64"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "RED"}, av.Value["color"])
+	assert.Equal(t, &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberS{Value: "a"}}}, av.Value["tags"])
+	assert.Equal(t, &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{"a": &types.AttributeValueMemberN{Value: "1"}}}, av.Value["counts"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "2024-04-13T04:54:29Z"}, av.Value["occurred_at"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "nick"}, av.Value["nickname"])
+	// 値のないfieldは保存しない
+	assert.NotContains(t, av.Value, "i32")
+}
+
+func TestMarshalAttributeValue_SpecialValues(t *testing.T) {
+	md := sampleDescriptor(t)
+	message := dynamicpb.NewMessage(md)
+	scores := message.Mutable(md.Fields().ByName("scores")).List()
+	for _, f := range []float64{math.Inf(1), math.Inf(-1), math.MaxFloat64} {
+		scores.Append(protoreflect.ValueOfFloat64(f))
+	}
+	// 未知のenum値は番号のまま残す
+	message.Set(md.Fields().ByName("color"), protoreflect.ValueOfEnum(7))
+	// 型が分からないAnyはbytesのまま残す
+	message.Set(md.Fields().ByName("detail"), protoreflect.ValueOfMessage((&anypb.Any{
+		TypeUrl: "type.googleapis.com/unknown.Message",
+		Value:   []byte{0x08, 0x01},
+	}).ProtoReflect()))
+
+	av, err := p.MarshalAttributeValue(message)
+	require.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "7"}, av.Value["color"])
+
+	restored := dynamicpb.NewMessage(md)
+	require.NoError(t, p.UnmarshalAttributeValue(av, restored))
+	assert.True(t, proto.Equal(message, restored))
+	assert.True(t, math.IsInf(restored.Get(md.Fields().ByName("scores")).List().Get(0).Float(), 1))
+}
+
+func TestEventStore_PersistEventWithNativeEncoding(t *testing.T) {
+	ctx := context.Background()
+	tableName := "journal"
+
+	client := InitializeDynamoDBClient()
+	eventStore := p.NewEventStore(client, tableName, p.WithNativeEncoding())
+
+	actorName := "testNativeActor"
+	occurredAt := time.Date(2024, 4, 13, 4, 54, 29, 123456789, time.UTC)
+	eventData := &p.Event{Id: "1", Type: "CreateUserAccount", Data: "user@example.com", OccurredAt: timestamppb.New(occurredAt)}
+	eventStore.PersistEvent(actorName, 1, eventData)
+	eventStore.PersistEvent(actorName, 2, &p.Event{Id: "2", Type: "ChangeEmail"})
+
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": 1,
+	})
+	require.NoError(t, err)
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{Key: key, TableName: aws.String(tableName)})
+	require.NoError(t, err)
+	payload := result.Item["payload"].(*types.AttributeValueMemberM)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "user@example.com"}, payload.Value["data"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "2024-04-13T04:54:29.123456789Z"}, payload.Value["occurred_at"])
+
+	// payloadの中身で絞り込める
+	query, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("actorName = :actorName"),
+		FilterExpression:       aws.String("payload.#type = :type"),
+		ExpressionAttributeNames: map[string]string{
+			"#type": "type",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+			":type":      &types.AttributeValueMemberS{Value: "ChangeEmail"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, query.Items, 1)
+
+	var events []interface{}
+	eventStore.GetEvents(actorName, 1, 1, func(e interface{}) { events = append(events, e) })
+	require.Len(t, events, 1)
+	assert.True(t, proto.Equal(eventData, events[0].(*p.Event)))
+
+	// クリーンアップ
+	for _, eventIndex := range []int{1, 2} {
+		key, err := attributevalue.MarshalMap(map[string]interface{}{
+			"actorName":  actorName,
+			"eventIndex": eventIndex,
+		})
+		require.NoError(t, err)
+		_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(tableName)})
+		require.NoError(t, err)
+	}
+}
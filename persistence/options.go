@@ -0,0 +1,334 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/proto"
+)
+
+// Option configures the ProviderState and the stores created for it.
+type Option func(*options)
+
+// ErrInvalidOptions is returned by CreateTables and the stores when an option is used without an option it needs.
+var ErrInvalidOptions = errors.New("invalid options")
+
+type options struct {
+	codec                Codec
+	compressionThreshold int
+	keyStore             *KeyStore
+	chunkTable           string
+	chunkSize            int
+	blobStore            BlobStore
+	blobThreshold        int
+	serializers          *SerializerRegistry
+	nativeEncoding       bool
+	nativeTypes          map[string]bool
+	upcasters            *UpcasterRegistry
+	snapshotMigrations   *SnapshotMigrations
+	ignoreStaleSnapshots bool
+	clock                func() time.Time
+	writerID             string
+	tagger               Tagger
+	headerCapture        *HeaderCapture
+	globalSequence       *globalSequence
+	globalSequenceWindow time.Duration
+	persistenceIDs       *persistenceIDRegistry
+	leases               *Leases
+	actorMetadata        *actorMetadataTable
+	compaction           *compactionPolicy
+	meterProvider        metric.MeterProvider
+	archiveReplay        *SegmentArchiver
+	ttl                  *ttlPolicy
+	softDelete           *softDelete
+	snapshotCacheBytes   int
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		codec:              NoneCodec(),
+		serializers:        NewSerializerRegistry(),
+		upcasters:          NewUpcasterRegistry(),
+		snapshotMigrations: NewSnapshotMigrations(),
+		clock:              time.Now,
+		writerID:           defaultWriterID(),
+		meterProvider:      otel.GetMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.actorMetadata != nil {
+		// metadataのitemも同じTTLで書き、最後のitemと一緒に期限切れにする
+		o.actorMetadata.ttl = o.ttl
+	}
+	if o.globalSequence != nil && o.globalSequenceWindow > 0 {
+		o.globalSequence.window = o.globalSequenceWindow
+	}
+	return o
+}
+
+// validate returns an ErrInvalidOptions error for options that can not be used as they are combined.
+func (o *options) validate() error {
+	if o.snapshotCacheBytes > 0 && o.actorMetadata == nil {
+		// metadataがないと、他のprocessが書いた新しいsnapshotに気付けない
+		return fmt.Errorf("%w: WithSnapshotCache needs WithActorMetadata", ErrInvalidOptions)
+	}
+	return nil
+}
+
+// WithCompression compresses payloads with the given codec.
+// Payloads smaller than threshold bytes are stored uncompressed, because
+// the codec header usually costs more than it saves on tiny messages.
+func WithCompression(codec Codec, threshold int) Option {
+	return func(o *options) {
+		o.codec = codec
+		o.compressionThreshold = threshold
+	}
+}
+
+// WithEncryption encrypts payloads with AES-GCM using per-actor data keys from keyStore.
+func WithEncryption(keyStore *KeyStore) Option {
+	return func(o *options) {
+		o.keyStore = keyStore
+	}
+}
+
+// WithChunking splits payloads larger than chunkSize bytes into items of the chunk table,
+// so that events and snapshots are not limited by the 400 KB item size of DynamoDB.
+func WithChunking(chunkTable string, chunkSize int) Option {
+	return func(o *options) {
+		o.chunkTable = chunkTable
+		o.chunkSize = chunkSize
+	}
+}
+
+// WithBlobStore writes payloads of threshold bytes or more to blobStore and keeps only a reference in DynamoDB.
+// It takes precedence over WithChunking. The blob of an item that is overwritten is deleted after the write.
+// Blobs do not expire with WithTTL, because DynamoDB deletes expired items without telling the store,
+// so give the bucket a lifecycle rule that expires objects no earlier than the items.
+func WithBlobStore(blobStore BlobStore, threshold int) Option {
+	return func(o *options) {
+		o.blobStore = blobStore
+		o.blobThreshold = threshold
+	}
+}
+
+// WithSerializers selects serializers for messages with registry instead of the protobuf binary default.
+func WithSerializers(registry *SerializerRegistry) Option {
+	return func(o *options) {
+		o.serializers = registry
+	}
+}
+
+// WithNativeEncoding stores proto messages as native DynamoDB maps instead of bytes,
+// so that items are readable in dynamodb-admin and can be filtered with expressions.
+// Without typeNames all proto messages are stored this way.
+// Payloads are neither compressed nor encrypted in this mode, so messages are still stored as bytes when encryption is enabled.
+func WithNativeEncoding(typeNames ...string) Option {
+	return func(o *options) {
+		o.nativeEncoding = true
+		if len(typeNames) > 0 {
+			o.nativeTypes = map[string]bool{}
+			for _, name := range typeNames {
+				o.nativeTypes[name] = true
+			}
+		}
+	}
+}
+
+// WithUpcasters upcasts events of old schema versions with registry when they are replayed,
+// and records the current schema version of each event when it is persisted.
+func WithUpcasters(registry *UpcasterRegistry) Option {
+	return func(o *options) {
+		o.upcasters = registry
+	}
+}
+
+// WithSnapshotMigrations migrates snapshots of old schema versions with migrations when they are loaded,
+// and records the current schema version of each snapshot when it is persisted.
+func WithSnapshotMigrations(migrations *SnapshotMigrations) Option {
+	return func(o *options) {
+		o.snapshotMigrations = migrations
+	}
+}
+
+// WithIgnoreUnmigratableSnapshots makes GetSnapshot and LoadSnapshot report no snapshot, instead of failing,
+// when a snapshot has no migration path to the current version or a migration fails. The actor then recovers by replaying all events.
+func WithIgnoreUnmigratableSnapshots() Option {
+	return func(o *options) {
+		o.ignoreStaleSnapshots = true
+	}
+}
+
+// WithClock sets the clock the write timestamp of events is taken from.
+func WithClock(clock func() time.Time) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithWriterID sets the ID of the node stored with each event. It defaults to the hostname.
+func WithWriterID(writerID string) Option {
+	return func(o *options) {
+		o.writerID = writerID
+	}
+}
+
+// WithTagger stores the tags returned by tagger with each event, and a row per tag in the tag table of the journal
+// for EventsByTag. CreateTables creates the tag table.
+func WithTagger(tagger Tagger) Option {
+	return func(o *options) {
+		o.tagger = tagger
+	}
+}
+
+// WithHeaderCapture stores the message headers captured by capture with each event.
+func WithHeaderCapture(capture *HeaderCapture) Option {
+	return func(o *options) {
+		o.headerCapture = capture
+	}
+}
+
+// WithGlobalSequence stores a global sequence number with each event, allocated in blocks of blockSize
+// from a counter item of sequenceTable, so that events of all actors can be read in one order with EventsSince.
+func WithGlobalSequence(sequenceTable string, blockSize int) Option {
+	return func(o *options) {
+		o.globalSequence = &globalSequence{table: sequenceTable, blockSize: int64(blockSize), window: DefaultGlobalSequenceWindow}
+	}
+}
+
+// WithGlobalSequenceWindow sets how long EventsSince holds back new events, DefaultGlobalSequenceWindow by default.
+// Writers use a block of numbers for at most half of window, so that an event with a lower number is written
+// before a reader passes it. A longer window tolerates more clock skew between writers, and delays readers more.
+func WithGlobalSequenceWindow(window time.Duration) Option {
+	return func(o *options) {
+		o.globalSequenceWindow = window
+	}
+}
+
+// WithPersistenceIDs registers every actor that writes events in persistenceIDTable,
+// so that actors can be listed with PersistenceIDs without scanning the journal.
+func WithPersistenceIDs(persistenceIDTable string) Option {
+	return func(o *options) {
+		o.persistenceIDs = &persistenceIDRegistry{table: persistenceIDTable}
+	}
+}
+
+// WithLeases refuses events and snapshots of actors that do not hold their lease in leases.
+// Use leases.ReceiverMiddleware before persistence.Using, so that actors acquire their lease when they recover.
+// The epoch of the lease is the fencing token: every write is conditioned on the lease item in the same transaction,
+// so stale writers are rejected with a *StaleWriterError only with WithLeases. WithActorMetadata does not fence writes.
+func WithLeases(leases *Leases) Option {
+	return func(o *options) {
+		o.leases = leases
+	}
+}
+
+// WithActorMetadata keeps a metadata item per actor in table, with the highest event index, the index
+// events are deleted to and the last snapshot index, updated in the same transaction as the events and snapshots.
+// Writers are fenced off by WithLeases, not by the metadata item.
+func WithActorMetadata(table string) Option {
+	return func(o *options) {
+		o.actorMetadata = &actorMetadataTable{table: table}
+	}
+}
+
+// compactionPolicy is how ProviderState compacts the journal after snapshots.
+type compactionPolicy struct {
+	safetyMargin int
+	concurrency  int
+	archiver     Archiver
+}
+
+// WithCompaction deletes the events of an actor up to its snapshot index minus safetyMargin after each PersistSnapshot,
+// in the background with at most concurrency compactions at a time. The event at the snapshot index is always kept,
+// because recovery replays from it. With WithSoftDelete, the events are tombstoned instead, and not archived.
+// A replay from a deleted event, e.g. when the snapshot can not be used, fails with ErrJournalTruncated
+// unless WithArchiveReplay reads the deleted events.
+func WithCompaction(safetyMargin int, concurrency int) Option {
+	return func(o *options) {
+		if o.compaction == nil {
+			o.compaction = &compactionPolicy{}
+		}
+		o.compaction.safetyMargin = safetyMargin
+		o.compaction.concurrency = concurrency
+	}
+}
+
+// WithCompactionArchive makes compaction archive events with archiver before it deletes them. It needs WithCompaction.
+func WithCompactionArchive(archiver Archiver) Option {
+	return func(o *options) {
+		if o.compaction == nil {
+			o.compaction = &compactionPolicy{concurrency: 1}
+		}
+		o.compaction.archiver = archiver
+	}
+}
+
+// WithArchiveReplay replays events from the segments of archive when the journal has been compacted
+// below the index recovery or a query starts at.
+func WithArchiveReplay(archive *SegmentArchiver) Option {
+	return func(o *options) {
+		o.archiveReplay = archive
+	}
+}
+
+// WithTTL writes the time events and snapshots of an actor expire at, as given by ttl, to attribute in epoch seconds,
+// or to DefaultTTLAttribute if attribute is empty. CreateTables enables TTL on that attribute.
+// Expired items are skipped before DynamoDB deletes them, and a replay that would skip expired events followed by
+// events that have not expired fails with ErrJournalExpired. Without WithActorMetadata, gaps left by DeleteEvents
+// are accepted, so expired events are only detected until DynamoDB removes them.
+func WithTTL(attribute string, ttl TTLFunc) Option {
+	return func(o *options) {
+		if attribute == "" {
+			attribute = DefaultTTLAttribute
+		}
+		o.ttl = &ttlPolicy{attribute: attribute, ttl: ttl}
+	}
+}
+
+// softDelete is how DeleteEvents tombstones events.
+type softDelete struct {
+	reason string
+}
+
+// WithSoftDelete makes DeleteEvents tombstone events with reason instead of removing them,
+// for data that must be hidden but kept. EventStore.PurgeEvents still removes events.
+func WithSoftDelete(reason string) Option {
+	return func(o *options) {
+		o.softDelete = &softDelete{reason: reason}
+	}
+}
+
+// WithSnapshotCache keeps the latest snapshots of recently used actors in memory, up to maxBytes of encoded snapshots,
+// so that actors that are stopped and spawned again recover without reading their snapshot from DynamoDB.
+// It needs WithActorMetadata: a cached snapshot is checked against the last snapshot index of the actor before it is used,
+// in case another process has written a newer one. The check is an eventually consistent read of that index only,
+// so a snapshot written by another process a moment ago may be missed, and recovery replays from the cached one.
+// Without WithActorMetadata, CreateTables and the snapshot store return an ErrInvalidOptions error.
+func WithSnapshotCache(maxBytes int) Option {
+	return func(o *options) {
+		o.snapshotCacheBytes = maxBytes
+	}
+}
+
+// WithMeterProvider sets the OpenTelemetry meter provider metrics are reported to. It defaults to the global one.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(o *options) {
+		o.meterProvider = provider
+	}
+}
+
+// useNativeEncoding reports whether message is stored as a native DynamoDB map.
+func (o *options) useNativeEncoding(message interface{}) bool {
+	if !o.nativeEncoding || o.keyStore != nil {
+		return false
+	}
+	if _, ok := message.(proto.Message); !ok {
+		return false
+	}
+	return o.nativeTypes == nil || o.nativeTypes[typeName(message)]
+}
@@ -0,0 +1,261 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	attrPayload    = "payload"
+	attrCodec      = "codec"
+	attrEncryption = "encryption"
+	attrDataKeyID  = "dataKeyId"
+
+	encryptionAESGCM = "AES-256-GCM"
+)
+
+// itemTable is the DynamoDB table a store keeps its items in.
+// EventStore and SnapshotStore share the way payloads are encoded into items.
+type itemTable struct {
+	client  *dynamodb.Client
+	table   string
+	options *options
+	// legacyManifest is the message type of items written without a manifest
+	legacyManifest string
+}
+
+// encodePayload turns a message into the payload attributes of a journal or snapshot item.
+// The payload is compressed first and then encrypted, since ciphertext does not compress.
+func (t *itemTable) encodePayload(ctx context.Context, actorName string, message interface{}) (map[string]types.AttributeValue, error) {
+	if t.options.useNativeEncoding(message) {
+		payload, err := MarshalAttributeValue(message.(proto.Message))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]types.AttributeValue{
+			attrSerializerID: &types.AttributeValueMemberS{Value: SerializerDynamoDBMap},
+			attrManifest:     &types.AttributeValueMemberS{Value: typeName(message)},
+			attrPayload:      payload,
+		}, nil
+	}
+
+	serializerID, manifest, payload, err := t.options.serializers.Serialize(message)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]types.AttributeValue{
+		attrSerializerID: &types.AttributeValueMemberS{Value: serializerID},
+		attrManifest:     &types.AttributeValueMemberS{Value: manifest},
+	}
+	if t.options.codec.Name() != CodecNone && len(payload) >= t.options.compressionThreshold {
+		payload, err = t.options.codec.Encode(payload)
+		if err != nil {
+			return nil, fmt.Errorf("compress payload with %s: %w", t.options.codec.Name(), err)
+		}
+		attrs[attrCodec] = &types.AttributeValueMemberS{Value: t.options.codec.Name()}
+	}
+
+	if t.options.keyStore != nil {
+		key, err := t.options.keyStore.currentKey(ctx, actorName)
+		if err != nil {
+			return nil, err
+		}
+		// actorNameをadditional dataにして、他のactorのitemへのコピーを検出する
+		payload, err = seal(key.aead, payload, []byte(actorName))
+		if err != nil {
+			return nil, err
+		}
+		attrs[attrEncryption] = &types.AttributeValueMemberS{Value: encryptionAESGCM}
+		attrs[attrDataKeyID] = &types.AttributeValueMemberS{Value: key.id}
+	}
+
+	attrs[attrPayload] = &types.AttributeValueMemberB{Value: payload}
+	return attrs, nil
+}
+
+// decodePayload restores the message stored in the payload attributes of an item.
+// Items written before compression existed have no codec attribute and are read as they are,
+// and items written before serializers existed are protobuf binary of the legacy type of the table.
+func (t *itemTable) decodePayload(ctx context.Context, actorName string, item map[string]types.AttributeValue) (interface{}, error) {
+	if native, ok := item[attrPayload].(*types.AttributeValueMemberM); ok {
+		manifest, _ := item[attrManifest].(*types.AttributeValueMemberS)
+		if manifest == nil {
+			return nil, fmt.Errorf("native payload has no %s", attrManifest)
+		}
+		message, err := newProtoMessage(manifest.Value)
+		if err != nil {
+			return nil, err
+		}
+		return message, UnmarshalAttributeValue(native, message)
+	}
+
+	payload, err := t.payloadBytes(ctx, item)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := item[attrEncryption].(*types.AttributeValueMemberS); ok {
+		if v.Value != encryptionAESGCM {
+			return nil, fmt.Errorf("unknown encryption: %s", v.Value)
+		}
+		if t.options.keyStore == nil {
+			return nil, fmt.Errorf("payload is encrypted but no key store is configured")
+		}
+		keyID, _ := item[attrDataKeyID].(*types.AttributeValueMemberS)
+		if keyID == nil {
+			return nil, fmt.Errorf("encrypted payload has no %s", attrDataKeyID)
+		}
+		key, err := t.options.keyStore.keyFor(ctx, actorName, keyID.Value)
+		if err != nil {
+			return nil, err
+		}
+		payload, err = open(key.aead, payload, []byte(actorName))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt payload: %w", err)
+		}
+	}
+
+	var codecName string
+	if v, ok := item[attrCodec].(*types.AttributeValueMemberS); ok {
+		codecName = v.Value
+	}
+	codec, err := LookupCodec(codecName)
+	if err != nil {
+		return nil, err
+	}
+	payload, err = codec.Decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload with %s: %w", codec.Name(), err)
+	}
+
+	serializerID, manifest := SerializerProto, t.legacyManifest
+	if v, ok := item[attrSerializerID].(*types.AttributeValueMemberS); ok {
+		serializerID = v.Value
+	}
+	if v, ok := item[attrManifest].(*types.AttributeValueMemberS); ok {
+		manifest = v.Value
+	}
+	return t.options.serializers.Deserialize(serializerID, manifest, payload)
+}
+
+// putItem writes an item, moving its payload to the blob store or splitting it into chunk items when it is large.
+// The item and its chunks are written in one transaction, so readers never see a partial payload.
+// With leases, the transaction also checks that the epoch the item is written under is still the current epoch of the lease.
+// The lease item is the only fencing token: the epoch of the lease is never behind the epoch of any write,
+// while an update of the actor metadata is dropped when the metadata is ahead of it, see transactWrite.
+// related are other writes that belong to the item, e.g. the update of the actor metadata, and are written in the same transaction.
+func (t *itemTable) putItem(ctx context.Context, item map[string]types.AttributeValue, related ...types.TransactWriteItem) (err error) {
+	var writes []types.TransactWriteItem
+	payload, _ := item[attrPayload].(*types.AttributeValueMemberB)
+	if payload != nil && t.options.blobStore != nil && len(payload.Value) >= t.options.blobThreshold {
+		item, err = t.offloadPayload(ctx, item, payload.Value)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				t.deleteOffloadedBlob(ctx, item)
+			}
+		}()
+	} else if payload != nil && t.options.chunkTable != "" && len(payload.Value) > t.options.chunkSize {
+		item, writes, err = t.chunkPayload(item, payload.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	actorName := item["actorName"].(*types.AttributeValueMemberS).Value
+	if t.options.ttl != nil {
+		if expiry, ok := t.options.ttl.expiry(actorName, t.options.clock()); ok {
+			// chunkも同時に期限切れにして、参照されないchunkを残さない
+			item[t.options.ttl.attribute] = expiry
+			for _, w := range writes {
+				w.Put.Item[t.options.ttl.attribute] = expiry
+			}
+		}
+	}
+	leaseCheck := -1
+	var epoch int64
+	if t.options.leases != nil {
+		var check types.TransactWriteItem
+		check, epoch, err = t.options.leases.conditionCheck(actorName)
+		if err != nil {
+			return err
+		}
+		leaseCheck = len(writes)
+		writes = append(writes, check)
+		item[attrWriterEpoch] = &types.AttributeValueMemberN{Value: strconv.FormatInt(epoch, 10)}
+	}
+	writes = append(writes, related...)
+	if len(writes)+1 > maxTransactItems {
+		return fmt.Errorf("%d writes exceed the transaction limit", len(writes)+1)
+	}
+
+	put := &types.Put{
+		TableName: aws.String(t.table),
+		Item:      item,
+	}
+	var replaced string
+	for attempt := 1; ; attempt++ {
+		if t.options.blobStore != nil {
+			// 上書きされるitemのblobを知るために、読んだ時から変わっていないことを条件にする
+			guardReplacedBlob(put, replaced)
+		}
+		err = t.writeItem(ctx, put, writes)
+		// 落としたmetadataの更新はleaseの確認より後ろにあるので、確認の位置は変わらない
+		var canceled *types.TransactionCanceledException
+		if leaseCheck >= 0 && errors.As(err, &canceled) && leaseCheck < len(canceled.CancellationReasons) {
+			if reason := canceled.CancellationReasons[leaseCheck]; aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				return staleWriterError(actorName, epoch, reason.Item)
+			}
+		}
+		current, ok := replacedItem(err)
+		if t.options.blobStore == nil || !ok || attempt >= batchWriteAttempts {
+			break
+		}
+		replaced, _ = payloadRefKey(current)
+	}
+	if err == nil && replaced != "" {
+		// 上書きされたitemのblobは、もうどのitemからも参照されない
+		_ = t.options.blobStore.DeleteObject(ctx, replaced)
+	}
+	return err
+}
+
+// writeItem writes put alone, or in one transaction with writes.
+func (t *itemTable) writeItem(ctx context.Context, put *types.Put, writes []types.TransactWriteItem) error {
+	if len(writes) == 0 {
+		_, err := t.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                           put.TableName,
+			Item:                                put.Item,
+			ConditionExpression:                 put.ConditionExpression,
+			ExpressionAttributeNames:            put.ExpressionAttributeNames,
+			ExpressionAttributeValues:           put.ExpressionAttributeValues,
+			ReturnValuesOnConditionCheckFailure: put.ReturnValuesOnConditionCheckFailure,
+		})
+		return err
+	}
+	return transactWrite(ctx, t.client, append(writes[:len(writes):len(writes)], types.TransactWriteItem{Put: put}))
+}
+
+// payloadBytes returns the stored payload of an item, reassembling it from chunks or the blob store if needed.
+func (t *itemTable) payloadBytes(ctx context.Context, item map[string]types.AttributeValue) ([]byte, error) {
+	if data, ok := item[attrPayload].(*types.AttributeValueMemberB); ok {
+		return data.Value, nil
+	}
+	if ref, ok := item[attrPayloadRef].(*types.AttributeValueMemberM); ok {
+		return t.resolvePayloadRef(ctx, ref)
+	}
+	if chunks, ok := item[attrChunks].(*types.AttributeValueMemberN); ok {
+		return t.readChunks(ctx, item, chunks)
+	}
+	return nil, fmt.Errorf("payload is not a binary type")
+}
@@ -0,0 +1,87 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	DefaultPersistenceIDTable = "persistence_ids"
+
+	persistenceIDsPageSize = 100
+)
+
+// persistenceIDRegistry keeps one item per actor with a journal, so that actors can be listed without scanning the journal.
+// The items of a journal share one partition, sorted by actor name.
+type persistenceIDRegistry struct {
+	table string
+	// registered caches the actors this process has already registered, so an actor costs one write per process
+	registered sync.Map
+}
+
+func (r *persistenceIDRegistry) register(ctx context.Context, client *dynamodb.Client, journal string, actorName string) error {
+	if _, ok := r.registered.Load(actorName); ok {
+		return nil
+	}
+	_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.table),
+		Item: map[string]types.AttributeValue{
+			"journal":   &types.AttributeValueMemberS{Value: journal},
+			"actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("register persistence id: %w", err)
+	}
+	r.registered.Store(actorName, true)
+	return nil
+}
+
+// PersistenceIDsPage is a page of PersistenceIDs.
+// NextID continues with the next page, and is empty after the last page.
+type PersistenceIDsPage struct {
+	IDs    []string
+	NextID string
+}
+
+// PersistenceIDs returns the next page of actors that have written events, in the order of their names, after afterID.
+// An empty afterID starts from the first actor.
+func (e *EventStore) PersistenceIDs(ctx context.Context, afterID string) (*PersistenceIDsPage, error) {
+	if e.options.persistenceIDs == nil {
+		return nil, errors.New("persistence id registry is not enabled")
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(e.options.persistenceIDs.table),
+		KeyConditionExpression: aws.String("journal = :journal"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":journal": &types.AttributeValueMemberS{Value: e.table},
+		},
+		Limit: aws.Int32(persistenceIDsPageSize),
+	}
+	if afterID != "" {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"journal":   &types.AttributeValueMemberS{Value: e.table},
+			"actorName": &types.AttributeValueMemberS{Value: afterID},
+		}
+	}
+	resp, err := e.client.Query(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &PersistenceIDsPage{}
+	for _, item := range resp.Items {
+		page.IDs = append(page.IDs, item["actorName"].(*types.AttributeValueMemberS).Value)
+	}
+	if last, ok := resp.LastEvaluatedKey["actorName"].(*types.AttributeValueMemberS); ok {
+		page.NextID = last.Value
+	}
+	return page, nil
+}
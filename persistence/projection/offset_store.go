@@ -0,0 +1,118 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const DefaultOffsetTable = "projection_offsets"
+
+// OffsetStore keeps the committed offset of each projection in a table with a "projectionName" hash key.
+type OffsetStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func NewOffsetStore(client *dynamodb.Client, table string) *OffsetStore {
+	return &OffsetStore{client: client, table: table}
+}
+
+// Load returns the committed offset of the projection named name, and false if it has none.
+func (s *OffsetStore) Load(ctx context.Context, name string) (string, bool, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.key(name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	offset, ok := out.Item["offset"].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", false, nil
+	}
+	return offset.Value, true, nil
+}
+
+// Save commits offset for the projection named name.
+func (s *OffsetStore) Save(ctx context.Context, name string, offset string) error {
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      s.item(name, offset),
+	})
+	return err
+}
+
+// Reset moves the projection named name to offset, so that it continues after offset on its next run.
+// An empty offset removes the committed offset, so that the projection starts from the first event.
+func (s *OffsetStore) Reset(ctx context.Context, name string, offset string) error {
+	if offset != "" {
+		return s.Save(ctx, name, offset)
+	}
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       s.key(name),
+	})
+	return err
+}
+
+// saveItem commits offset in a transaction, only if the committed offset is still previous,
+// so that a runner whose offset was reset or moved by another runner does not overwrite it.
+func (s *OffsetStore) saveItem(name string, previous string, hasPrevious bool, offset string) types.TransactWriteItem {
+	put := &types.Put{
+		TableName:           aws.String(s.table),
+		Item:                s.item(name, offset),
+		ConditionExpression: aws.String("attribute_not_exists(projectionName)"),
+	}
+	if hasPrevious {
+		put.ConditionExpression = aws.String("#offset = :previous")
+		put.ExpressionAttributeNames = map[string]string{"#offset": "offset"}
+		put.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":previous": &types.AttributeValueMemberS{Value: previous},
+		}
+	}
+	return types.TransactWriteItem{Put: put}
+}
+
+func (s *OffsetStore) key(name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"projectionName": &types.AttributeValueMemberS{Value: name},
+	}
+}
+
+func (s *OffsetStore) item(name string, offset string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"projectionName": &types.AttributeValueMemberS{Value: name},
+		"offset":         &types.AttributeValueMemberS{Value: offset},
+		"updatedAt":      &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+	}
+}
+
+// CreateOffsetTable creates the offset table if it does not exist.
+func CreateOffsetTable(ctx context.Context, client *dynamodb.Client, table string) error {
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("projectionName"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("projectionName"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	var inUseErr *types.ResourceInUseException
+	if errors.As(err, &inUseErr) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	return waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}, 5*time.Minute)
+}
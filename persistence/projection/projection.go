@@ -0,0 +1,195 @@
+// Package projection builds read models from the journal by running handlers over a Source of events
+// and committing how far they got in an OffsetStore.
+package projection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	defaultPollInterval = time.Second
+	// maxTransactItems is the item limit of TransactWriteItems.
+	maxTransactItems = 100
+)
+
+// ErrOffsetConflict is returned by an exactly-once projection when its committed offset was changed by someone else,
+// e.g. by Reset or another runner of the same projection.
+var ErrOffsetConflict = errors.New("projection offset was changed concurrently")
+
+// Handler handles an event of an at-least-once projection.
+// An event may be handled again after a restart, so the handler should be idempotent.
+type Handler func(ctx context.Context, envelope Envelope) error
+
+// TransactionalHandler returns the writes of the read model for an event of an exactly-once projection.
+// They are committed in one transaction together with the offset.
+type TransactionalHandler func(ctx context.Context, envelope Envelope) ([]types.TransactWriteItem, error)
+
+// Projection runs a handler over the events of a source and resumes from its committed offset when it is run again.
+type Projection struct {
+	name      string
+	source    Source
+	offsets   *OffsetStore
+	handler   Handler
+	txHandler TransactionalHandler
+	// PollInterval is how long to wait after a fetch without new events.
+	PollInterval time.Duration
+}
+
+// NewAtLeastOnce creates a projection that commits its offset after each batch of handled events.
+func NewAtLeastOnce(name string, source Source, offsets *OffsetStore, handler Handler) *Projection {
+	return &Projection{
+		name:         name,
+		source:       source,
+		offsets:      offsets,
+		handler:      handler,
+		PollInterval: defaultPollInterval,
+	}
+}
+
+// NewExactlyOnce creates a projection that commits the writes of handler and its offset in one transaction per offset,
+// so that no event is applied to the read model twice. The read model must be in DynamoDB, in the region of the offset table.
+func NewExactlyOnce(name string, source Source, offsets *OffsetStore, handler TransactionalHandler) *Projection {
+	return &Projection{
+		name:         name,
+		source:       source,
+		offsets:      offsets,
+		txHandler:    handler,
+		PollInterval: defaultPollInterval,
+	}
+}
+
+func (p *Projection) Name() string {
+	return p.name
+}
+
+// Offset returns the committed offset, and false if the projection has not committed one yet.
+func (p *Projection) Offset(ctx context.Context) (string, bool, error) {
+	return p.offsets.Load(ctx, p.name)
+}
+
+// Reset moves the committed offset, so that the next Run continues after offset.
+// An empty offset rebuilds the read model from the first event. Reset the projection while it is not running.
+func (p *Projection) Reset(ctx context.Context, offset string) error {
+	return p.offsets.Reset(ctx, p.name, offset)
+}
+
+// Run handles events from the committed offset until ctx is done or an error occurs.
+func (p *Projection) Run(ctx context.Context) error {
+	offset, committed, err := p.offsets.Load(ctx, p.name)
+	if err != nil {
+		return err
+	}
+
+	for {
+		envelopes, next, err := p.source.Fetch(ctx, offset)
+		if err != nil {
+			return err
+		}
+		if len(envelopes) == 0 && next == offset {
+			if err := sleep(ctx, p.PollInterval); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if p.txHandler != nil {
+			for _, group := range groupByOffset(envelopes) {
+				if err := p.commit(ctx, group, offset, committed, group[0].Offset); err != nil {
+					return err
+				}
+				offset, committed = group[0].Offset, true
+			}
+			// sourceが飛ばしたeventの分もoffsetを進める
+			if next != offset {
+				if err := p.commit(ctx, nil, offset, committed, next); err != nil {
+					return err
+				}
+				offset, committed = next, true
+			}
+			continue
+		}
+
+		reached := offset
+		var handleErr error
+	groups:
+		for _, group := range groupByOffset(envelopes) {
+			for _, envelope := range group {
+				if handleErr = p.handler(ctx, envelope); handleErr != nil {
+					break groups
+				}
+			}
+			reached = group[0].Offset
+		}
+		if handleErr == nil {
+			reached = next
+		}
+		// 失敗したeventの手前までは処理済みとして記録する
+		if reached != offset {
+			if err := p.offsets.Save(ctx, p.name, reached); err != nil {
+				return err
+			}
+			offset, committed = reached, true
+		}
+		if handleErr != nil {
+			return fmt.Errorf("projection %s: %w", p.name, handleErr)
+		}
+	}
+}
+
+// commit writes the read model for the events of one offset and moves the offset from previous to offset in one transaction.
+// Without events, it only moves the offset.
+func (p *Projection) commit(ctx context.Context, group []Envelope, previous string, hasPrevious bool, offset string) error {
+	var items []types.TransactWriteItem
+	for _, envelope := range group {
+		writes, err := p.txHandler(ctx, envelope)
+		if err != nil {
+			return fmt.Errorf("projection %s: %w", p.name, err)
+		}
+		items = append(items, writes...)
+	}
+	items = append(items, p.offsets.saveItem(p.name, previous, hasPrevious, offset))
+	if len(items) > maxTransactItems {
+		return fmt.Errorf("projection %s: %d writes for offset %s exceed the transaction limit", p.name, len(items)-1, offset)
+	}
+
+	_, err := p.offsets.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		// offsetの条件は最後のitemなので、その理由を見る
+		reasons := canceled.CancellationReasons
+		if len(reasons) == len(items) && aws.ToString(reasons[len(reasons)-1].Code) == "ConditionalCheckFailed" {
+			return ErrOffsetConflict
+		}
+	}
+	return err
+}
+
+// groupByOffset splits envelopes into runs of the same offset, which are committed together.
+func groupByOffset(envelopes []Envelope) [][]Envelope {
+	var groups [][]Envelope
+	for i, envelope := range envelopes {
+		if i == 0 || envelope.Offset != envelopes[i-1].Offset {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], envelope)
+	}
+	return groups
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,283 @@
+package projection_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence/projection"
+)
+
+const balanceTable = "projection_test_balances"
+
+// run runs projection in the background until the returned stop is called, which returns the error of Run.
+func run(projection *projection.Projection) (stop func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- projection.Run(ctx)
+	}()
+	return func() error {
+		cancel()
+		return <-done
+	}
+}
+
+// receive waits for n events from c.
+func receive(t *testing.T, c <-chan string, n int) []string {
+	var data []string
+	for len(data) < n {
+		select {
+		case d := <-c:
+			data = append(data, d)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v, want %d events", data, n)
+		}
+	}
+	return data
+}
+
+func TestProjection_AtLeastOnce(t *testing.T) {
+	ctx := context.Background()
+	client := p.InitializeDynamoDBClient()
+	require.NoError(t, p.CreateTables(ctx, client))
+	require.NoError(t, projection.CreateOffsetTable(ctx, client, projection.DefaultOffsetTable))
+
+	actorName := "testProjectionActor"
+	provider := p.NewProviderState(client)
+	provider.PersistEvent(actorName, 0, &p.Event{Data: "event1"})
+	provider.PersistEvent(actorName, 1, &p.Event{Data: "event2"})
+	provider.PersistEvent(actorName, 2, &p.Event{Data: "event3"})
+
+	store := p.NewEventStore(client, p.DefaultJournalTable)
+	offsets := projection.NewOffsetStore(client, projection.DefaultOffsetTable)
+	received := make(chan string, 10)
+	newProjection := func() *projection.Projection {
+		pr := projection.NewAtLeastOnce("testAtLeastOnce", projection.EventsByPersistenceID(store, actorName), offsets,
+			func(_ context.Context, envelope projection.Envelope) error {
+				received <- envelope.Event.(*p.Event).Data
+				return nil
+			})
+		pr.PollInterval = 10 * time.Millisecond
+		return pr
+	}
+	pr := newProjection()
+	require.NoError(t, pr.Reset(ctx, ""))
+
+	stop := run(pr)
+	assert.Equal(t, []string{"event1", "event2", "event3"}, receive(t, received, 3))
+	assert.ErrorIs(t, stop(), context.Canceled)
+
+	offset, ok, err := pr.Offset(ctx)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "2", offset)
+
+	// 再起動すると続きから処理する
+	provider.PersistEvent(actorName, 3, &p.Event{Data: "event4"})
+	stop = run(newProjection())
+	assert.Equal(t, []string{"event4"}, receive(t, received, 1))
+	assert.ErrorIs(t, stop(), context.Canceled)
+
+	// 指定したoffsetの次からやり直す
+	require.NoError(t, pr.Reset(ctx, "1"))
+	stop = run(newProjection())
+	assert.Equal(t, []string{"event3", "event4"}, receive(t, received, 2))
+	assert.ErrorIs(t, stop(), context.Canceled)
+
+	t.Run("handler error", func(t *testing.T) {
+		require.NoError(t, pr.Reset(ctx, ""))
+		failing := projection.NewAtLeastOnce("testAtLeastOnce", projection.EventsByPersistenceID(store, actorName), offsets,
+			func(_ context.Context, envelope projection.Envelope) error {
+				if envelope.EventIndex == 2 {
+					return errors.New("read model is down")
+				}
+				return nil
+			})
+		err := failing.Run(ctx)
+		assert.ErrorContains(t, err, "read model is down")
+
+		// 失敗したeventの手前までcommitされる
+		offset, _, err := pr.Offset(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "1", offset)
+	})
+
+	t.Run("empty page", func(t *testing.T) {
+		// eventを返さずにoffsetだけ進めるsourceでも、offsetはcommitされる
+		require.NoError(t, pr.Reset(ctx, "3"))
+		skipping := projection.NewAtLeastOnce("testAtLeastOnce", skippingSource("3", "7"), offsets,
+			func(_ context.Context, envelope projection.Envelope) error {
+				received <- envelope.Event.(*p.Event).Data
+				return nil
+			})
+		skipping.PollInterval = 10 * time.Millisecond
+		stop := run(skipping)
+		require.Eventually(t, func() bool {
+			offset, _, err := pr.Offset(ctx)
+			require.NoError(t, err)
+			return offset == "7"
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.ErrorIs(t, stop(), context.Canceled)
+		assert.Empty(t, received)
+	})
+
+	// クリーンアップ
+	require.NoError(t, pr.Reset(ctx, ""))
+	deleteActorItems(t, client, actorName)
+}
+
+func TestProjection_ExactlyOnce(t *testing.T) {
+	ctx := context.Background()
+	client := p.InitializeDynamoDBClient()
+	require.NoError(t, p.CreateTables(ctx, client))
+	require.NoError(t, projection.CreateOffsetTable(ctx, client, projection.DefaultOffsetTable))
+	createBalanceTable(t, client)
+
+	actorName := "testExactlyOnceAccount"
+	provider := p.NewProviderState(client)
+	provider.PersistEvent(actorName, 0, &p.Event{Data: "100"})
+	provider.PersistEvent(actorName, 1, &p.Event{Data: "-30"})
+	provider.PersistEvent(actorName, 2, &p.Event{Data: "5"})
+
+	store := p.NewEventStore(client, p.DefaultJournalTable)
+	offsets := projection.NewOffsetStore(client, projection.DefaultOffsetTable)
+	// 残高をread modelに加算する
+	handler := func(_ context.Context, envelope projection.Envelope) ([]types.TransactWriteItem, error) {
+		return []types.TransactWriteItem{{
+			Update: &types.Update{
+				TableName:        aws.String(balanceTable),
+				Key:              map[string]types.AttributeValue{"account": &types.AttributeValueMemberS{Value: envelope.ActorName}},
+				UpdateExpression: aws.String("ADD balance :amount"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":amount": &types.AttributeValueMemberN{Value: envelope.Event.(*p.Event).Data},
+				},
+			},
+		}}, nil
+	}
+	pr := projection.NewExactlyOnce("testExactlyOnce", projection.EventsByPersistenceID(store, actorName), offsets, handler)
+	pr.PollInterval = 10 * time.Millisecond
+	require.NoError(t, pr.Reset(ctx, ""))
+
+	stop := run(pr)
+	require.Eventually(t, func() bool {
+		offset, _, err := pr.Offset(ctx)
+		require.NoError(t, err)
+		return offset == "2"
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.ErrorIs(t, stop(), context.Canceled)
+	assert.Equal(t, 75, balance(t, client, actorName))
+
+	// 再起動しても、commit済みのeventは二重に反映されない
+	provider.PersistEvent(actorName, 3, &p.Event{Data: "25"})
+	stop = run(pr)
+	require.Eventually(t, func() bool {
+		offset, _, err := pr.Offset(ctx)
+		require.NoError(t, err)
+		return offset == "3"
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.ErrorIs(t, stop(), context.Canceled)
+	assert.Equal(t, 100, balance(t, client, actorName))
+
+	t.Run("offset conflict", func(t *testing.T) {
+		// 読んでいる間に別のrunnerがoffsetを進める
+		source := projection.SourceFunc(func(ctx context.Context, offset string) ([]projection.Envelope, string, error) {
+			envelopes, next, err := projection.EventsByPersistenceID(store, actorName).Fetch(ctx, offset)
+			if err != nil {
+				return nil, "", err
+			}
+			return envelopes, next, offsets.Save(ctx, "testExactlyOnce", "1")
+		})
+		require.NoError(t, pr.Reset(ctx, "0"))
+		conflicting := projection.NewExactlyOnce("testExactlyOnce", source, offsets, handler)
+		assert.ErrorIs(t, conflicting.Run(ctx), projection.ErrOffsetConflict)
+		assert.Equal(t, 100, balance(t, client, actorName))
+	})
+
+	t.Run("empty page", func(t *testing.T) {
+		// eventを返さずにoffsetだけ進めるsourceでも、offsetはcommitされる
+		require.NoError(t, pr.Reset(ctx, "3"))
+		skipping := projection.NewExactlyOnce("testExactlyOnce", skippingSource("3", "7"), offsets, handler)
+		skipping.PollInterval = 10 * time.Millisecond
+		stop := run(skipping)
+		require.Eventually(t, func() bool {
+			offset, _, err := pr.Offset(ctx)
+			require.NoError(t, err)
+			return offset == "7"
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.ErrorIs(t, stop(), context.Canceled)
+		assert.Equal(t, 100, balance(t, client, actorName))
+	})
+
+	// クリーンアップ
+	require.NoError(t, pr.Reset(ctx, ""))
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(balanceTable),
+		Key:       map[string]types.AttributeValue{"account": &types.AttributeValueMemberS{Value: actorName}},
+	})
+	assert.NoError(t, err)
+	deleteActorItems(t, client, actorName)
+}
+
+// skippingSource moves from offset from to offset to without returning events, as a source does that skips deleted events.
+func skippingSource(from string, to string) projection.Source {
+	return projection.SourceFunc(func(_ context.Context, offset string) ([]projection.Envelope, string, error) {
+		if offset == from {
+			return nil, to, nil
+		}
+		return nil, offset, nil
+	})
+}
+
+func createBalanceTable(t *testing.T, client *dynamodb.Client) {
+	ctx := context.Background()
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(balanceTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("account"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("account"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	var inUseErr *types.ResourceInUseException
+	if !errors.As(err, &inUseErr) {
+		require.NoError(t, err)
+	}
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	require.NoError(t, waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(balanceTable)}, time.Minute))
+}
+
+func balance(t *testing.T, client *dynamodb.Client, account string) int {
+	out, err := client.GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName:      aws.String(balanceTable),
+		Key:            map[string]types.AttributeValue{"account": &types.AttributeValueMemberS{Value: account}},
+		ConsistentRead: aws.Bool(true),
+	})
+	require.NoError(t, err)
+	n, err := strconv.Atoi(out.Item["balance"].(*types.AttributeValueMemberN).Value)
+	require.NoError(t, err)
+	return n
+}
+
+func deleteActorItems(t *testing.T, client *dynamodb.Client, actorName string) {
+	for i := 0; i < 4; i++ {
+		_, err := client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(p.DefaultJournalTable),
+			Key: map[string]types.AttributeValue{
+				"actorName":  &types.AttributeValueMemberS{Value: actorName},
+				"eventIndex": &types.AttributeValueMemberN{Value: strconv.Itoa(i)},
+			},
+		})
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,110 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+const fetchSize = 100
+
+// Envelope is an event delivered to a projection with its offset in the source.
+// Events upcast from one stored event share their offset.
+type Envelope struct {
+	persistence.EventEnvelope
+	Offset string
+}
+
+// Source reads the events of a projection.
+// Fetch returns the next events after offset in order, and the offset to fetch the following events from.
+// The next offset can move past events the source skipped, e.g. deleted events, even when no events are returned,
+// and equals offset when there are no new events for now. An empty offset starts from the first event.
+type Source interface {
+	Fetch(ctx context.Context, offset string) ([]Envelope, string, error)
+}
+
+// SourceFunc adapts a function to a Source, e.g. for tests.
+type SourceFunc func(ctx context.Context, offset string) ([]Envelope, string, error)
+
+func (f SourceFunc) Fetch(ctx context.Context, offset string) ([]Envelope, string, error) {
+	return f(ctx, offset)
+}
+
+// errPageFull stops ReadEvents after a page of events.
+var errPageFull = errors.New("page full")
+
+// EventsByPersistenceID reads the events of one actor. The offset is the event index.
+func EventsByPersistenceID(store *persistence.EventStore, actorName string) Source {
+	return SourceFunc(func(ctx context.Context, offset string) ([]Envelope, string, error) {
+		start := 0
+		if offset != "" {
+			index, err := strconv.Atoi(offset)
+			if err != nil {
+				return nil, "", err
+			}
+			start = index + 1
+		}
+
+		var envelopes []Envelope
+		err := store.ReadEvents(ctx, actorName, start, 0, func(envelope persistence.EventEnvelope) error {
+			// upcastされた同じindexのeventは同じpageに入れる
+			if len(envelopes) >= fetchSize && envelopes[len(envelopes)-1].EventIndex != envelope.EventIndex {
+				return errPageFull
+			}
+			envelopes = append(envelopes, Envelope{EventEnvelope: envelope, Offset: strconv.Itoa(envelope.EventIndex)})
+			return nil
+		})
+		if err != nil && !errors.Is(err, errPageFull) {
+			return nil, "", err
+		}
+		if len(envelopes) == 0 {
+			return nil, offset, nil
+		}
+		return envelopes, envelopes[len(envelopes)-1].Offset, nil
+	})
+}
+
+// EventsByTag reads the events tagged with tag through the tag table. It needs persistence.WithTagger.
+func EventsByTag(store *persistence.EventStore, tag string) Source {
+	return SourceFunc(func(ctx context.Context, offset string) ([]Envelope, string, error) {
+		page, err := store.EventsByTag(ctx, tag, offset)
+		if err != nil {
+			return nil, "", err
+		}
+		envelopes := make([]Envelope, 0, len(page.Events))
+		for _, event := range page.Events {
+			envelopes = append(envelopes, Envelope{EventEnvelope: event.EventEnvelope, Offset: event.Offset})
+		}
+		return envelopes, page.NextOffset, nil
+	})
+}
+
+// AllEvents reads the events of all actors in the order of the global sequence. It needs persistence.WithGlobalSequence.
+// The offset is the global sequence number. Events are read once they are older than the window of
+// persistence.WithGlobalSequenceWindow, so that an event with a lower number written late is not skipped.
+func AllEvents(store *persistence.EventStore) Source {
+	return SourceFunc(func(ctx context.Context, offset string) ([]Envelope, string, error) {
+		var seq int64
+		if offset != "" {
+			var err error
+			seq, err = strconv.ParseInt(offset, 10, 64)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		page, err := store.EventsSince(ctx, seq)
+		if err != nil {
+			return nil, "", err
+		}
+		envelopes := make([]Envelope, 0, len(page.Events))
+		for _, event := range page.Events {
+			envelopes = append(envelopes, Envelope{EventEnvelope: event.EventEnvelope, Offset: strconv.FormatInt(event.GlobalSeq, 10)})
+		}
+		if page.NextSeq == seq {
+			return envelopes, offset, nil
+		}
+		return envelopes, strconv.FormatInt(page.NextSeq, 10), nil
+	})
+}
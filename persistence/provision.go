@@ -0,0 +1,204 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	DefaultJournalTable  = "journal"
+	DefaultSnapshotTable = "snapshot"
+	DefaultKeyTable      = "keys"
+)
+
+// CreateTables creates the tables NewProviderState uses with the same opts.
+// Tables that already exist are left as they are.
+func CreateTables(ctx context.Context, client *dynamodb.Client, opts ...Option) error {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	journal := eventTableInput(DefaultJournalTable)
+	// StreamSubscriptionが読むstream
+	journal.StreamSpecification = &types.StreamSpecification{
+		StreamEnabled:  aws.Bool(true),
+		StreamViewType: types.StreamViewTypeNewImage,
+	}
+	if o.globalSequence != nil {
+		journal.AttributeDefinitions = append(journal.AttributeDefinitions,
+			types.AttributeDefinition{AttributeName: aws.String(attrGlobalSeqPartition), AttributeType: types.ScalarAttributeTypeS},
+			types.AttributeDefinition{AttributeName: aws.String(attrGlobalSeq), AttributeType: types.ScalarAttributeTypeN},
+		)
+		journal.GlobalSecondaryIndexes = append(journal.GlobalSecondaryIndexes, types.GlobalSecondaryIndex{
+			IndexName: aws.String(GlobalSeqIndex),
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String(attrGlobalSeqPartition), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String(attrGlobalSeq), KeyType: types.KeyTypeRange},
+			},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		})
+	}
+	inputs := []*dynamodb.CreateTableInput{
+		journal,
+		eventTableInput(DefaultSnapshotTable),
+		{
+			TableName: aws.String(DefaultStateTable),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("actorName"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("actorName"), KeyType: types.KeyTypeHash},
+			},
+		},
+	}
+	if o.keyStore != nil {
+		inputs = append(inputs, &dynamodb.CreateTableInput{
+			TableName: aws.String(o.keyStore.table),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("actorName"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("actorName"), KeyType: types.KeyTypeHash},
+			},
+		})
+	}
+	if o.compaction != nil {
+		if archiver, ok := o.compaction.archiver.(*TableArchiver); ok {
+			inputs = append(inputs, eventTableInput(archiver.table))
+		}
+	}
+	if o.actorMetadata != nil {
+		inputs = append(inputs, &dynamodb.CreateTableInput{
+			TableName: aws.String(o.actorMetadata.table),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("actorName"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("actorName"), KeyType: types.KeyTypeHash},
+			},
+		})
+	}
+	if o.leases != nil {
+		inputs = append(inputs, &dynamodb.CreateTableInput{
+			TableName: aws.String(o.leases.table),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("actorName"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("actorName"), KeyType: types.KeyTypeHash},
+			},
+		})
+	}
+	if o.globalSequence != nil {
+		inputs = append(inputs, &dynamodb.CreateTableInput{
+			TableName: aws.String(o.globalSequence.table),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("name"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("name"), KeyType: types.KeyTypeHash},
+			},
+		})
+	}
+	if o.persistenceIDs != nil {
+		inputs = append(inputs, &dynamodb.CreateTableInput{
+			TableName: aws.String(o.persistenceIDs.table),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("journal"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("actorName"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("journal"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("actorName"), KeyType: types.KeyTypeRange},
+			},
+		})
+	}
+	if o.tagger != nil {
+		inputs = append(inputs, &dynamodb.CreateTableInput{
+			TableName: aws.String(tagTableName(DefaultJournalTable)),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String(attrTag), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String(attrTagOffset), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String(attrTag), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String(attrTagOffset), KeyType: types.KeyTypeRange},
+			},
+		})
+	}
+	if o.chunkTable != "" {
+		inputs = append(inputs, &dynamodb.CreateTableInput{
+			TableName: aws.String(o.chunkTable),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("chunkKey"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("chunkId"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("chunkKey"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("chunkId"), KeyType: types.KeyTypeRange},
+			},
+		})
+	}
+
+	for _, input := range inputs {
+		if err := createTableIfNotExists(ctx, client, input); err != nil {
+			return err
+		}
+	}
+
+	if o.ttl != nil {
+		tables := []string{DefaultJournalTable, DefaultSnapshotTable}
+		if o.chunkTable != "" {
+			tables = append(tables, o.chunkTable)
+		}
+		if o.actorMetadata != nil {
+			tables = append(tables, o.actorMetadata.table)
+		}
+		if o.tagger != nil {
+			tables = append(tables, tagTableName(DefaultJournalTable))
+		}
+		for _, table := range tables {
+			if err := enableTTL(ctx, client, table, o.ttl.attribute); err != nil {
+				return fmt.Errorf("enable TTL on %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// eventTableInput is the schema shared by the journal and snapshot tables.
+func eventTableInput(table string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("actorName"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("eventIndex"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("actorName"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("eventIndex"), KeyType: types.KeyTypeRange},
+		},
+	}
+}
+
+func createTableIfNotExists(ctx context.Context, client *dynamodb.Client, input *dynamodb.CreateTableInput) error {
+	input.BillingMode = types.BillingModePayPerRequest
+	_, err := client.CreateTable(ctx, input)
+	var inUseErr *types.ResourceInUseException
+	if errors.As(err, &inUseErr) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	return waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName}, 5*time.Minute)
+}
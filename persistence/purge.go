@@ -0,0 +1,268 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// batchWriteAttempts is how often a batch is written before items DynamoDB left unprocessed fail it.
+	batchWriteAttempts = 8
+	batchWriteBackoff  = 50 * time.Millisecond
+)
+
+// PurgeReport is what PurgeActor removed. Counts are of the items it found, so running PurgeActor again after it
+// was interrupted reports what was left.
+type PurgeReport struct {
+	ActorName      string
+	Events         int
+	Snapshots      int
+	Chunks         int
+	Blobs          int
+	ArchivedEvents int
+	Segments       int
+	Metadata       bool
+	State          bool
+	PersistenceID  bool
+	DataKey        bool
+}
+
+// PurgeActor removes everything stored for actorName: its events and snapshots with their chunks and blobs,
+// archived events and segments, its actor metadata, its state in DefaultStateTable including the tombstone
+// of a deleted state, its persistence ID and its data key, depending on the options.
+// Items are found by key queries and deleted in batches, so it is cheap for one actor in a large table.
+// It is idempotent, and running it again resumes a purge that failed. The lease of the actor is kept,
+// because its epoch fences off writers that still think they own the actor.
+func (p *ProviderState) PurgeActor(ctx context.Context, actorName string) (*PurgeReport, error) {
+	report := &PurgeReport{ActorName: actorName}
+	var err error
+	tagTable := ""
+	if p.eventStore.options.tagger != nil {
+		tagTable = p.eventStore.tagTable()
+	}
+	if report.Events, report.Blobs, err = p.eventStore.purgeItems(ctx, actorName, tagTable); err != nil {
+		return report, err
+	}
+	snapshots, blobs, err := p.snapshotStore.purgeItems(ctx, actorName, "")
+	report.Snapshots, report.Blobs = snapshots, report.Blobs+blobs
+	if err != nil {
+		return report, err
+	}
+	tables := []*itemTable{&p.eventStore.itemTable, &p.snapshotStore.itemTable}
+	if p.snapshotStore.cache != nil {
+		p.snapshotStore.cache.invalidate(actorName, math.MaxInt)
+	}
+	for _, t := range tables {
+		chunks, err := t.purgeChunks(ctx, actorName)
+		report.Chunks += chunks
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if c := p.options.compaction; c != nil {
+		if archiver, ok := c.archiver.(*TableArchiver); ok {
+			// archiveのitemもjournalのchunkとblobを参照しているので、同じ方法で消す。tagの行はarchive時に消えている
+			archive := &itemTable{client: archiver.client, table: archiver.table, options: p.eventStore.options}
+			archived, blobs, err := archive.purgeItems(ctx, actorName, "")
+			report.ArchivedEvents, report.Blobs = archived, report.Blobs+blobs
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+	for _, archiver := range p.segmentArchivers() {
+		segments, err := archiver.purge(ctx, actorName)
+		report.Segments += segments
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if m := p.options.actorMetadata; m != nil {
+		if report.Metadata, err = deleteItem(ctx, p.eventStore.client, m.table, map[string]types.AttributeValue{
+			"actorName": &types.AttributeValueMemberS{Value: actorName},
+		}); err != nil {
+			return report, err
+		}
+	}
+	// CreateTablesは状態の表を常に作るので、StateStoreを使わないactorでも消しに行ける
+	if report.State, err = deleteItem(ctx, p.eventStore.client, DefaultStateTable, stateKey(actorName)); err != nil {
+		return report, err
+	}
+	if r := p.eventStore.options.persistenceIDs; r != nil {
+		if report.PersistenceID, err = deleteItem(ctx, p.eventStore.client, r.table, map[string]types.AttributeValue{
+			"journal":   &types.AttributeValueMemberS{Value: p.eventStore.table},
+			"actorName": &types.AttributeValueMemberS{Value: actorName},
+		}); err != nil {
+			return report, err
+		}
+		r.registered.Delete(actorName)
+	}
+	// 鍵は最後に消す。途中で失敗しても、残ったitemは読めるまま消し直せる
+	if k := p.options.keyStore; k != nil {
+		if report.DataKey, err = k.forget(ctx, actorName); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// segmentArchivers returns the distinct segment archivers the journal is compacted to or replayed from.
+func (p *ProviderState) segmentArchivers() []*SegmentArchiver {
+	var archivers []*SegmentArchiver
+	if c := p.options.compaction; c != nil {
+		if archiver, ok := c.archiver.(*SegmentArchiver); ok {
+			archivers = append(archivers, archiver)
+		}
+	}
+	if archiver := p.options.archiveReplay; archiver != nil && (len(archivers) == 0 || archivers[0] != archiver) {
+		archivers = append(archivers, archiver)
+	}
+	return archivers
+}
+
+// purgeItems deletes the items of actorName and the blobs of their payloads, and returns how many of each it found.
+// The blob of an item is deleted before the item, so that a failed purge leaves no blob without an item that refers to it.
+// With a tagTable, the rows of the tag table for the items are deleted after them.
+func (t *itemTable) purgeItems(ctx context.Context, actorName string, tagTable string) (int, int, error) {
+	paginator := dynamodb.NewQueryPaginator(t.client, &dynamodb.QueryInput{
+		TableName:              aws.String(t.table),
+		KeyConditionExpression: aws.String("actorName = :actorName"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+		ProjectionExpression: aws.String(strings.Join([]string{"actorName", "eventIndex", attrPayloadRef, attrTags, attrWrittenAt}, ", ")),
+	})
+
+	items, blobs := 0, 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return items, blobs, err
+		}
+		requests := make([]types.WriteRequest, 0, len(page.Items))
+		for _, item := range page.Items {
+			if ref, ok := item[attrPayloadRef].(*types.AttributeValueMemberM); ok && t.options.blobStore != nil {
+				if key, ok := ref.Value["key"].(*types.AttributeValueMemberS); ok {
+					if err := t.options.blobStore.DeleteObject(ctx, key.Value); err != nil {
+						return items, blobs, fmt.Errorf("delete blob %s: %w", key.Value, err)
+					}
+					blobs++
+				}
+			}
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{
+				"actorName":  item["actorName"],
+				"eventIndex": item["eventIndex"],
+			}}})
+		}
+		if err := batchWrite(ctx, t.client, t.table, requests); err != nil {
+			return items, blobs, fmt.Errorf("purge %s of %s: %w", t.table, actorName, err)
+		}
+		if tagTable != "" {
+			if err := deleteTagRows(ctx, t.client, tagTable, page.Items); err != nil {
+				return items, blobs, err
+			}
+		}
+		items += len(page.Items)
+	}
+	return items, blobs, nil
+}
+
+// purgeChunks deletes all chunks of the items of actorName, which share one partition of the chunk table.
+func (t *itemTable) purgeChunks(ctx context.Context, actorName string) (int, error) {
+	if t.options.chunkTable == "" {
+		return 0, nil
+	}
+	paginator := dynamodb.NewQueryPaginator(t.client, &dynamodb.QueryInput{
+		TableName:              aws.String(t.options.chunkTable),
+		KeyConditionExpression: aws.String("chunkKey = :chunkKey"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":chunkKey": &types.AttributeValueMemberS{Value: t.chunkKey(map[string]types.AttributeValue{
+				"actorName": &types.AttributeValueMemberS{Value: actorName},
+			})},
+		},
+		ProjectionExpression: aws.String("chunkKey, chunkId"),
+	})
+
+	chunks := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return chunks, err
+		}
+		requests := make([]types.WriteRequest, 0, len(page.Items))
+		for _, item := range page.Items {
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: item}})
+		}
+		if err := batchWrite(ctx, t.client, t.options.chunkTable, requests); err != nil {
+			return chunks, fmt.Errorf("purge chunks of %s: %w", actorName, err)
+		}
+		chunks += len(page.Items)
+	}
+	return chunks, nil
+}
+
+// purge deletes the segments of actorName and returns how many it found.
+func (a *SegmentArchiver) purge(ctx context.Context, actorName string) (int, error) {
+	segments, err := a.Segments(ctx, actorName)
+	if err != nil {
+		return 0, err
+	}
+	for i, segment := range segments {
+		if err := a.storage.DeleteObject(ctx, segment.Key); err != nil {
+			return i, fmt.Errorf("delete segment %s: %w", segment.Key, err)
+		}
+	}
+	return len(segments), nil
+}
+
+// batchWrite writes requests to table with BatchWriteItem in batches of its item limit.
+// Items DynamoDB leaves unprocessed, e.g. when the table is throttled, are written again with exponential backoff.
+func batchWrite(ctx context.Context, client *dynamodb.Client, table string, requests []types.WriteRequest) error {
+	for start := 0; start < len(requests); start += batchWriteSize {
+		batch := requests[start:min(start+batchWriteSize, len(requests))]
+		backoff := batchWriteBackoff
+		for attempt := 1; len(batch) > 0; attempt++ {
+			if attempt > batchWriteAttempts {
+				return fmt.Errorf("%d items left unprocessed after %d attempts", len(batch), batchWriteAttempts)
+			}
+			if attempt > 1 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+			}
+			out, err := client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{table: batch},
+			})
+			if err != nil {
+				return err
+			}
+			batch = out.UnprocessedItems[table]
+		}
+	}
+	return nil
+}
+
+// deleteItem deletes the item at key and reports whether it existed.
+func deleteItem(ctx context.Context, client *dynamodb.Client, table string, key map[string]types.AttributeValue) (bool, error) {
+	out, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:    aws.String(table),
+		Key:          key,
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return false, fmt.Errorf("delete from %s: %w", table, err)
+	}
+	return len(out.Attributes) > 0, nil
+}
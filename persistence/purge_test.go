@@ -0,0 +1,98 @@
+package persistence_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+func TestProviderState_PurgeActor(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	keyProvider, err := p.NewStaticKeyProvider("test-key", make([]byte, 32))
+	require.NoError(t, err)
+	opts := []p.Option{
+		p.WithEncryption(p.NewKeyStore(client, p.DefaultKeyTable, keyProvider)),
+		p.WithChunking(p.DefaultChunkTable, 16*1024),
+		p.WithBlobStore(p.NewFileBlobStore(t.TempDir()), 100*1024),
+		p.WithActorMetadata(p.DefaultActorMetadataTable),
+		p.WithPersistenceIDs(p.DefaultPersistenceIDTable),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	actorName := "testPurgeActor"
+	provider.PersistEvent(actorName, 0, &p.Event{Data: "event1"})
+	// chunkに分けられるevent
+	provider.PersistEvent(actorName, 1, &p.Event{Data: strings.Repeat("x", 40*1024)})
+	provider.PersistEvent(actorName, 2, &p.Event{Data: "event3"})
+	// blob storeに置かれるsnapshot
+	provider.PersistSnapshot(actorName, 2, largeSnapshot())
+	// 削除されたstateのtombstoneも消す
+	stateStore := p.NewStateStore(client, p.DefaultStateTable, opts...)
+	deleteState(t, client, actorName)
+	revision, err := stateStore.Upsert(ctx, actorName, 0, &p.Snapshot{Data: "state"})
+	require.NoError(t, err)
+	_, err = stateStore.Delete(ctx, actorName, revision)
+	require.NoError(t, err)
+
+	report, err := provider.PurgeActor(ctx, actorName)
+	require.NoError(t, err)
+	assert.Equal(t, &p.PurgeReport{
+		ActorName:     actorName,
+		Events:        3,
+		Snapshots:     1,
+		Chunks:        3,
+		Blobs:         1,
+		Metadata:      true,
+		State:         true,
+		PersistenceID: true,
+		DataKey:       true,
+	}, report)
+
+	var data []string
+	provider.GetEvents(actorName, 0, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Empty(t, data)
+	_, _, ok := provider.GetSnapshot(actorName)
+	assert.False(t, ok)
+	_, ok, err = provider.ActorMetadata(ctx, actorName)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	_, revision, err = stateStore.Get(ctx, actorName)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), revision)
+	chunks, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(p.DefaultChunkTable),
+		KeyConditionExpression: aws.String("chunkKey = :chunkKey"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":chunkKey": &types.AttributeValueMemberS{Value: p.DefaultJournalTable + "#" + actorName},
+		},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, chunks.Items)
+
+	// 2回目は何も残っていない
+	report, err = provider.PurgeActor(ctx, actorName)
+	require.NoError(t, err)
+	assert.Equal(t, &p.PurgeReport{ActorName: actorName}, report)
+
+	// purgeした後も、同じ名前のactorは初めから書ける
+	provider.PersistEvent(actorName, 0, &p.Event{Data: "event1"})
+	ids, err := p.NewEventStore(client, p.DefaultJournalTable, opts...).PersistenceIDs(ctx, "")
+	require.NoError(t, err)
+	assert.Contains(t, ids.IDs, actorName)
+
+	// クリーンアップ
+	_, err = provider.PurgeActor(ctx, actorName)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,52 @@
+// Package query reads the journal and snapshots written by the persistence provider,
+// for tools and projections that are not the persistent actors themselves.
+package query
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+// ReadJournal reads the default journal and snapshot tables.
+type ReadJournal struct {
+	events    *persistence.EventStore
+	snapshots *persistence.SnapshotStore
+}
+
+// NewReadJournal takes the options the ProviderState was created with, so that payloads are decoded the same way.
+// CurrentPersistenceIDs needs persistence.WithPersistenceIDs.
+func NewReadJournal(client *dynamodb.Client, opts ...persistence.Option) *ReadJournal {
+	return &ReadJournal{
+		events:    persistence.NewEventStore(client, persistence.DefaultJournalTable, opts...),
+		snapshots: persistence.NewSnapshotStore(client, persistence.DefaultSnapshotTable, opts...),
+	}
+}
+
+// CurrentPersistenceIDs returns the next page of actors with a journal after afterID.
+// An empty afterID starts from the first actor, and an empty NextID means the last page.
+func (r *ReadJournal) CurrentPersistenceIDs(ctx context.Context, afterID string) (*persistence.PersistenceIDsPage, error) {
+	return r.events.PersistenceIDs(ctx, afterID)
+}
+
+// CurrentEventsByPersistenceID streams the events of persistenceID from fromIndex to toIndex that exist now.
+// A toIndex of 0 reads to the last event.
+func (r *ReadJournal) CurrentEventsByPersistenceID(ctx context.Context, persistenceID string, fromIndex int, toIndex int) *Stream[persistence.EventEnvelope] {
+	return newStream(ctx, func(emit func(persistence.EventEnvelope) error) error {
+		return r.events.ReadEvents(ctx, persistenceID, fromIndex, toIndex, emit)
+	})
+}
+
+// CurrentSnapshotsByPersistenceID streams the snapshots of persistenceID that exist now, in the order of their event index.
+func (r *ReadJournal) CurrentSnapshotsByPersistenceID(ctx context.Context, persistenceID string) *Stream[persistence.SnapshotEnvelope] {
+	return newStream(ctx, func(emit func(persistence.SnapshotEnvelope) error) error {
+		return r.snapshots.ReadSnapshots(ctx, persistenceID, emit)
+	})
+}
+
+// ActorMetadata returns the highest event index, the index events are deleted to and the last snapshot index of persistenceID
+// without reading its journal. It needs persistence.WithActorMetadata.
+func (r *ReadJournal) ActorMetadata(ctx context.Context, persistenceID string) (persistence.ActorMetadata, bool, error) {
+	return r.events.ActorMetadata(ctx, persistenceID)
+}
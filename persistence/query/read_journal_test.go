@@ -0,0 +1,114 @@
+package query_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence/query"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestReadJournal(t *testing.T) {
+	ctx := context.Background()
+	client := p.InitializeDynamoDBClient()
+
+	opts := []p.Option{p.WithPersistenceIDs(p.DefaultPersistenceIDTable)}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	provider.PersistEvent("testQueryActor-1", 0, &p.Event{Data: "event1"})
+	provider.PersistEvent("testQueryActor-1", 1, &p.Event{Data: "event2"})
+	provider.PersistEvent("testQueryActor-1", 2, &p.Event{Data: "event3"})
+	provider.PersistEvent("testQueryActor-2", 0, &p.Event{Data: "event1"})
+	provider.PersistSnapshot("testQueryActor-1", 1, &p.Snapshot{Data: "snapshot1"})
+	provider.PersistSnapshot("testQueryActor-1", 2, &p.Snapshot{Data: "snapshot2"})
+
+	readJournal := query.NewReadJournal(client, opts...)
+
+	t.Run("persistence ids", func(t *testing.T) {
+		var ids []string
+		afterID := ""
+		for {
+			page, err := readJournal.CurrentPersistenceIDs(ctx, afterID)
+			require.NoError(t, err)
+			ids = append(ids, page.IDs...)
+			if page.NextID == "" {
+				break
+			}
+			afterID = page.NextID
+		}
+		assert.Contains(t, ids, "testQueryActor-1")
+		assert.Contains(t, ids, "testQueryActor-2")
+	})
+
+	t.Run("events", func(t *testing.T) {
+		stream := readJournal.CurrentEventsByPersistenceID(ctx, "testQueryActor-1", 1, 0)
+		var events []p.EventEnvelope
+		for envelope := range stream.C {
+			events = append(events, envelope)
+		}
+		require.NoError(t, stream.Err())
+		require.Len(t, events, 2)
+		assert.Equal(t, 1, events[0].EventIndex)
+		assert.True(t, proto.Equal(&p.Event{Data: "event2"}, events[0].Event.(*p.Event)))
+		assert.Equal(t, 2, events[1].EventIndex)
+	})
+
+	t.Run("snapshots", func(t *testing.T) {
+		stream := readJournal.CurrentSnapshotsByPersistenceID(ctx, "testQueryActor-1")
+		var snapshots []p.SnapshotEnvelope
+		for envelope := range stream.C {
+			snapshots = append(snapshots, envelope)
+		}
+		require.NoError(t, stream.Err())
+		require.Len(t, snapshots, 2)
+		assert.Equal(t, 1, snapshots[0].EventIndex)
+		assert.True(t, proto.Equal(&p.Snapshot{Data: "snapshot2"}, snapshots[1].Snapshot.(*p.Snapshot)))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		stream := readJournal.CurrentEventsByPersistenceID(ctx, "testQueryActor-1", 0, 0)
+		<-stream.C
+		// 途中で読むのをやめる
+		cancel()
+		for range stream.C {
+		}
+		assert.ErrorIs(t, stream.Err(), context.Canceled)
+	})
+
+	// クリーンアップ
+	for _, table := range []string{p.DefaultJournalTable, p.DefaultSnapshotTable} {
+		for _, key := range []struct {
+			actorName  string
+			eventIndex string
+		}{
+			{"testQueryActor-1", "0"}, {"testQueryActor-1", "1"}, {"testQueryActor-1", "2"}, {"testQueryActor-2", "0"},
+		} {
+			_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(table),
+				Key: map[string]types.AttributeValue{
+					"actorName":  &types.AttributeValueMemberS{Value: key.actorName},
+					"eventIndex": &types.AttributeValueMemberN{Value: key.eventIndex},
+				},
+			})
+			assert.NoError(t, err)
+		}
+	}
+	for _, actorName := range []string{"testQueryActor-1", "testQueryActor-2"} {
+		_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(p.DefaultPersistenceIDTable),
+			Key: map[string]types.AttributeValue{
+				"journal":   &types.AttributeValueMemberS{Value: p.DefaultJournalTable},
+				"actorName": &types.AttributeValueMemberS{Value: actorName},
+			},
+		})
+		assert.NoError(t, err)
+	}
+}
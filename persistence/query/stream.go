@@ -0,0 +1,37 @@
+package query
+
+import "context"
+
+// Stream delivers items read in the background on C.
+// C is closed after the last item or at the first error, which Err returns after that.
+// Cancel the context to stop reading before the end.
+type Stream[T any] struct {
+	C <-chan T
+
+	err  error
+	done chan struct{}
+}
+
+// Err waits for C to be closed and returns the error that ended the stream, if any.
+func (s *Stream[T]) Err() error {
+	<-s.done
+	return s.err
+}
+
+func newStream[T any](ctx context.Context, read func(emit func(T) error) error) *Stream[T] {
+	c := make(chan T)
+	s := &Stream[T]{C: c, done: make(chan struct{})}
+	go func() {
+		s.err = read(func(item T) error {
+			select {
+			case c <- item:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		close(c)
+		close(s.done)
+	}()
+	return s
+}
@@ -0,0 +1,372 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	segmentFormat  = "journal-segment"
+	segmentVersion = 1
+	segmentSuffix  = ".seg"
+)
+
+// SegmentStorage keeps archived journal segments. Like BlobStore it follows the object API of S3,
+// with the listing of keys by prefix. FileBlobStore implements it on the local filesystem.
+type SegmentStorage interface {
+	BlobStore
+	ListObjects(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Segment is a range of the journal of an actor archived by SegmentArchiver.
+type Segment struct {
+	Key        string
+	ActorName  string
+	FromIndex  int
+	ToIndex    int
+	ArchivedAt time.Time
+	// Items are the journal items as they were stored, with their metadata and payload attributes.
+	Items []map[string]types.AttributeValue
+}
+
+// segmentHeader is the first line of a segment file. The body after it is compressed with the codec,
+// and the checksum is taken over the compressed body.
+type segmentHeader struct {
+	Format   string `json:"format"`
+	Version  int    `json:"version"`
+	Codec    string `json:"codec"`
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+type segmentBody struct {
+	ActorName  string                   `json:"actorName"`
+	FromIndex  int                      `json:"fromIndex"`
+	ToIndex    int                      `json:"toIndex"`
+	ArchivedAt time.Time                `json:"archivedAt"`
+	Items      []map[string]interface{} `json:"items"`
+}
+
+// SegmentArchiver is an Archiver that writes the items of each compaction batch to one segment file,
+// compressed with codec and checksummed. Items are kept in the DynamoDB JSON format, so segments can be read
+// without this package, and they are replayed with WithArchiveReplay after the journal was compacted.
+//
+// Segments are keyed by actor and event range, e.g. segments/userAccountActor-1/00000000000000000000-00000000000000000099.seg.
+type SegmentArchiver struct {
+	storage SegmentStorage
+	codec   Codec
+	clock   func() time.Time
+}
+
+func NewSegmentArchiver(storage SegmentStorage, codec Codec) *SegmentArchiver {
+	return &SegmentArchiver{storage: storage, codec: codec, clock: time.Now}
+}
+
+func (a *SegmentArchiver) Archive(ctx context.Context, actorName string, items []map[string]types.AttributeValue) error {
+	if len(items) == 0 {
+		return nil
+	}
+	body := segmentBody{ActorName: actorName, FromIndex: -1, ArchivedAt: a.clock().UTC()}
+	for _, item := range items {
+		eventIndex, err := itemEventIndex(item)
+		if err != nil {
+			return err
+		}
+		if body.FromIndex < 0 || eventIndex < body.FromIndex {
+			body.FromIndex = eventIndex
+		}
+		body.ToIndex = max(body.ToIndex, eventIndex)
+		body.Items = append(body.Items, itemToJSON(item))
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	compressed, err := a.codec.Encode(encoded)
+	if err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(compressed)
+	header, err := json.Marshal(segmentHeader{
+		Format:   segmentFormat,
+		Version:  segmentVersion,
+		Codec:    a.codec.Name(),
+		Size:     len(compressed),
+		Checksum: hex.EncodeToString(checksum[:]),
+	})
+	if err != nil {
+		return err
+	}
+
+	file := make([]byte, 0, len(header)+1+len(compressed))
+	file = append(file, header...)
+	file = append(file, '\n')
+	file = append(file, compressed...)
+	key := segmentPrefix(actorName) + fmt.Sprintf("%020d-%020d", body.FromIndex, body.ToIndex) + segmentSuffix
+	if err := a.storage.PutObject(ctx, key, file); err != nil {
+		return fmt.Errorf("put segment %s: %w", key, err)
+	}
+	return nil
+}
+
+// Segments lists the segments of actorName in event index order, without reading them.
+// Only Key, ActorName, FromIndex and ToIndex are set; ReadSegment reads a segment.
+func (a *SegmentArchiver) Segments(ctx context.Context, actorName string) ([]Segment, error) {
+	prefix := segmentPrefix(actorName)
+	keys, err := a.storage.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []Segment
+	for _, key := range keys {
+		from, to, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(key, prefix), segmentSuffix), "-")
+		if !ok || !strings.HasSuffix(key, segmentSuffix) {
+			continue
+		}
+		segment := Segment{Key: key, ActorName: actorName}
+		if segment.FromIndex, err = strconv.Atoi(from); err != nil {
+			continue
+		}
+		if segment.ToIndex, err = strconv.Atoi(to); err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].FromIndex < segments[j].FromIndex
+	})
+	return segments, nil
+}
+
+// ReadSegment reads the segment at key and verifies its checksum.
+func (a *SegmentArchiver) ReadSegment(ctx context.Context, key string) (Segment, error) {
+	file, err := a.storage.GetObject(ctx, key)
+	if err != nil {
+		return Segment{}, err
+	}
+	line, compressed, ok := bytes.Cut(file, []byte{'\n'})
+	if !ok {
+		return Segment{}, fmt.Errorf("segment %s has no header", key)
+	}
+	var header segmentHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return Segment{}, fmt.Errorf("read header of segment %s: %w", key, err)
+	}
+	if header.Format != segmentFormat || header.Version != segmentVersion {
+		return Segment{}, fmt.Errorf("segment %s has unknown format %s version %d", key, header.Format, header.Version)
+	}
+	checksum := sha256.Sum256(compressed)
+	if header.Size != len(compressed) || header.Checksum != hex.EncodeToString(checksum[:]) {
+		return Segment{}, fmt.Errorf("%w: segment %s", ErrChecksumMismatch, key)
+	}
+
+	codec, err := LookupCodec(header.Codec)
+	if err != nil {
+		return Segment{}, err
+	}
+	encoded, err := codec.Decode(compressed)
+	if err != nil {
+		return Segment{}, err
+	}
+	var body struct {
+		segmentBody
+		Items []map[string]json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(encoded, &body); err != nil {
+		return Segment{}, fmt.Errorf("read segment %s: %w", key, err)
+	}
+
+	segment := Segment{
+		Key:        key,
+		ActorName:  body.ActorName,
+		FromIndex:  body.FromIndex,
+		ToIndex:    body.ToIndex,
+		ArchivedAt: body.ArchivedAt,
+	}
+	for _, encodedItem := range body.Items {
+		item, err := itemFromJSON(encodedItem)
+		if err != nil {
+			return Segment{}, fmt.Errorf("read segment %s: %w", key, err)
+		}
+		segment.Items = append(segment.Items, item)
+	}
+	return segment, nil
+}
+
+// replay passes the archived items of actorName from eventIndexStart to eventIndexEnd, or to the last archived item
+// if eventIndexEnd is 0, to callback in event index order, and returns the index after the last item it passed.
+func (a *SegmentArchiver) replay(ctx context.Context, actorName string, eventIndexStart int, eventIndexEnd int, callback func(item map[string]types.AttributeValue) error) (int, error) {
+	segments, err := a.Segments(ctx, actorName)
+	if err != nil {
+		return eventIndexStart, err
+	}
+	next := eventIndexStart
+	for _, segment := range segments {
+		if segment.ToIndex < next || (eventIndexEnd != 0 && segment.FromIndex > eventIndexEnd) {
+			continue
+		}
+		segment, err := a.ReadSegment(ctx, segment.Key)
+		if err != nil {
+			return next, err
+		}
+		for _, item := range segment.Items {
+			eventIndex, err := itemEventIndex(item)
+			if err != nil {
+				return next, err
+			}
+			// 重なったsegmentや範囲外のitemは飛ばす
+			if eventIndex < next || (eventIndexEnd != 0 && eventIndex > eventIndexEnd) {
+				continue
+			}
+			if err := callback(item); err != nil {
+				return next, err
+			}
+			next = eventIndex + 1
+		}
+	}
+	return next, nil
+}
+
+func segmentPrefix(actorName string) string {
+	return "segments/" + url.PathEscape(actorName) + "/"
+}
+
+func itemEventIndex(item map[string]types.AttributeValue) (int, error) {
+	v, ok := item["eventIndex"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("item has no event index")
+	}
+	return strconv.Atoi(v.Value)
+}
+
+// itemToJSON converts an item into the DynamoDB JSON format, e.g. {"eventIndex": {"N": "1"}}.
+func itemToJSON(item map[string]types.AttributeValue) map[string]interface{} {
+	m := make(map[string]interface{}, len(item))
+	for k, v := range item {
+		m[k] = attributeToJSON(v)
+	}
+	return m
+}
+
+func attributeToJSON(av types.AttributeValue) interface{} {
+	switch v := av.(type) {
+	case *types.AttributeValueMemberS:
+		return map[string]interface{}{"S": v.Value}
+	case *types.AttributeValueMemberN:
+		return map[string]interface{}{"N": v.Value}
+	case *types.AttributeValueMemberB:
+		// []byteはbase64で書かれる
+		return map[string]interface{}{"B": v.Value}
+	case *types.AttributeValueMemberBOOL:
+		return map[string]interface{}{"BOOL": v.Value}
+	case *types.AttributeValueMemberNULL:
+		return map[string]interface{}{"NULL": v.Value}
+	case *types.AttributeValueMemberSS:
+		return map[string]interface{}{"SS": v.Value}
+	case *types.AttributeValueMemberNS:
+		return map[string]interface{}{"NS": v.Value}
+	case *types.AttributeValueMemberBS:
+		return map[string]interface{}{"BS": v.Value}
+	case *types.AttributeValueMemberL:
+		list := make([]interface{}, 0, len(v.Value))
+		for _, e := range v.Value {
+			list = append(list, attributeToJSON(e))
+		}
+		return map[string]interface{}{"L": list}
+	case *types.AttributeValueMemberM:
+		return map[string]interface{}{"M": itemToJSON(v.Value)}
+	default:
+		return nil
+	}
+}
+
+// itemFromJSON restores an item written by itemToJSON.
+func itemFromJSON(encoded map[string]json.RawMessage) (map[string]types.AttributeValue, error) {
+	item := make(map[string]types.AttributeValue, len(encoded))
+	for k, raw := range encoded {
+		av, err := attributeFromJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", k, err)
+		}
+		item[k] = av
+	}
+	return item, nil
+}
+
+func attributeFromJSON(raw json.RawMessage) (types.AttributeValue, error) {
+	var typed map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &typed); err != nil {
+		return nil, err
+	}
+	if len(typed) != 1 {
+		return nil, fmt.Errorf("attribute value must have one type: %s", raw)
+	}
+	for typ, value := range typed {
+		switch typ {
+		case "S":
+			v := &types.AttributeValueMemberS{}
+			return v, json.Unmarshal(value, &v.Value)
+		case "N":
+			v := &types.AttributeValueMemberN{}
+			return v, json.Unmarshal(value, &v.Value)
+		case "B":
+			v := &types.AttributeValueMemberB{}
+			return v, json.Unmarshal(value, &v.Value)
+		case "BOOL":
+			v := &types.AttributeValueMemberBOOL{}
+			return v, json.Unmarshal(value, &v.Value)
+		case "NULL":
+			v := &types.AttributeValueMemberNULL{}
+			return v, json.Unmarshal(value, &v.Value)
+		case "SS":
+			v := &types.AttributeValueMemberSS{}
+			return v, json.Unmarshal(value, &v.Value)
+		case "NS":
+			v := &types.AttributeValueMemberNS{}
+			return v, json.Unmarshal(value, &v.Value)
+		case "BS":
+			v := &types.AttributeValueMemberBS{}
+			return v, json.Unmarshal(value, &v.Value)
+		case "L":
+			var list []json.RawMessage
+			if err := json.Unmarshal(value, &list); err != nil {
+				return nil, err
+			}
+			v := &types.AttributeValueMemberL{Value: make([]types.AttributeValue, 0, len(list))}
+			for _, e := range list {
+				av, err := attributeFromJSON(e)
+				if err != nil {
+					return nil, err
+				}
+				v.Value = append(v.Value, av)
+			}
+			return v, nil
+		case "M":
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(value, &m); err != nil {
+				return nil, err
+			}
+			item, err := itemFromJSON(m)
+			if err != nil {
+				return nil, err
+			}
+			return &types.AttributeValueMemberM{Value: item}, nil
+		default:
+			return nil, fmt.Errorf("unknown attribute type: %s", typ)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,225 @@
+package persistence_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+func TestSegmentArchiver(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	archiver := p.NewSegmentArchiver(p.NewFileBlobStore(root), p.ZstdCodec())
+
+	item := func(eventIndex string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"actorName":  &types.AttributeValueMemberS{Value: "testSegment/Actor"},
+			"eventIndex": &types.AttributeValueMemberN{Value: eventIndex},
+			"payload":    &types.AttributeValueMemberB{Value: []byte{0, 1, 2, 0xff}},
+			"tags":       &types.AttributeValueMemberSS{Value: []string{"a", "b"}},
+			"headers": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+				"traceId": &types.AttributeValueMemberS{Value: "trace"},
+			}},
+			"list": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+				&types.AttributeValueMemberBOOL{Value: true},
+				&types.AttributeValueMemberNULL{Value: true},
+			}},
+		}
+	}
+	require.NoError(t, archiver.Archive(ctx, "testSegment/Actor", []map[string]types.AttributeValue{item("10"), item("11")}))
+	require.NoError(t, archiver.Archive(ctx, "testSegment/Actor", []map[string]types.AttributeValue{item("2")}))
+	// 他のactorのsegmentは含まれない
+	require.NoError(t, archiver.Archive(ctx, "testSegment", []map[string]types.AttributeValue{item("0")}))
+
+	segments, err := archiver.Segments(ctx, "testSegment/Actor")
+	require.NoError(t, err)
+	require.Len(t, segments, 2)
+	assert.Equal(t, 2, segments[0].FromIndex)
+	assert.Equal(t, 2, segments[0].ToIndex)
+	assert.Equal(t, 10, segments[1].FromIndex)
+	assert.Equal(t, 11, segments[1].ToIndex)
+
+	segment, err := archiver.ReadSegment(ctx, segments[1].Key)
+	require.NoError(t, err)
+	assert.Equal(t, "testSegment/Actor", segment.ActorName)
+	assert.Equal(t, 10, segment.FromIndex)
+	assert.Equal(t, 11, segment.ToIndex)
+	assert.False(t, segment.ArchivedAt.IsZero())
+	assert.Equal(t, []map[string]types.AttributeValue{item("10"), item("11")}, segment.Items)
+
+	// 壊れたsegmentは読めない
+	path := filepath.Join(root, filepath.FromSlash(segments[1].Key))
+	file, err := os.ReadFile(path)
+	require.NoError(t, err)
+	file[len(file)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, file, 0o644))
+	_, err = archiver.ReadSegment(ctx, segments[1].Key)
+	assert.ErrorIs(t, err, p.ErrChecksumMismatch)
+}
+
+func TestFileBlobStore_ListObjects(t *testing.T) {
+	ctx := context.Background()
+	store := p.NewFileBlobStore(t.TempDir())
+
+	for _, key := range []string{"journal/a/2", "journal/a/1", "journal/ab/1", "snapshot/a/1"} {
+		require.NoError(t, store.PutObject(ctx, key, []byte("payload")))
+	}
+
+	keys, err := store.ListObjects(ctx, "journal/a/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"journal/a/1", "journal/a/2"}, keys)
+
+	keys, err = store.ListObjects(ctx, "journal/a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"journal/a/1", "journal/a/2", "journal/ab/1"}, keys)
+
+	// 存在しないprefixは空
+	keys, err = store.ListObjects(ctx, "missing/")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestProviderState_ArchiveReplay(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	archiver := p.NewSegmentArchiver(p.NewFileBlobStore(t.TempDir()), p.ZstdCodec())
+	opts := []p.Option{
+		p.WithCompaction(1, 1),
+		p.WithCompactionArchive(archiver),
+		p.WithArchiveReplay(archiver),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	actorName := "testArchiveReplayActor"
+	for i, data := range []string{"event1", "event2", "event3", "event4", "event5"} {
+		provider.PersistEvent(actorName, i, &p.Event{Data: data})
+	}
+	provider.PersistSnapshot(actorName, 3, &p.Snapshot{Data: "snapshot"})
+	provider.WaitForCompactions()
+
+	segments, err := archiver.Segments(ctx, actorName)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	assert.Equal(t, 0, segments[0].FromIndex)
+	assert.Equal(t, 2, segments[0].ToIndex)
+
+	// journalから消えたeventはarchiveから読む
+	var data []string
+	provider.GetEvents(actorName, 1, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Equal(t, []string{"event2", "event3", "event4", "event5"}, data)
+
+	data = nil
+	provider.GetEvents(actorName, 0, 1, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Equal(t, []string{"event1", "event2"}, data)
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorName)
+}
+
+func TestProviderState_ArchiveReplayTTL(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	now := time.Now()
+	archiver := p.NewSegmentArchiver(p.NewFileBlobStore(t.TempDir()), p.ZstdCodec())
+	opts := []p.Option{
+		p.WithTTL("", p.FixedTTL(time.Hour)),
+		p.WithClock(func() time.Time { return now }),
+		p.WithCompaction(1, 1),
+		p.WithCompactionArchive(archiver),
+		p.WithArchiveReplay(archiver),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	actorName := "testArchiveReplayTTLActor"
+	provider.PersistEvent(actorName, 0, &p.Event{Data: "event1"})
+	provider.PersistEvent(actorName, 1, &p.Event{Data: "event2"})
+	now = now.Add(30 * time.Minute)
+	for i, data := range []string{"event3", "event4", "event5"} {
+		provider.PersistEvent(actorName, i+2, &p.Event{Data: data})
+	}
+	provider.PersistSnapshot(actorName, 3, &p.Snapshot{Data: "snapshot"})
+	provider.WaitForCompactions()
+
+	// archiveのitemも期限を持ち、期限切れのeventを飛ばしてreplayしない
+	now = now.Add(31 * time.Minute)
+	err := persistError(func() { provider.GetEvents(actorName, 0, 0, func(e interface{}) {}) })
+	assert.ErrorIs(t, err, p.ErrJournalExpired)
+
+	var data []string
+	provider.GetEvents(actorName, 2, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Equal(t, []string{"event3", "event4", "event5"}, data)
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorName)
+}
+
+func TestProviderState_ArchiveReplayLargePayloads(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	blobStore := p.NewFileBlobStore(t.TempDir())
+	archiver := p.NewSegmentArchiver(p.NewFileBlobStore(t.TempDir()), p.ZstdCodec())
+	opts := []p.Option{
+		p.WithChunking(p.DefaultChunkTable, 16*1024),
+		p.WithBlobStore(blobStore, 200*1024),
+		p.WithCompaction(1, 1),
+		p.WithCompactionArchive(archiver),
+		p.WithArchiveReplay(archiver),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	// 1つ目はchunkに、2つ目はblobに分けて書かれる
+	large := largeSnapshot().Data
+	actorName := "testArchiveLargeActor"
+	for i, data := range []string{large, large + large, "event3", "event4", "event5"} {
+		provider.PersistEvent(actorName, i, &p.Event{Data: data})
+	}
+	provider.PersistSnapshot(actorName, 3, &p.Snapshot{Data: "snapshot"})
+	provider.WaitForCompactions()
+
+	// segmentはpayloadをそのまま持ち、chunkやblobを参照しない
+	segments, err := archiver.Segments(ctx, actorName)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	segment, err := archiver.ReadSegment(ctx, segments[0].Key)
+	require.NoError(t, err)
+	require.Len(t, segment.Items, 3)
+	for _, item := range segment.Items {
+		assert.Contains(t, item, "payload")
+		assert.NotContains(t, item, "chunks")
+		assert.NotContains(t, item, "payloadRef")
+	}
+	blobs, err := blobStore.ListObjects(ctx, p.DefaultJournalTable+"/"+actorName+"/")
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+
+	var data []string
+	provider.GetEvents(actorName, 0, 0, func(e interface{}) {
+		data = append(data, e.(*p.Event).Data)
+	})
+	assert.Equal(t, []string{large, large + large, "event3", "event4", "event5"}, data)
+
+	// クリーンアップ
+	_, err = provider.PurgeActor(ctx, actorName)
+	require.NoError(t, err)
+}
@@ -0,0 +1,199 @@
+package persistence
+
+import (
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	SerializerProto     = "proto"
+	SerializerProtoJSON = "protojson"
+
+	attrSerializerID = "serializerId"
+	attrManifest     = "manifest"
+)
+
+// Serializer converts messages to bytes and back.
+// The ID and the manifest are stored with each item, so a reader can pick the same serializer
+// and restore the type of the message without knowing it in advance.
+type Serializer interface {
+	ID() string
+	Manifest(message interface{}) (string, error)
+	Marshal(message interface{}) ([]byte, error)
+	Unmarshal(data []byte, manifest string) (interface{}, error)
+}
+
+type protoSerializer struct{}
+
+// ProtoSerializer stores messages in the protobuf binary format.
+func ProtoSerializer() Serializer {
+	return protoSerializer{}
+}
+
+func (protoSerializer) ID() string { return SerializerProto }
+
+func (protoSerializer) Manifest(message interface{}) (string, error) {
+	return protoManifest(message)
+}
+
+func (protoSerializer) Marshal(message interface{}) ([]byte, error) {
+	m, ok := message.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto message", message)
+	}
+	return proto.Marshal(m)
+}
+
+func (protoSerializer) Unmarshal(data []byte, manifest string) (interface{}, error) {
+	m, err := newProtoMessage(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return m, proto.Unmarshal(data, m)
+}
+
+type protoJSONSerializer struct{}
+
+// ProtoJSONSerializer stores messages as protobuf JSON, which can be read without the Go types.
+func ProtoJSONSerializer() Serializer {
+	return protoJSONSerializer{}
+}
+
+func (protoJSONSerializer) ID() string { return SerializerProtoJSON }
+
+func (protoJSONSerializer) Manifest(message interface{}) (string, error) {
+	return protoManifest(message)
+}
+
+func (protoJSONSerializer) Marshal(message interface{}) ([]byte, error) {
+	m, ok := message.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto message", message)
+	}
+	return protojson.Marshal(m)
+}
+
+func (protoJSONSerializer) Unmarshal(data []byte, manifest string) (interface{}, error) {
+	m, err := newProtoMessage(manifest)
+	if err != nil {
+		return nil, err
+	}
+	// 新しいfieldが追加された後でも古いreaderが読めるように、未知のfieldは無視する
+	return m, protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, m)
+}
+
+// protoManifest is the full name of the proto message, e.g. persistence.Event.
+func protoManifest(message interface{}) (string, error) {
+	m, ok := message.(proto.Message)
+	if !ok {
+		return "", fmt.Errorf("%T is not a proto message", message)
+	}
+	return string(m.ProtoReflect().Descriptor().FullName()), nil
+}
+
+func newProtoMessage(manifest string) (proto.Message, error) {
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(manifest))
+	if err != nil {
+		return nil, fmt.Errorf("find message type %s: %w", manifest, err)
+	}
+	return mt.New().Interface(), nil
+}
+
+// SerializerRegistry selects the serializer of a message by its type name,
+// falling back to the default serializer of the provider.
+type SerializerRegistry struct {
+	mu          sync.RWMutex
+	serializers map[string]Serializer
+	bindings    map[string]string
+	defaultID   string
+}
+
+// NewSerializerRegistry returns a registry with the protobuf binary and protojson serializers,
+// using protobuf binary by default.
+func NewSerializerRegistry() *SerializerRegistry {
+	r := &SerializerRegistry{
+		serializers: map[string]Serializer{},
+		bindings:    map[string]string{},
+		defaultID:   SerializerProto,
+	}
+	r.Register(ProtoSerializer())
+	r.Register(ProtoJSONSerializer())
+	return r
+}
+
+// Register adds a serializer, replacing one with the same ID.
+func (r *SerializerRegistry) Register(serializer Serializer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.serializers[serializer.ID()] = serializer
+}
+
+// Bind makes messages of typeName use the serializer with serializerID.
+// typeName is the full name of a proto message, or the %T name of other Go types.
+func (r *SerializerRegistry) Bind(typeName string, serializerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bindings[typeName] = serializerID
+}
+
+// SetDefault makes serializerID the serializer of messages without a binding.
+func (r *SerializerRegistry) SetDefault(serializerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.defaultID = serializerID
+}
+
+// Serialize marshals message with the serializer selected for its type.
+func (r *SerializerRegistry) Serialize(message interface{}) (serializerID string, manifest string, data []byte, err error) {
+	serializer, err := r.serializerFor(message)
+	if err != nil {
+		return "", "", nil, err
+	}
+	manifest, err = serializer.Manifest(message)
+	if err != nil {
+		return "", "", nil, err
+	}
+	data, err = serializer.Marshal(message)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return serializer.ID(), manifest, data, nil
+}
+
+// Deserialize unmarshals data written by Serialize.
+func (r *SerializerRegistry) Deserialize(serializerID string, manifest string, data []byte) (interface{}, error) {
+	r.mu.RLock()
+	serializer, ok := r.serializers[serializerID]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown serializer: %s", serializerID)
+	}
+	return serializer.Unmarshal(data, manifest)
+}
+
+func (r *SerializerRegistry) serializerFor(message interface{}) (Serializer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.bindings[typeName(message)]
+	if !ok {
+		id = r.defaultID
+	}
+	serializer, ok := r.serializers[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown serializer: %s", id)
+	}
+	return serializer, nil
+}
+
+func typeName(message interface{}) string {
+	if m, ok := message.(proto.Message); ok {
+		return string(m.ProtoReflect().Descriptor().FullName())
+	}
+	return fmt.Sprintf("%T", message)
+}
@@ -0,0 +1,167 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// protobufではないGoの構造体をJSONで保存するserializer
+type accountClosed struct {
+	Reason string `json:"reason"`
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) ID() string { return "json" }
+
+func (jsonSerializer) Manifest(message interface{}) (string, error) {
+	switch message.(type) {
+	case *accountClosed:
+		return "accountClosed", nil
+	}
+	return "", fmt.Errorf("unsupported type %T", message)
+}
+
+func (jsonSerializer) Marshal(message interface{}) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, manifest string) (interface{}, error) {
+	switch manifest {
+	case "accountClosed":
+		m := &accountClosed{}
+		return m, json.Unmarshal(data, m)
+	}
+	return nil, fmt.Errorf("unsupported manifest %s", manifest)
+}
+
+func TestSerializerRegistry(t *testing.T) {
+	event := &p.Event{Id: "1", Type: "CreateUserAccount", Data: "user@example.com", OccurredAt: timestamppb.Now()}
+
+	registry := p.NewSerializerRegistry()
+	id, manifest, data, err := registry.Serialize(event)
+	assert.NoError(t, err)
+	assert.Equal(t, p.SerializerProto, id)
+	assert.Equal(t, "persistence.Event", manifest)
+	restored, err := registry.Deserialize(id, manifest, data)
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(event, restored.(*p.Event)))
+
+	// 型ごとにserializerを選べる
+	registry.Bind("persistence.Event", p.SerializerProtoJSON)
+	id, manifest, data, err = registry.Serialize(event)
+	assert.NoError(t, err)
+	assert.Equal(t, p.SerializerProtoJSON, id)
+	assert.Contains(t, string(data), `"data":"user@example.com"`)
+	restored, err = registry.Deserialize(id, manifest, data)
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(event, restored.(*p.Event)))
+
+	// bindされていない型はdefaultのserializerを使う
+	id, _, _, err = registry.Serialize(&p.Snapshot{Data: "snapshot"})
+	assert.NoError(t, err)
+	assert.Equal(t, p.SerializerProto, id)
+
+	// 独自のserializerを登録できる
+	registry.Register(jsonSerializer{})
+	registry.Bind("*persistence_test.accountClosed", "json")
+	id, manifest, data, err = registry.Serialize(&accountClosed{Reason: "requested"})
+	assert.NoError(t, err)
+	assert.Equal(t, "json", id)
+	restored, err = registry.Deserialize(id, manifest, data)
+	assert.NoError(t, err)
+	assert.Equal(t, &accountClosed{Reason: "requested"}, restored)
+
+	_, err = registry.Deserialize("unknown", manifest, data)
+	assert.Error(t, err)
+	_, err = registry.Deserialize(p.SerializerProto, "persistence.Unknown", data)
+	assert.Error(t, err)
+}
+
+func TestEventStore_PersistEventWithProtoJSON(t *testing.T) {
+	ctx := context.Background()
+	tableName := "journal"
+
+	client := InitializeDynamoDBClient()
+	registry := p.NewSerializerRegistry()
+	registry.SetDefault(p.SerializerProtoJSON)
+	eventStore := p.NewEventStore(client, tableName, p.WithSerializers(registry))
+
+	actorName := "testProtoJSONActor"
+	eventStore.PersistEvent(actorName, 1, &p.Event{Data: "event1"})
+	// Event以外の型もjournalに保存できる
+	eventStore.PersistEvent(actorName, 2, &p.Snapshot{Data: "event2"})
+
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": 1,
+	})
+	assert.NoError(t, err)
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{Key: key, TableName: aws.String(tableName)})
+	assert.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: p.SerializerProtoJSON}, result.Item["serializerId"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "persistence.Event"}, result.Item["manifest"])
+	assert.JSONEq(t, `{"data":"event1"}`, string(result.Item["payload"].(*types.AttributeValueMemberB).Value))
+
+	// protobuf binaryの設定のstoreからも読める
+	var events []interface{}
+	p.NewEventStore(client, tableName).GetEvents(actorName, 1, 0, func(e interface{}) { events = append(events, e) })
+	assert.Len(t, events, 2)
+	assert.True(t, proto.Equal(&p.Event{Data: "event1"}, events[0].(*p.Event)))
+	assert.True(t, proto.Equal(&p.Snapshot{Data: "event2"}, events[1].(*p.Snapshot)))
+
+	// クリーンアップ
+	for _, eventIndex := range []int{1, 2} {
+		key, err := attributevalue.MarshalMap(map[string]interface{}{
+			"actorName":  actorName,
+			"eventIndex": eventIndex,
+		})
+		assert.NoError(t, err)
+		_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(tableName)})
+		assert.NoError(t, err)
+	}
+}
+
+func TestProviderState_AppendNonProtoMessages(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	registry := p.NewSerializerRegistry()
+	registry.Register(jsonSerializer{})
+	registry.Bind("*persistence_test.accountClosed", "json")
+	provider := p.NewProviderState(client, p.WithSerializers(registry))
+
+	// protobufではない型のeventとsnapshotも、serializerがあれば保存できる
+	actorName := "testNonProtoActor"
+	require.NoError(t, provider.AppendEvent(ctx, actorName, 0, &p.Event{Data: "event1"}))
+	require.NoError(t, provider.AppendEvent(ctx, actorName, 1, &accountClosed{Reason: "requested"}))
+	require.NoError(t, provider.SaveSnapshot(ctx, actorName, 1, &accountClosed{Reason: "snapshot"}))
+
+	var events []interface{}
+	provider.GetEvents(actorName, 0, 0, func(e interface{}) { events = append(events, e) })
+	require.Len(t, events, 2)
+	assert.True(t, proto.Equal(&p.Event{Data: "event1"}, events[0].(*p.Event)))
+	assert.Equal(t, &accountClosed{Reason: "requested"}, events[1])
+	snapshot, eventIndex, ok := provider.GetSnapshot(actorName)
+	require.True(t, ok)
+	assert.Equal(t, 1, eventIndex)
+	assert.Equal(t, &accountClosed{Reason: "snapshot"}, snapshot)
+
+	// serializerのない型はerrorになる
+	assert.Error(t, provider.AppendEvent(ctx, actorName, 2, struct{}{}))
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorName)
+}
@@ -0,0 +1,133 @@
+package persistence
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/proto"
+)
+
+// snapshotCache keeps the latest snapshot of recently used actors in memory, up to maxBytes of encoded snapshots,
+// and evicts the least recently used ones beyond that. Snapshots are cloned on the way in and out,
+// so actors can not change a cached snapshot.
+type snapshotCache struct {
+	maxBytes int
+	metrics  snapshotCacheMetrics
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int
+}
+
+type cachedSnapshot struct {
+	actorName  string
+	eventIndex int
+	snapshot   proto.Message
+	size       int
+	// expiresAt is when the snapshot expires with WithTTL, or zero if it is kept forever.
+	expiresAt time.Time
+}
+
+type snapshotCacheMetrics struct {
+	hits      metric.Int64Counter
+	misses    metric.Int64Counter
+	evictions metric.Int64Counter
+	bytes     metric.Int64UpDownCounter
+}
+
+func newSnapshotCache(maxBytes int, meterProvider metric.MeterProvider) *snapshotCache {
+	meter := meterProvider.Meter(meterName)
+	c := &snapshotCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+	// 計装の作成に失敗しても、noopの計装が返るので使い続けられる
+	c.metrics.hits, _ = meter.Int64Counter("persistence.snapshot_cache.hits",
+		metric.WithDescription("Snapshots returned from the snapshot cache."))
+	c.metrics.misses, _ = meter.Int64Counter("persistence.snapshot_cache.misses",
+		metric.WithDescription("Snapshots that were not in the snapshot cache and were read from the table."))
+	c.metrics.evictions, _ = meter.Int64Counter("persistence.snapshot_cache.evictions",
+		metric.WithDescription("Snapshots evicted from the snapshot cache to stay within its size."))
+	c.metrics.bytes, _ = meter.Int64UpDownCounter("persistence.snapshot_cache.size",
+		metric.WithDescription("Encoded size of the snapshots in the snapshot cache."), metric.WithUnit("By"))
+	return c
+}
+
+// get returns a copy of the cached snapshot of actorName, unless it has none or the snapshot has expired at now.
+func (c *snapshotCache) get(actorName string, now time.Time) (proto.Message, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[actorName]
+	if !ok {
+		return nil, 0, false
+	}
+	entry := e.Value.(*cachedSnapshot)
+	if !entry.expiresAt.IsZero() && !entry.expiresAt.After(now) {
+		c.remove(e)
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(e)
+	return proto.Clone(entry.snapshot), entry.eventIndex, true
+}
+
+// record counts a lookup of the cache as a hit or a miss.
+func (c *snapshotCache) record(ctx context.Context, hit bool) {
+	if hit {
+		c.metrics.hits.Add(ctx, 1)
+	} else {
+		c.metrics.misses.Add(ctx, 1)
+	}
+}
+
+// put caches snapshot as the latest snapshot of actorName. An older snapshot than the cached one is ignored,
+// and a snapshot larger than the whole cache is not cached.
+func (c *snapshotCache) put(ctx context.Context, actorName string, eventIndex int, snapshot proto.Message, expiresAt time.Time) {
+	size := proto.Size(snapshot)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[actorName]; ok {
+		if e.Value.(*cachedSnapshot).eventIndex > eventIndex {
+			return
+		}
+		c.remove(e)
+	}
+	if size > c.maxBytes {
+		return
+	}
+
+	c.entries[actorName] = c.lru.PushFront(&cachedSnapshot{
+		actorName:  actorName,
+		eventIndex: eventIndex,
+		snapshot:   proto.Clone(snapshot),
+		size:       size,
+		expiresAt:  expiresAt,
+	})
+	c.bytes += size
+	c.metrics.bytes.Add(ctx, int64(size))
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.metrics.evictions.Add(ctx, 1)
+	}
+}
+
+// invalidate drops the cached snapshot of actorName if it was taken at inclusiveToIndex or before.
+func (c *snapshotCache) invalidate(actorName string, inclusiveToIndex int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[actorName]; ok && e.Value.(*cachedSnapshot).eventIndex <= inclusiveToIndex {
+		c.remove(e)
+	}
+}
+
+// remove drops an entry. The caller holds mu.
+func (c *snapshotCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cachedSnapshot)
+	delete(c.entries, entry.actorName)
+	c.bytes -= entry.size
+	c.metrics.bytes.Add(context.Background(), -int64(entry.size))
+}
@@ -0,0 +1,120 @@
+package persistence_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestSnapshotStore_Cache(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	reader := sdkmetric.NewManualReader()
+	// 100文字のsnapshotが1つだけ入る大きさ
+	opts := []p.Option{
+		p.WithSnapshotCache(150),
+		p.WithActorMetadata(p.DefaultActorMetadataTable),
+		p.WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	store := p.NewSnapshotStore(client, p.DefaultSnapshotTable, opts...)
+
+	// metadataがなければ、他のprocessが書いたsnapshotに気付けないので使えない
+	assert.ErrorIs(t, p.CreateTables(ctx, client, p.WithSnapshotCache(150)), p.ErrInvalidOptions)
+	_, _, err := p.NewSnapshotStore(client, p.DefaultSnapshotTable, p.WithSnapshotCache(150)).LoadSnapshot(ctx, "testCacheActorA")
+	assert.ErrorIs(t, err, p.ErrInvalidOptions)
+
+	actorA, actorB := "testCacheActorA", "testCacheActorB"
+	store.PersistSnapshot(actorA, 3, &p.Snapshot{Data: strings.Repeat("a", 100)})
+
+	// tableから消しても、cacheから返る
+	deleteActorItems(t, client, p.DefaultSnapshotTable, actorA)
+	snapshot, eventIndex, ok := store.GetSnapshot(actorA)
+	require.True(t, ok)
+	assert.Equal(t, 3, eventIndex)
+	assert.Equal(t, strings.Repeat("a", 100), snapshot.(*p.Snapshot).Data)
+
+	// 返したsnapshotを変えても、cacheは変わらない
+	snapshot.(*p.Snapshot).Data = "changed"
+	snapshot, _, ok = store.GetSnapshot(actorA)
+	require.True(t, ok)
+	assert.Equal(t, strings.Repeat("a", 100), snapshot.(*p.Snapshot).Data)
+
+	// 大きさを超えると、最も使われていないsnapshotが追い出される
+	store.PersistSnapshot(actorB, 5, &p.Snapshot{Data: strings.Repeat("b", 100)})
+	_, _, ok = store.GetSnapshot(actorA)
+	assert.False(t, ok)
+	snapshot, eventIndex, ok = store.GetSnapshot(actorB)
+	require.True(t, ok)
+	assert.Equal(t, 5, eventIndex)
+	assert.Equal(t, strings.Repeat("b", 100), snapshot.(*p.Snapshot).Data)
+
+	// 削除でtableから消え、cacheも無効になる
+	store.DeleteSnapshots(actorB, 5)
+	_, _, ok = store.GetSnapshot(actorB)
+	assert.False(t, ok)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	sums := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok {
+				for _, dp := range sum.DataPoints {
+					sums[m.Name] += dp.Value
+				}
+			}
+		}
+	}
+	assert.Equal(t, int64(3), sums["persistence.snapshot_cache.hits"])
+	assert.Equal(t, int64(2), sums["persistence.snapshot_cache.misses"])
+	assert.Equal(t, int64(1), sums["persistence.snapshot_cache.evictions"])
+	assert.Equal(t, int64(0), sums["persistence.snapshot_cache.size"])
+
+	// クリーンアップ
+	for _, actorName := range []string{actorA, actorB} {
+		_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(p.DefaultActorMetadataTable),
+			Key:       map[string]types.AttributeValue{"actorName": &types.AttributeValueMemberS{Value: actorName}},
+		})
+		assert.NoError(t, err)
+	}
+}
+
+func TestForgetActor_SnapshotCache(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	keyProvider, err := p.NewStaticKeyProvider("test-key", make([]byte, 32))
+	require.NoError(t, err)
+	opts := []p.Option{
+		p.WithEncryption(p.NewKeyStore(client, p.DefaultKeyTable, keyProvider)),
+		p.WithActorMetadata(p.DefaultActorMetadataTable),
+		p.WithSnapshotCache(1024 * 1024),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	actorName := "testForgottenCacheActor"
+	provider.PersistSnapshot(actorName, 3, &p.Snapshot{Data: "user@example.com"})
+	_, _, ok := provider.GetSnapshot(actorName)
+	require.True(t, ok)
+
+	// 鍵を破棄したら、cacheからも読めない
+	require.NoError(t, provider.ForgetActor(ctx, actorName))
+	_, _, ok = provider.GetSnapshot(actorName)
+	assert.False(t, ok)
+
+	// クリーンアップ
+	_, err = provider.PurgeActor(ctx, actorName)
+	require.NoError(t, err)
+}
@@ -0,0 +1,85 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNoMigrationPath is returned when a snapshot was stored with a schema version that can not be migrated to the current one.
+var ErrNoMigrationPath = errors.New("no migration path for snapshot")
+
+// SnapshotMigration turns a snapshot stored with an old schema version into its form at the next version.
+type SnapshotMigration func(snapshot interface{}) (interface{}, error)
+
+// SnapshotMigrations holds the migrations of snapshot types and the schema version snapshots are written with.
+// Snapshots without a recorded schema version are version 1.
+type SnapshotMigrations struct {
+	mu         sync.RWMutex
+	migrations map[versionKey]SnapshotMigration
+	versions   map[string]int
+}
+
+func NewSnapshotMigrations() *SnapshotMigrations {
+	return &SnapshotMigrations{
+		migrations: map[versionKey]SnapshotMigration{},
+		versions:   map[string]int{},
+	}
+}
+
+// Register adds a migration from fromVersion to fromVersion+1 for snapshots of typeName.
+// The current version of typeName becomes fromVersion+1 unless a later migration is registered.
+// Snapshots returned by the migration continue at fromVersion+1 of their own type.
+func (m *SnapshotMigrations) Register(typeName string, fromVersion int, migration SnapshotMigration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.migrations[versionKey{typeName, fromVersion}] = migration
+	if m.versions[typeName] < fromVersion+1 {
+		m.versions[typeName] = fromVersion + 1
+	}
+}
+
+// SetCurrentVersion sets the schema version of typeName without a migration from the previous one,
+// e.g. when old snapshots are cheaper to rebuild from events than to migrate.
+func (m *SnapshotMigrations) SetCurrentVersion(typeName string, version int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.versions[typeName] = version
+}
+
+// CurrentVersion is the schema version new snapshots of typeName are written with.
+func (m *SnapshotMigrations) CurrentVersion(typeName string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if version, ok := m.versions[typeName]; ok {
+		return version
+	}
+	return 1
+}
+
+// Migrate applies migrations to snapshot, stored with version, until it reaches the current version.
+func (m *SnapshotMigrations) Migrate(snapshot interface{}, version int) (interface{}, error) {
+	for {
+		name := typeName(snapshot)
+		current := m.CurrentVersion(name)
+		if version == current {
+			return snapshot, nil
+		}
+		if version > current {
+			// 新しいversionのcodeが書いたsnapshotは読めない
+			return nil, fmt.Errorf("%w: %s version %d is newer than %d", ErrNoMigrationPath, name, version, current)
+		}
+
+		m.mu.RLock()
+		migration, ok := m.migrations[versionKey{name, version}]
+		m.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("%w: %s version %d", ErrNoMigrationPath, name, version)
+		}
+		migrated, err := migration(snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("migrate %s from version %d: %w", name, version, err)
+		}
+		snapshot, version = migrated, version+1
+	}
+}
@@ -0,0 +1,142 @@
+package persistence_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/proto"
+)
+
+const snapshotTypeName = "persistence.Snapshot"
+
+// newUserAccountMigrations describes the history of the Snapshot schema used in these tests.
+//   - version 1: Dataは大文字だった
+//   - version 2: Dataを小文字にした
+func newUserAccountMigrations() *p.SnapshotMigrations {
+	migrations := p.NewSnapshotMigrations()
+	migrations.Register(snapshotTypeName, 1, func(snapshot interface{}) (interface{}, error) {
+		s := proto.Clone(snapshot.(*p.Snapshot)).(*p.Snapshot)
+		s.Data = strings.ToLower(s.Data)
+		return s, nil
+	})
+	return migrations
+}
+
+func TestSnapshotMigrations_Migrate(t *testing.T) {
+	migrations := newUserAccountMigrations()
+	assert.Equal(t, 2, migrations.CurrentVersion(snapshotTypeName))
+
+	migrated, err := migrations.Migrate(&p.Snapshot{Data: "ALICE"}, 1)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(&p.Snapshot{Data: "alice"}, migrated.(*p.Snapshot)))
+
+	current := &p.Snapshot{Data: "Alice"}
+	migrated, err = migrations.Migrate(current, 2)
+	require.NoError(t, err)
+	assert.Same(t, current, migrated)
+
+	_, err = migrations.Migrate(&p.Snapshot{}, 3)
+	assert.ErrorIs(t, err, p.ErrNoMigrationPath)
+
+	// migrationなしでversionを上げると、古いsnapshotは移行できない
+	migrations.SetCurrentVersion(snapshotTypeName, 3)
+	_, err = migrations.Migrate(&p.Snapshot{Data: "ALICE"}, 1)
+	assert.ErrorIs(t, err, p.ErrNoMigrationPath)
+}
+
+func TestSnapshotStore_GetSnapshotWithMigrations(t *testing.T) {
+	ctx := context.Background()
+	tableName := "snapshot"
+
+	client := InitializeDynamoDBClient()
+	actorName := "testMigrationActor"
+	snapshotBytes, err := proto.Marshal(&p.Snapshot{Data: "ALICE"})
+	require.NoError(t, err)
+
+	// version 1のitemはschemaVersionを持たない
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]types.AttributeValue{
+			"actorName":  &types.AttributeValueMemberS{Value: actorName},
+			"eventIndex": &types.AttributeValueMemberN{Value: "3"},
+			"payload":    &types.AttributeValueMemberB{Value: snapshotBytes},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("migrated", func(t *testing.T) {
+		snapshotStore := p.NewSnapshotStore(client, tableName, p.WithSnapshotMigrations(newUserAccountMigrations()))
+		snapshot, eventIndex, ok := snapshotStore.GetSnapshot(actorName)
+		require.True(t, ok)
+		assert.Equal(t, 3, eventIndex)
+		assert.True(t, proto.Equal(&p.Snapshot{Data: "alice"}, snapshot.(*p.Snapshot)))
+	})
+
+	t.Run("no migration path", func(t *testing.T) {
+		migrations := newUserAccountMigrations()
+		migrations.SetCurrentVersion(snapshotTypeName, 3)
+		snapshotStore := p.NewSnapshotStore(client, tableName, p.WithSnapshotMigrations(migrations))
+		assert.Panics(t, func() { snapshotStore.GetSnapshot(actorName) })
+
+		_, ok, err := snapshotStore.LoadSnapshot(ctx, actorName)
+		assert.False(t, ok)
+		var migration *p.SnapshotMigrationError
+		require.ErrorAs(t, err, &migration)
+		assert.ErrorIs(t, err, p.ErrNoMigrationPath)
+		assert.Equal(t, 3, migration.EventIndex)
+		assert.Equal(t, 1, migration.Version)
+	})
+
+	t.Run("migration fails", func(t *testing.T) {
+		migrations := p.NewSnapshotMigrations()
+		migrations.Register(snapshotTypeName, 1, func(interface{}) (interface{}, error) {
+			return nil, errors.New("broken migration")
+		})
+		snapshotStore := p.NewSnapshotStore(client, tableName, p.WithSnapshotMigrations(migrations))
+		_, _, err := snapshotStore.LoadSnapshot(ctx, actorName)
+		var migration *p.SnapshotMigrationError
+		require.ErrorAs(t, err, &migration)
+		assert.NotErrorIs(t, err, p.ErrNoMigrationPath)
+
+		// migrationの失敗も、移行先のないsnapshotと同じく無視できる
+		snapshotStore = p.NewSnapshotStore(client, tableName, p.WithSnapshotMigrations(migrations), p.WithIgnoreUnmigratableSnapshots())
+		_, ok, err := snapshotStore.LoadSnapshot(ctx, actorName)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("ignored", func(t *testing.T) {
+		migrations := newUserAccountMigrations()
+		migrations.SetCurrentVersion(snapshotTypeName, 3)
+		snapshotStore := p.NewSnapshotStore(client, tableName, p.WithSnapshotMigrations(migrations), p.WithIgnoreUnmigratableSnapshots())
+		_, _, ok := snapshotStore.GetSnapshot(actorName)
+		assert.False(t, ok)
+
+		// 新しいsnapshotには現在のschemaVersionが記録され、そのまま読める
+		snapshotStore.PersistSnapshot(actorName, 4, &p.Snapshot{Data: "alice"})
+		snapshot, eventIndex, ok := snapshotStore.GetSnapshot(actorName)
+		require.True(t, ok)
+		assert.Equal(t, 4, eventIndex)
+		assert.True(t, proto.Equal(&p.Snapshot{Data: "alice"}, snapshot.(*p.Snapshot)))
+	})
+
+	// クリーンアップ
+	for _, eventIndex := range []int{3, 4} {
+		key, err := attributevalue.MarshalMap(map[string]interface{}{
+			"actorName":  actorName,
+			"eventIndex": eventIndex,
+		})
+		require.NoError(t, err)
+		_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(tableName)})
+		require.NoError(t, err)
+	}
+}
@@ -1,8 +1,12 @@
 package persistence
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"context"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -15,18 +19,60 @@ import (
 
 
 type SnapshotStore struct {
-	client    *dynamodb.Client
-	table     string
+	itemTable
+	cache *snapshotCache
+	// err is the ErrInvalidOptions error of the options, returned instead of reading or writing snapshots.
+	err error
 }
 
-func NewSnapshotStore(client *dynamodb.Client, table string) *SnapshotStore {
-	return &SnapshotStore{
-		client:    client,
-		table:     table,
+func NewSnapshotStore(client *dynamodb.Client, table string, opts ...Option) *SnapshotStore {
+	return newSnapshotStore(client, table, newOptions(opts))
+}
+
+// newSnapshotStore creates a SnapshotStore that shares o with the other stores of a ProviderState.
+func newSnapshotStore(client *dynamodb.Client, table string, o *options) *SnapshotStore {
+	s := &SnapshotStore{
+		itemTable: itemTable{
+			client:         client,
+			table:          table,
+			options:        o,
+			legacyManifest: string((&Snapshot{}).ProtoReflect().Descriptor().FullName()),
+		},
 	}
+	s.err = s.options.validate()
+	if s.err == nil && s.options.snapshotCacheBytes > 0 {
+		s.cache = newSnapshotCache(s.options.snapshotCacheBytes, s.options.meterProvider)
+	}
+	return s
 }
 
+// GetSnapshot returns the latest snapshot of actorName, migrated to the current schema version.
+// The signature is fixed by persistence.ProviderState, so an error makes it panic, e.g. a *SnapshotMigrationError
+// unless WithIgnoreUnmigratableSnapshots is set, or a snapshot that can not be read. LoadSnapshot returns the error instead.
 func (s *SnapshotStore) GetSnapshot(actorName string) (snapshot interface{}, eventIndex int, ok bool) {
+	envelope, ok, err := s.LoadSnapshot(context.Background(), actorName)
+	if err != nil {
+		// snapshotなしで復元すると、compaction後のjournalから間違った状態になるので、黙って続けない
+		// TODO: エラーハンドリング
+		panic(err)
+	}
+	return envelope.Snapshot, envelope.EventIndex, ok
+}
+
+// LoadSnapshot returns the latest snapshot of actorName, migrated to the current schema version.
+// A snapshot that can not be migrated, because there is no migration path or a migration fails, is reported
+// as a *SnapshotMigrationError, or as no snapshot with WithIgnoreUnmigratableSnapshots. The snapshot of a forgotten actor
+// is reported as no snapshot; any other error reading the snapshot is returned.
+func (s *SnapshotStore) LoadSnapshot(ctx context.Context, actorName string) (SnapshotEnvelope, bool, error) {
+	if s.err != nil {
+		return SnapshotEnvelope{}, false, s.err
+	}
+	if s.cache != nil {
+		if snapshot, eventIndex, ok := s.cachedSnapshot(ctx, actorName); ok {
+			return SnapshotEnvelope{ActorName: actorName, EventIndex: eventIndex, Snapshot: snapshot}, true, nil
+		}
+	}
+
 	input := &dynamodb.QueryInput{
 		TableName:              aws.String(s.table),
 		KeyConditionExpression: aws.String("actorName = :actorName"),
@@ -37,71 +83,254 @@ func (s *SnapshotStore) GetSnapshot(actorName string) (snapshot interface{}, eve
 		Limit:            aws.Int32(1),    // 最新の1レコードのみ取得
 	}
 
-	result, err := s.client.Query(context.Background(), input)
+	result, err := s.client.Query(ctx, input)
 	if err != nil {
-		return nil, 0, false
+		return SnapshotEnvelope{}, false, err
 	}
 
 	if len(result.Items) == 0 {
-		return nil, 0, false
+		return SnapshotEnvelope{}, false, nil
 	}
 
 	item := result.Items[0]
+	if s.options.ttl != nil && s.options.ttl.expired(item, s.options.clock()) {
+		// 古いsnapshotは先に期限切れになっているので、探さない
+		return SnapshotEnvelope{}, false, nil
+	}
 
 	var snapshotData map[string]interface{}
 	err = attributevalue.UnmarshalMap(item, &snapshotData)
 	if err != nil {
-		return nil, 0, false
+		return SnapshotEnvelope{}, false, err
 	}
 
 	// Goでは、UnmarshalMapすると数値はfloat64になるが、取得できているかを型assertionで確認する
 	eventIndexStr := fmt.Sprintf("%.0f", snapshotData["eventIndex"].(float64))
-	eventIndex, err = strconv.Atoi(eventIndexStr)
+	eventIndex, err := strconv.Atoi(eventIndexStr)
+	if err != nil {
+		return SnapshotEnvelope{}, false, err
+	}
+
+	snapshot, err := s.decodePayload(ctx, actorName, item)
+	if errors.Is(err, ErrActorForgotten) {
+		return SnapshotEnvelope{}, false, nil
+	}
+	if err != nil {
+		return SnapshotEnvelope{}, false, err
+	}
+
+	snapshot, err = s.migrate(actorName, eventIndex, item, snapshot)
+	var migration *SnapshotMigrationError
+	if errors.As(err, &migration) && s.options.ignoreStaleSnapshots {
+		// snapshotを使わずに、全eventのreplayで復元させる
+		return SnapshotEnvelope{}, false, nil
+	}
 	if err != nil {
-		return nil, 0, false
+		return SnapshotEnvelope{}, false, err
 	}
 
-	snapshotBytes, ok := snapshotData["payload"].([]byte)
-	if !ok {
-		if snapshotData["payload"] == nil {
-			// log something
-			return nil, 0, false
+	if message, ok := snapshot.(proto.Message); ok && s.cache != nil {
+		var expiresAt time.Time
+		if s.options.ttl != nil {
+			expiresAt = s.options.ttl.expiresAt(item)
 		}
-		return nil, 0, false
+		s.cache.put(ctx, actorName, eventIndex, message, expiresAt)
 	}
+	return SnapshotEnvelope{ActorName: actorName, EventIndex: eventIndex, Snapshot: snapshot}, true, nil
+}
+
+// SnapshotMigrationError is returned when a stored snapshot can not be migrated to the current schema version,
+// either because there is no migration path (ErrNoMigrationPath) or because a migration failed.
+type SnapshotMigrationError struct {
+	ActorName  string
+	EventIndex int
+	Version    int
+	Err        error
+}
 
-	snapshot = &Snapshot{}
-	err = proto.Unmarshal(snapshotBytes, snapshot.(*Snapshot))
+func (e *SnapshotMigrationError) Error() string {
+	return fmt.Sprintf("snapshot %d of %s at version %d: %s", e.EventIndex, e.ActorName, e.Version, e.Err)
+}
+
+func (e *SnapshotMigrationError) Unwrap() error {
+	return e.Err
+}
+
+// migrate migrates a decoded snapshot from the schema version recorded in its item.
+func (s *SnapshotStore) migrate(actorName string, eventIndex int, item map[string]types.AttributeValue, snapshot interface{}) (interface{}, error) {
+	version, err := schemaVersion(item)
+	if err != nil {
+		return nil, err
+	}
+	migrated, err := s.options.snapshotMigrations.Migrate(snapshot, version)
 	if err != nil {
-		return nil, 0, false
+		return nil, &SnapshotMigrationError{ActorName: actorName, EventIndex: eventIndex, Version: version, Err: err}
 	}
+	return migrated, nil
+}
 
-	return snapshot, eventIndex, true
+// cachedSnapshot returns the cached snapshot of actorName. It is used only while it is still the latest snapshot
+// of the actor in the actor metadata, in case another process has written a newer one.
+func (s *SnapshotStore) cachedSnapshot(ctx context.Context, actorName string) (interface{}, int, bool) {
+	snapshot, eventIndex, ok := s.cache.get(actorName, s.options.clock())
+	if ok {
+		last, found, err := s.options.actorMetadata.lastSnapshotIndex(ctx, s.client, actorName)
+		ok = err == nil && found && last == eventIndex
+	}
+	s.cache.record(ctx, ok)
+	return snapshot, eventIndex, ok
 }
 
+// SnapshotEnvelope is a stored snapshot with the index of the event it was taken at.
+type SnapshotEnvelope struct {
+	ActorName  string
+	EventIndex int
+	Snapshot   interface{}
+}
+
+// ReadSnapshots reads all snapshots of actorName in the order of their event index, migrated to the current schema version.
+// It stops at the first error, including one returned by callback.
+func (s *SnapshotStore) ReadSnapshots(ctx context.Context, actorName string, callback func(envelope SnapshotEnvelope) error) error {
+	if s.err != nil {
+		return s.err
+	}
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("actorName = :actorName"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if s.options.ttl != nil && s.options.ttl.expired(item, s.options.clock()) {
+				continue
+			}
+			eventIndex, err := strconv.Atoi(item["eventIndex"].(*types.AttributeValueMemberN).Value)
+			if err != nil {
+				return err
+			}
+			snapshot, err := s.decodePayload(ctx, actorName, item)
+			if errors.Is(err, ErrActorForgotten) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("decode snapshot %d of %s: %w", eventIndex, actorName, err)
+			}
+			snapshot, err = s.migrate(actorName, eventIndex, item, snapshot)
+			if err != nil {
+				return err
+			}
+			if err := callback(SnapshotEnvelope{ActorName: actorName, EventIndex: eventIndex, Snapshot: snapshot}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PersistSnapshot saves a snapshot like SaveSnapshot. A snapshot that can not be written is logged instead of
+// crashing the actor, which recovers from its previous snapshot and the events after it.
 func (s *SnapshotStore) PersistSnapshot(actorName string, eventIndex int, snapshot protoreflect.ProtoMessage) {
-	snapshotBytes, err := proto.Marshal(snapshot)
+	if err := s.SaveSnapshot(context.Background(), actorName, eventIndex, snapshot); err != nil {
+		log.Printf("persist snapshot %d of %s: %s", eventIndex, actorName, err)
+	}
+}
+
+// SaveSnapshot writes snapshot as the snapshot of actorName at eventIndex. Unlike PersistSnapshot, the snapshot can be
+// any message the serializers of WithSerializers support. Only proto messages are cached by WithSnapshotCache.
+func (s *SnapshotStore) SaveSnapshot(ctx context.Context, actorName string, eventIndex int, snapshot interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	item, err := s.encodePayload(ctx, actorName, snapshot)
 	if err != nil {
-		// TODO: error handling
-		panic(err)
+		return fmt.Errorf("encode snapshot %d of %s: %w", eventIndex, actorName, err)
 	}
+	item["actorName"] = &types.AttributeValueMemberS{Value: actorName}
+	item["eventIndex"] = &types.AttributeValueMemberN{Value: strconv.Itoa(eventIndex)}
+	item[attrSchemaVersion] = &types.AttributeValueMemberN{Value: strconv.Itoa(s.options.snapshotMigrations.CurrentVersion(typeName(snapshot)))}
 
-	item := map[string]types.AttributeValue{
-		"actorName": &types.AttributeValueMemberS{Value: actorName},
-		"eventIndex": &types.AttributeValueMemberN{Value: strconv.Itoa(eventIndex)},
-		"payload": &types.AttributeValueMemberB{Value: snapshotBytes},
+	var related []types.TransactWriteItem
+	if s.options.actorMetadata != nil {
+		related = append(related, s.options.actorMetadata.snapshotWritten(actorName, eventIndex, s.options.clock()))
+	}
+	if err := s.putItem(ctx, item, related...); err != nil {
+		return err
 	}
 
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(s.table),
-		Item:      item,
+	if message, ok := snapshot.(proto.Message); ok && s.cache != nil {
+		var expiresAt time.Time
+		if s.options.ttl != nil {
+			expiresAt = s.options.ttl.expiresAfter(actorName, s.options.clock())
+		}
+		s.cache.put(ctx, actorName, eventIndex, message, expiresAt)
 	}
+	return nil
+}
 
-	_, err = s.client.PutItem(context.Background(), input)
+// DeleteSnapshots deletes the snapshots of actorName up to inclusiveToIndex, together with their chunks and blobs,
+// and drops them from the snapshot cache. The last snapshot index in the actor metadata is kept.
+func (s *SnapshotStore) DeleteSnapshots(actorName string, inclusiveToIndex int) {
+	err := s.deleteSnapshots(context.TODO(), actorName, inclusiveToIndex)
+	if s.cache != nil {
+		s.cache.invalidate(actorName, inclusiveToIndex)
+	}
 	if err != nil {
-		// TODO: error handling
+		// TODO: エラーハンドリング
 		panic(err)
 	}
 }
 
-func (s *SnapshotStore) DeleteSnapshots(actorName string, inclusiveToIndex int) {}
+// deleteSnapshots deletes the snapshot items of actorName up to inclusiveToIndex, and then their chunks and blobs.
+func (s *SnapshotStore) deleteSnapshots(ctx context.Context, actorName string, inclusiveToIndex int) error {
+	if s.err != nil {
+		return s.err
+	}
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("actorName = :actorName AND eventIndex <= :to"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+			":to":        &types.AttributeValueMemberN{Value: strconv.Itoa(inclusiveToIndex)},
+		},
+		ProjectionExpression: aws.String(strings.Join([]string{"actorName", "eventIndex", attrChunks, attrPayloadRef}, ", ")),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		requests := make([]types.WriteRequest, 0, len(page.Items))
+		for _, item := range page.Items {
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{
+				"actorName":  item["actorName"],
+				"eventIndex": item["eventIndex"],
+			}}})
+		}
+		if err := batchWrite(ctx, s.client, s.table, requests); err != nil {
+			return fmt.Errorf("delete snapshots of %s: %w", actorName, err)
+		}
+
+		// snapshotのitemを消した後なので、途中で失敗しても残るのは参照されないpayloadだけ
+		for _, item := range page.Items {
+			if chunks, ok := item[attrChunks].(*types.AttributeValueMemberN); ok {
+				if err := s.deleteChunks(ctx, item, chunks); err != nil {
+					return err
+				}
+			}
+			if ref, ok := item[attrPayloadRef].(*types.AttributeValueMemberM); ok && s.options.blobStore != nil {
+				if key, ok := ref.Value["key"].(*types.AttributeValueMemberS); ok {
+					if err := s.options.blobStore.DeleteObject(ctx, key.Value); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
 	"google.golang.org/protobuf/proto"
 )
@@ -103,3 +105,149 @@ func TestSnapshotStore_PersistSnapshot(t *testing.T) {
 	_, err = client.DeleteItem(context.Background(), deleteInput)
 	assert.NoError(t, err)
 }
+
+func TestSnapshotStore_PersistSnapshotWithCompression(t *testing.T) {
+	tableName := "testSnapshotTable"
+
+	client := InitializeDynamoDBClient()
+	snapshotStore := p.NewSnapshotStore(client, tableName, p.WithCompression(p.ZstdCodec(), 1024))
+
+	actorName := "testCompressedActor"
+	eventIndex := 1
+	snapshotData := largeSnapshot()
+
+	snapshotStore.PersistSnapshot(actorName, eventIndex, snapshotData)
+
+	// codec attributeが記録されていることを確認
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": eventIndex,
+	})
+	assert.NoError(t, err)
+	result, err := client.GetItem(context.Background(), &dynamodb.GetItemInput{
+		Key:       key,
+		TableName: aws.String(tableName),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: p.CodecZstd}, result.Item["codec"])
+
+	// 圧縮されたスナップショットも、無圧縮の設定のstoreから読める
+	retrievedSnapshot, retrievedEventIndex, ok := p.NewSnapshotStore(client, tableName).GetSnapshot(actorName)
+	assert.True(t, ok)
+	assert.Equal(t, eventIndex, retrievedEventIndex)
+	assert.True(t, proto.Equal(snapshotData, retrievedSnapshot.(*p.Snapshot)))
+
+	// クリーンアップ
+	_, err = client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		Key:       key,
+		TableName: aws.String(tableName),
+	})
+	assert.NoError(t, err)
+}
+
+func TestSnapshotStore_DeleteSnapshots(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	opts := []p.Option{p.WithChunking(p.DefaultChunkTable, 16*1024)}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	snapshotStore := p.NewSnapshotStore(client, p.DefaultSnapshotTable, opts...)
+
+	actorName := "testDeleteSnapshotsActor"
+	snapshotStore.PersistSnapshot(actorName, 1, largeSnapshot())
+	snapshotStore.PersistSnapshot(actorName, 3, &p.Snapshot{Data: "snapshot3"})
+	snapshotStore.PersistSnapshot(actorName, 5, &p.Snapshot{Data: "snapshot5"})
+
+	// 指定したindexまでのsnapshotが、chunkと一緒に消える
+	snapshotStore.DeleteSnapshots(actorName, 3)
+	var indexes []int
+	require.NoError(t, snapshotStore.ReadSnapshots(ctx, actorName, func(envelope p.SnapshotEnvelope) error {
+		indexes = append(indexes, envelope.EventIndex)
+		return nil
+	}))
+	assert.Equal(t, []int{5}, indexes)
+	chunks, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(p.DefaultChunkTable),
+		KeyConditionExpression: aws.String("chunkKey = :chunkKey"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":chunkKey": &types.AttributeValueMemberS{Value: p.DefaultSnapshotTable + "#" + actorName},
+		},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, chunks.Items)
+
+	// クリーンアップ
+	snapshotStore.DeleteSnapshots(actorName, 5)
+}
+
+func TestSnapshotStore_PersistSnapshotWithChunking(t *testing.T) {
+	ctx := context.Background()
+	tableName := "snapshot"
+	chunkSize := 16 * 1024
+
+	client := InitializeDynamoDBClient()
+	opts := []p.Option{p.WithChunking(p.DefaultChunkTable, chunkSize)}
+	assert.NoError(t, p.CreateTables(ctx, client, opts...))
+	snapshotStore := p.NewSnapshotStore(client, tableName, opts...)
+
+	actorName := "testChunkedActor"
+	eventIndex := 1
+	snapshotData := largeSnapshot()
+
+	snapshotStore.PersistSnapshot(actorName, eventIndex, snapshotData)
+
+	// payloadは本体のitemではなく、chunkに分割して保存されている
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": eventIndex,
+	})
+	assert.NoError(t, err)
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{Key: key, TableName: aws.String(tableName)})
+	assert.NoError(t, err)
+	assert.Nil(t, result.Item["payload"])
+	chunks := (proto.Size(snapshotData) + chunkSize - 1) / chunkSize
+	assert.Equal(t, &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", chunks)}, result.Item["chunks"])
+
+	retrievedSnapshot, retrievedEventIndex, ok := snapshotStore.GetSnapshot(actorName)
+	assert.True(t, ok)
+	assert.Equal(t, eventIndex, retrievedEventIndex)
+	assert.True(t, proto.Equal(snapshotData, retrievedSnapshot.(*p.Snapshot)))
+
+	// chunkが欠けていると、壊れたsnapshotは返さずにエラーにする
+	chunkKey := map[string]types.AttributeValue{
+		"chunkKey": &types.AttributeValueMemberS{Value: tableName + "#" + actorName},
+		"chunkId":  &types.AttributeValueMemberS{Value: fmt.Sprintf("%020d#%05d", eventIndex, 1)},
+	}
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: chunkKey, TableName: aws.String(p.DefaultChunkTable)})
+	assert.NoError(t, err)
+	_, ok, err = snapshotStore.LoadSnapshot(ctx, actorName)
+	assert.Error(t, err)
+	assert.False(t, ok)
+	assert.Panics(t, func() { snapshotStore.GetSnapshot(actorName) })
+
+	// クリーンアップ
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(tableName)})
+	assert.NoError(t, err)
+	for i := 0; i < chunks; i++ {
+		chunkKey["chunkId"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("%020d#%05d", eventIndex, i)}
+		_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: chunkKey, TableName: aws.String(p.DefaultChunkTable)})
+		assert.NoError(t, err)
+	}
+}
+
+func TestProviderState_PersistSnapshotFailure(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	leases := p.NewLeases(client, p.DefaultLeaseTable, "node-a", time.Minute)
+	opts := []p.Option{p.WithLeases(leases), p.WithCompaction(0, 1)}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	// leaseを持たないので書き込めないが、actorは止まらない
+	actorName := "testFailedSnapshotActor"
+	snapshot := &p.Snapshot{Data: "state"}
+	assert.ErrorIs(t, provider.SaveSnapshot(ctx, actorName, 3, snapshot), p.ErrLeaseLost)
+	assert.NotPanics(t, func() { provider.PersistSnapshot(actorName, 3, snapshot) })
+	provider.WaitForCompactions()
+	_, _, ok := provider.GetSnapshot(actorName)
+	assert.False(t, ok)
+}
@@ -0,0 +1,95 @@
+package persistence
+
+import (
+	"context"
+	"log"
+	"reflect"
+
+	"github.com/asynkron/protoactor-go/actor"
+	"google.golang.org/protobuf/proto"
+)
+
+// StateRecovered is delivered to an actor using UsingState before *actor.Started, if it has a stored state.
+type StateRecovered struct {
+	State    interface{}
+	Revision int64
+}
+
+type stateful interface {
+	initState(store *StateStore, name string, revision int64)
+}
+
+// StateMixin is embedded in actors that persist their latest state with UsingState.
+type StateMixin struct {
+	store    *StateStore
+	name     string
+	revision int64
+}
+
+var _ stateful = (*StateMixin)(nil)
+
+func (m *StateMixin) initState(store *StateStore, name string, revision int64) {
+	m.store = store
+	m.name = name
+	m.revision = revision
+}
+
+func (m *StateMixin) Name() string {
+	return m.name
+}
+
+// Revision returns the revision of the stored state, including a deleted one, or 0 if the actor never had a state.
+func (m *StateMixin) Revision() int64 {
+	return m.revision
+}
+
+// SaveState writes state as the next revision.
+// It returns ErrRevisionConflict if the state was changed by someone else since it was recovered or last saved.
+func (m *StateMixin) SaveState(state proto.Message) error {
+	revision, err := m.store.Upsert(context.Background(), m.name, m.revision, state)
+	if err != nil {
+		return err
+	}
+	m.revision = revision
+	return nil
+}
+
+// DeleteState deletes the stored state.
+// It returns ErrRevisionConflict if the state was changed by someone else since it was recovered or last saved.
+func (m *StateMixin) DeleteState() error {
+	revision, err := m.store.Delete(context.Background(), m.name, m.revision)
+	if err != nil {
+		return err
+	}
+	m.revision = revision
+	return nil
+}
+
+// UsingState loads the state of an actor embedding StateMixin when it starts, like persistence.Using does for event sourced actors.
+// The actor receives a *StateRecovered with its state before *actor.Started, and saves it with SaveState when it changes.
+func UsingState(store *StateStore) func(next actor.ReceiverFunc) actor.ReceiverFunc {
+	return func(next actor.ReceiverFunc) actor.ReceiverFunc {
+		return func(ctx actor.ReceiverContext, envelope *actor.MessageEnvelope) {
+			if _, ok := envelope.Message.(*actor.Started); !ok {
+				next(ctx, envelope)
+				return
+			}
+
+			s, ok := ctx.Actor().(stateful)
+			if !ok {
+				log.Fatalf("Actor type %v is not stateful", reflect.TypeOf(ctx.Actor()))
+			}
+			name := ctx.Self().Id
+			state, revision, err := store.Get(context.Background(), name)
+			if err != nil {
+				// TODO: エラーハンドリング
+				panic(err)
+			}
+			s.initState(store, name, revision)
+			if state != nil {
+				next(ctx, &actor.MessageEnvelope{Message: &StateRecovered{State: state, Revision: revision}})
+			}
+			next(ctx, envelope)
+		}
+	}
+}
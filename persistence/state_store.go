@@ -0,0 +1,125 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	DefaultStateTable = "state"
+
+	attrRevision     = "revision"
+	attrStateDeleted = "deleted"
+)
+
+// ErrRevisionConflict is returned by Upsert when the stored state is not at the expected revision.
+var ErrRevisionConflict = errors.New("state revision conflict")
+
+// StateStore keeps only the latest state of each actor, for actors that do not need an event log.
+// Every write increments the revision of the state, and writes are conditional on the revision they expect,
+// so that two incarnations of an actor do not overwrite each other. A deleted state is kept as a tombstone
+// with its revision, so that a write that expects a revision from before the delete still fails.
+//
+// Payloads are encoded like events and snapshots, except that they are not chunked or moved to the blob store.
+type StateStore struct {
+	itemTable
+}
+
+func NewStateStore(client *dynamodb.Client, table string, opts ...Option) *StateStore {
+	return &StateStore{
+		itemTable: itemTable{
+			client:  client,
+			table:   table,
+			options: newOptions(opts),
+		},
+	}
+}
+
+// Get returns the state of id and its revision, or a nil state and revision 0 if there is none.
+// A deleted state is returned as a nil state at the revision of its delete.
+func (s *StateStore) Get(ctx context.Context, id string) (interface{}, int64, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            stateKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if out.Item == nil {
+		return nil, 0, nil
+	}
+
+	revision, err := strconv.ParseInt(out.Item[attrRevision].(*types.AttributeValueMemberN).Value, 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, deleted := out.Item[attrStateDeleted]; deleted {
+		return nil, revision, nil
+	}
+	state, err := s.decodePayload(ctx, id, out.Item)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decode state of %s: %w", id, err)
+	}
+	return state, revision, nil
+}
+
+// Upsert writes state as the next revision of id and returns that revision.
+// expectedRevision is the revision returned by Get or the previous Upsert, or 0 if id has no state yet.
+func (s *StateStore) Upsert(ctx context.Context, id string, expectedRevision int64, state proto.Message) (int64, error) {
+	item, err := s.encodePayload(ctx, id, state)
+	if err != nil {
+		return 0, err
+	}
+	return s.put(ctx, id, expectedRevision, item)
+}
+
+// Delete replaces the state of id with a tombstone at the next revision and returns that revision.
+// Like Upsert, it fails with ErrRevisionConflict if the stored state is not at expectedRevision.
+// The next Upsert of id expects the returned revision.
+func (s *StateStore) Delete(ctx context.Context, id string, expectedRevision int64) (int64, error) {
+	return s.put(ctx, id, expectedRevision, map[string]types.AttributeValue{
+		attrStateDeleted: &types.AttributeValueMemberBOOL{Value: true},
+	})
+}
+
+// put writes item as the next revision of id, if the stored state is at expectedRevision.
+func (s *StateStore) put(ctx context.Context, id string, expectedRevision int64, item map[string]types.AttributeValue) (int64, error) {
+	revision := expectedRevision + 1
+	item["actorName"] = &types.AttributeValueMemberS{Value: id}
+	item[attrRevision] = &types.AttributeValueMemberN{Value: strconv.FormatInt(revision, 10)}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(actorName)"),
+	}
+	if expectedRevision > 0 {
+		input.ConditionExpression = aws.String("revision = :expected")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedRevision, 10)},
+		}
+	}
+	_, err := s.client.PutItem(ctx, input)
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return 0, fmt.Errorf("%w: %s is not at revision %d", ErrRevisionConflict, id, expectedRevision)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+func stateKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"actorName": &types.AttributeValueMemberS{Value: id},
+	}
+}
@@ -0,0 +1,143 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asynkron/protoactor-go/actor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStateStore(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	require.NoError(t, p.CreateTables(ctx, client))
+	store := p.NewStateStore(client, p.DefaultStateTable)
+
+	id := "testStateActor"
+	deleteState(t, client, id)
+
+	state, revision, err := store.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Nil(t, state)
+	assert.Equal(t, int64(0), revision)
+
+	revision, err = store.Upsert(ctx, id, 0, &p.Snapshot{Data: "state1"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), revision)
+	revision, err = store.Upsert(ctx, id, revision, &p.Snapshot{Data: "state2"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), revision)
+
+	state, revision, err = store.Get(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(&p.Snapshot{Data: "state2"}, state.(*p.Snapshot)))
+	assert.Equal(t, int64(2), revision)
+
+	// 古いrevisionを前提にした書き込みは失敗する
+	_, err = store.Upsert(ctx, id, 1, &p.Snapshot{Data: "stale"})
+	assert.ErrorIs(t, err, p.ErrRevisionConflict)
+	_, err = store.Upsert(ctx, id, 0, &p.Snapshot{Data: "stale"})
+	assert.ErrorIs(t, err, p.ErrRevisionConflict)
+
+	_, err = store.Delete(ctx, id, 1)
+	assert.ErrorIs(t, err, p.ErrRevisionConflict)
+	revision, err = store.Delete(ctx, id, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), revision)
+	state, revision, err = store.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Nil(t, state)
+	assert.Equal(t, int64(3), revision)
+
+	// 削除前のrevisionや、状態がないことを前提にした書き込みは、削除後も失敗する
+	_, err = store.Upsert(ctx, id, 2, &p.Snapshot{Data: "stale"})
+	assert.ErrorIs(t, err, p.ErrRevisionConflict)
+	_, err = store.Upsert(ctx, id, 0, &p.Snapshot{Data: "stale"})
+	assert.ErrorIs(t, err, p.ErrRevisionConflict)
+	revision, err = store.Upsert(ctx, id, 3, &p.Snapshot{Data: "state4"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), revision)
+
+	// クリーンアップ
+	deleteState(t, client, id)
+}
+
+// deleteState removes the item of id from the state table, including a tombstone.
+func deleteState(t *testing.T, client *dynamodb.Client, id string) {
+	_, err := client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(p.DefaultStateTable),
+		Key: map[string]types.AttributeValue{
+			"actorName": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	require.NoError(t, err)
+}
+
+type getState struct{}
+
+// counterActor keeps its count as its latest state instead of as events.
+type counterActor struct {
+	p.StateMixin
+	state *p.Snapshot
+}
+
+func (a *counterActor) Receive(ctx actor.Context) {
+	switch msg := ctx.Message().(type) {
+	case *p.StateRecovered:
+		a.state = msg.State.(*p.Snapshot)
+	case *actor.Started:
+		if a.state == nil {
+			a.state = &p.Snapshot{}
+		}
+	case *p.Event:
+		a.state = &p.Snapshot{Data: a.state.Data + msg.Data}
+		if err := a.SaveState(a.state); err != nil {
+			panic(err)
+		}
+	case *getState:
+		ctx.Respond([]interface{}{a.state.Data, a.Revision()})
+	}
+}
+
+func TestStateMixin(t *testing.T) {
+	ctx := context.Background()
+	system := actor.NewActorSystem()
+	client := InitializeDynamoDBClient()
+	require.NoError(t, p.CreateTables(ctx, client))
+	store := p.NewStateStore(client, p.DefaultStateTable)
+
+	actorName := "testStateMixinActor"
+	deleteState(t, client, actorName)
+	props := actor.PropsFromProducer(func() actor.Actor {
+		return &counterActor{}
+	}, actor.WithReceiverMiddleware(p.UsingState(store)))
+
+	pid, err := system.Root.SpawnNamed(props, actorName)
+	require.NoError(t, err)
+	system.Root.Send(pid, &p.Event{Data: "a"})
+	system.Root.Send(pid, &p.Event{Data: "b"})
+	result, err := system.Root.RequestFuture(pid, &getState{}, time.Second).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"ab", int64(2)}, result)
+	require.NoError(t, system.Root.StopFuture(pid).Wait())
+
+	// 再起動すると最新の状態から始まる
+	pid, err = system.Root.SpawnNamed(props, actorName)
+	require.NoError(t, err)
+	system.Root.Send(pid, &p.Event{Data: "c"})
+	result, err = system.Root.RequestFuture(pid, &getState{}, time.Second).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"abc", int64(3)}, result)
+	require.NoError(t, system.Root.StopFuture(pid).Wait())
+
+	// クリーンアップ
+	deleteState(t, client, actorName)
+}
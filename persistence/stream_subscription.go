@@ -0,0 +1,228 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+// StreamsAPI is the part of the DynamoDB Streams client a StreamSubscription uses.
+// *dynamodbstreams.Client implements it.
+type StreamsAPI interface {
+	DescribeStream(ctx context.Context, params *dynamodbstreams.DescribeStreamInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIterator(ctx context.Context, params *dynamodbstreams.GetShardIteratorInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecords(ctx context.Context, params *dynamodbstreams.GetRecordsInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+// StreamSubscription tails the inserts into the journal through its DynamoDB stream, which needs the NEW_IMAGE view.
+// Shards are read after their parent shard is finished, so the events of an actor are delivered in order across resharding.
+// The sequence number of the last delivered record of each shard is saved as its checkpoint.
+type StreamSubscription struct {
+	store       *EventStore
+	streams     StreamsAPI
+	streamARN   string
+	checkpoints CheckpointStore
+	// PollInterval is how long to wait after a round over all shards without new records.
+	PollInterval time.Duration
+	// StartFromLatest skips the records that are in the stream when a subscription without checkpoints starts.
+	StartFromLatest bool
+}
+
+func NewStreamSubscription(store *EventStore, streams StreamsAPI, streamARN string, checkpoints CheckpointStore) *StreamSubscription {
+	return &StreamSubscription{
+		store:        store,
+		streams:      streams,
+		streamARN:    streamARN,
+		checkpoints:  checkpoints,
+		PollInterval: defaultPollInterval,
+	}
+}
+
+// shardState is how far a shard has been read.
+// last is the sequence number of the last record read, which is kept even when no checkpoint is saved for it.
+type shardState struct {
+	iterator string
+	last     string
+	latest   bool
+	finished bool
+}
+
+// Run delivers events to sink until ctx is done or an error occurs.
+func (s *StreamSubscription) Run(ctx context.Context, sink Sink) error {
+	states := map[string]*shardState{}
+	first := true
+	for {
+		shards, err := s.describeShards(ctx)
+		if err != nil {
+			return err
+		}
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			if _, ok := states[id]; ok {
+				continue
+			}
+			states[id] = &shardState{}
+			if err := s.openShard(ctx, shard, states[id], first); err != nil {
+				return err
+			}
+		}
+
+		delivered := 0
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			state := states[id]
+			if state.finished {
+				continue
+			}
+			// 分割・統合されたshardは、親shardを読み終えてから読む。期限切れで消えた親は待たない
+			if parent, ok := states[aws.ToString(shard.ParentShardId)]; ok && !parent.finished {
+				continue
+			}
+
+			n, err := s.readShard(ctx, id, state, sink)
+			if err != nil {
+				return err
+			}
+			delivered += n
+		}
+		first = false
+
+		if delivered == 0 {
+			if err := sleep(ctx, s.PollInterval); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *StreamSubscription) describeShards(ctx context.Context) ([]streamtypes.Shard, error) {
+	var shards []streamtypes.Shard
+	var start *string
+	for {
+		out, err := s.streams.DescribeStream(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(s.streamARN),
+			ExclusiveStartShardId: start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("describe stream: %w", err)
+		}
+		shards = append(shards, out.StreamDescription.Shards...)
+		start = out.StreamDescription.LastEvaluatedShardId
+		if start == nil {
+			return shards, nil
+		}
+	}
+}
+
+// openShard gets the first iterator of a shard, from its checkpoint if it has one.
+func (s *StreamSubscription) openShard(ctx context.Context, shard streamtypes.Shard, state *shardState, first bool) error {
+	id := aws.ToString(shard.ShardId)
+	checkpoint, ok, err := s.checkpoints.Load(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(s.streamARN),
+		ShardId:           aws.String(id),
+		ShardIteratorType: streamtypes.ShardIteratorTypeTrimHorizon,
+	}
+	switch {
+	case ok:
+		input.ShardIteratorType = streamtypes.ShardIteratorTypeAfterSequenceNumber
+		input.SequenceNumber = aws.String(checkpoint)
+	case first && s.StartFromLatest:
+		if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+			// 閉じたshardには新しいrecordが来ない
+			state.finished = true
+			return nil
+		}
+		input.ShardIteratorType = streamtypes.ShardIteratorTypeLatest
+		state.latest = true
+	}
+	return s.shardIterator(ctx, input, state)
+}
+
+// reopenShard gets a new iterator for a shard whose iterator expired, after the last record read from it.
+func (s *StreamSubscription) reopenShard(ctx context.Context, id string, state *shardState) error {
+	if state.last == "" {
+		// まだ何も読んでいなければ、開いた時と同じ位置から読む
+		return s.openShard(ctx, streamtypes.Shard{ShardId: aws.String(id)}, state, state.latest)
+	}
+	return s.shardIterator(ctx, &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(s.streamARN),
+		ShardId:           aws.String(id),
+		ShardIteratorType: streamtypes.ShardIteratorTypeAfterSequenceNumber,
+		SequenceNumber:    aws.String(state.last),
+	}, state)
+}
+
+func (s *StreamSubscription) shardIterator(ctx context.Context, input *dynamodbstreams.GetShardIteratorInput, state *shardState) error {
+	out, err := s.streams.GetShardIterator(ctx, input)
+	if err != nil {
+		return fmt.Errorf("get shard iterator of %s: %w", aws.ToString(input.ShardId), err)
+	}
+	if out.ShardIterator == nil {
+		state.finished = true
+		return nil
+	}
+	state.iterator = aws.ToString(out.ShardIterator)
+	return nil
+}
+
+// readShard reads one batch of records of a shard and delivers the inserted events.
+func (s *StreamSubscription) readShard(ctx context.Context, id string, state *shardState, sink Sink) (int, error) {
+	out, err := s.streams.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{
+		ShardIterator: aws.String(state.iterator),
+	})
+	var expired *streamtypes.ExpiredIteratorException
+	if errors.As(err, &expired) {
+		// iteratorは15分で切れるので、最後に読んだrecordの後から取り直す
+		return 0, s.reopenShard(ctx, id, state)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get records of %s: %w", id, err)
+	}
+
+	delivered := 0
+	var last string
+	for _, record := range out.Records {
+		last = aws.ToString(record.Dynamodb.SequenceNumber)
+		if record.EventName != streamtypes.OperationTypeInsert || record.Dynamodb.NewImage == nil {
+			continue
+		}
+		item, err := attributevalue.FromDynamoDBStreamsMap(record.Dynamodb.NewImage)
+		if err != nil {
+			return delivered, err
+		}
+		envelopes, err := s.store.envelopes(ctx, item)
+		if err != nil {
+			return delivered, err
+		}
+		for _, envelope := range envelopes {
+			if err := sink(ctx, envelope); err != nil {
+				return delivered, err
+			}
+			delivered++
+		}
+	}
+	if last != "" {
+		state.last = last
+		if err := s.checkpoints.Save(ctx, id, last); err != nil {
+			return delivered, err
+		}
+	}
+
+	if out.NextShardIterator == nil {
+		state.finished = true
+	} else {
+		state.iterator = aws.ToString(out.NextShardIterator)
+	}
+	return delivered, nil
+}
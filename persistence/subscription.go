@@ -0,0 +1,197 @@
+package persistence
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/asynkron/protoactor-go/actor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	DefaultCheckpointTable = "checkpoints"
+
+	defaultPollInterval = time.Second
+	pollCheckpointKey   = "poll"
+)
+
+// Sink receives the events delivered by a subscription.
+// An event is delivered again after a restart if the sink returned before its checkpoint was saved.
+type Sink func(ctx context.Context, envelope EventEnvelope) error
+
+// ChannelSink delivers events to c, waiting until they are received.
+func ChannelSink(c chan<- EventEnvelope) Sink {
+	return func(ctx context.Context, envelope EventEnvelope) error {
+		select {
+		case c <- envelope:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// PIDSink sends each event to pid as an *EventEnvelope.
+func PIDSink(sender actor.SenderContext, pid *actor.PID) Sink {
+	return func(_ context.Context, envelope EventEnvelope) error {
+		sender.Send(pid, &envelope)
+		return nil
+	}
+}
+
+// CheckpointStore remembers how far a subscription has delivered, per shard or per poller.
+type CheckpointStore interface {
+	Load(ctx context.Context, key string) (checkpoint string, ok bool, err error)
+	Save(ctx context.Context, key string, checkpoint string) error
+}
+
+// MemoryCheckpointStore keeps checkpoints in memory, e.g. for subscriptions that start from the latest event on every run.
+type MemoryCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints map[string]string
+}
+
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{checkpoints: map[string]string{}}
+}
+
+func (m *MemoryCheckpointStore) Load(_ context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	checkpoint, ok := m.checkpoints[key]
+	return checkpoint, ok, nil
+}
+
+func (m *MemoryCheckpointStore) Save(_ context.Context, key string, checkpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoints[key] = checkpoint
+	return nil
+}
+
+// DynamoDBCheckpointStore keeps the checkpoints of the subscription named name in a table with a "name" hash key.
+type DynamoDBCheckpointStore struct {
+	client *dynamodb.Client
+	table  string
+	name   string
+}
+
+func NewDynamoDBCheckpointStore(client *dynamodb.Client, table string, name string) *DynamoDBCheckpointStore {
+	return &DynamoDBCheckpointStore{client: client, table: table, name: name}
+}
+
+func (d *DynamoDBCheckpointStore) Load(ctx context.Context, key string) (string, bool, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]types.AttributeValue{
+			"name": &types.AttributeValueMemberS{Value: d.name + "#" + key},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	checkpoint, ok := out.Item["checkpoint"].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", false, nil
+	}
+	return checkpoint.Value, true, nil
+}
+
+func (d *DynamoDBCheckpointStore) Save(ctx context.Context, key string, checkpoint string) error {
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]types.AttributeValue{
+			"name":       &types.AttributeValueMemberS{Value: d.name + "#" + key},
+			"checkpoint": &types.AttributeValueMemberS{Value: checkpoint},
+		},
+	})
+	return err
+}
+
+// PollFunc reads the events written after position and returns the position to continue from,
+// which equals position when there are no new events.
+type PollFunc func(ctx context.Context, position int64) ([]EventEnvelope, int64, error)
+
+// EventsSincePoller polls the journal in the order of the global sequence. It needs WithGlobalSequence.
+func (e *EventStore) EventsSincePoller() PollFunc {
+	return func(ctx context.Context, position int64) ([]EventEnvelope, int64, error) {
+		page, err := e.EventsSince(ctx, position)
+		if err != nil {
+			return nil, 0, err
+		}
+		envelopes := make([]EventEnvelope, 0, len(page.Events))
+		for _, event := range page.Events {
+			envelopes = append(envelopes, event.EventEnvelope)
+		}
+		return envelopes, page.NextSeq, nil
+	}
+}
+
+// PollingSubscription delivers new events by polling, for environments without DynamoDB Streams.
+type PollingSubscription struct {
+	poll        PollFunc
+	checkpoints CheckpointStore
+	// PollInterval is how long to wait after a poll without new events.
+	PollInterval time.Duration
+}
+
+func NewPollingSubscription(poll PollFunc, checkpoints CheckpointStore) *PollingSubscription {
+	return &PollingSubscription{
+		poll:         poll,
+		checkpoints:  checkpoints,
+		PollInterval: defaultPollInterval,
+	}
+}
+
+// Run delivers events to sink from the saved checkpoint until ctx is done or an error occurs.
+func (p *PollingSubscription) Run(ctx context.Context, sink Sink) error {
+	var position int64
+	checkpoint, ok, err := p.checkpoints.Load(ctx, pollCheckpointKey)
+	if err != nil {
+		return err
+	}
+	if ok {
+		position, err = strconv.ParseInt(checkpoint, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		envelopes, next, err := p.poll(ctx, position)
+		if err != nil {
+			return err
+		}
+		for _, envelope := range envelopes {
+			if err := sink(ctx, envelope); err != nil {
+				return err
+			}
+		}
+		if next == position {
+			if err := sleep(ctx, p.PollInterval); err != nil {
+				return err
+			}
+			continue
+		}
+		position = next
+		if err := p.checkpoints.Save(ctx, pollCheckpointKey, strconv.FormatInt(position, 10)); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,354 @@
+package persistence_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asynkron/protoactor-go/actor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+type fakeShard struct {
+	id      string
+	parent  string
+	records []streamtypes.Record
+	closed  bool
+}
+
+// fakeStreams is an in-memory DynamoDB stream. GetRecords returns at most two records per call.
+type fakeStreams struct {
+	mu     sync.Mutex
+	shards []*fakeShard
+	seq    int
+	// opened receives the ID of each shard an iterator is requested for
+	opened chan string
+	// expire makes the next GetRecords fail as if the iterator had expired
+	expire bool
+}
+
+func (f *fakeStreams) addShard(id string, parent string) *fakeShard {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shard := &fakeShard{id: id, parent: parent}
+	f.shards = append(f.shards, shard)
+	return shard
+}
+
+func (f *fakeStreams) insert(shard *fakeShard, actorName string, eventIndex int, data string) {
+	f.record(shard, streamtypes.OperationTypeInsert, actorName, eventIndex, data)
+}
+
+func (f *fakeStreams) record(shard *fakeShard, operation streamtypes.OperationType, actorName string, eventIndex int, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	shard.records = append(shard.records, streamtypes.Record{
+		EventName: operation,
+		Dynamodb: &streamtypes.StreamRecord{
+			SequenceNumber: aws.String(fmt.Sprintf("%05d", f.seq)),
+			NewImage: map[string]streamtypes.AttributeValue{
+				"actorName":  &streamtypes.AttributeValueMemberS{Value: actorName},
+				"eventIndex": &streamtypes.AttributeValueMemberN{Value: strconv.Itoa(eventIndex)},
+				"payload":    &streamtypes.AttributeValueMemberB{Value: encodeEvent(&p.Event{Data: data})},
+			},
+		},
+	})
+}
+
+func (f *fakeStreams) DescribeStream(_ context.Context, _ *dynamodbstreams.DescribeStreamInput, _ ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var shards []streamtypes.Shard
+	for _, s := range f.shards {
+		shard := streamtypes.Shard{ShardId: aws.String(s.id), SequenceNumberRange: &streamtypes.SequenceNumberRange{}}
+		if s.parent != "" {
+			shard.ParentShardId = aws.String(s.parent)
+		}
+		if s.closed {
+			shard.SequenceNumberRange.EndingSequenceNumber = aws.String("99999")
+		}
+		shards = append(shards, shard)
+	}
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: &streamtypes.StreamDescription{Shards: shards}}, nil
+}
+
+func (f *fakeStreams) GetShardIterator(_ context.Context, params *dynamodbstreams.GetShardIteratorInput, _ ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	f.mu.Lock()
+	shard := f.shard(aws.ToString(params.ShardId))
+	position := 0
+	switch params.ShardIteratorType {
+	case streamtypes.ShardIteratorTypeLatest:
+		position = len(shard.records)
+	case streamtypes.ShardIteratorTypeAfterSequenceNumber:
+		for i, r := range shard.records {
+			if aws.ToString(r.Dynamodb.SequenceNumber) == aws.ToString(params.SequenceNumber) {
+				position = i + 1
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	if f.opened != nil {
+		f.opened <- shard.id
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s:%d", shard.id, position))}, nil
+}
+
+func (f *fakeStreams) GetRecords(_ context.Context, params *dynamodbstreams.GetRecordsInput, _ ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.expire {
+		f.expire = false
+		return nil, &streamtypes.ExpiredIteratorException{Message: aws.String("iterator expired")}
+	}
+	id, pos, _ := strings.Cut(aws.ToString(params.ShardIterator), ":")
+	position, _ := strconv.Atoi(pos)
+	shard := f.shard(id)
+
+	end := min(position+2, len(shard.records))
+	out := &dynamodbstreams.GetRecordsOutput{Records: shard.records[position:end]}
+	if !shard.closed || end < len(shard.records) {
+		out.NextShardIterator = aws.String(fmt.Sprintf("%s:%d", id, end))
+	}
+	return out, nil
+}
+
+func (f *fakeStreams) shard(id string) *fakeShard {
+	for _, s := range f.shards {
+		if s.id == id {
+			return s
+		}
+	}
+	panic("unknown shard " + id)
+}
+
+// collect runs subscription until n events are delivered and returns their data.
+func collect(t *testing.T, run func(ctx context.Context, sink p.Sink) error, n int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var data []string
+	err := run(ctx, func(_ context.Context, envelope p.EventEnvelope) error {
+		data = append(data, fmt.Sprintf("%s/%d/%s", envelope.ActorName, envelope.EventIndex, envelope.Event.(*p.Event).Data))
+		if len(data) == n {
+			cancel()
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	return data
+}
+
+func TestStreamSubscription_Resharding(t *testing.T) {
+	streams := &fakeStreams{}
+	// 子shardが親shardより先に返っても、親から読む
+	parent := &fakeShard{id: "shard-0", closed: true}
+	child := streams.addShard("shard-1", "shard-0")
+	streams.shards = append(streams.shards, parent)
+
+	streams.insert(parent, "actor-1", 0, "a")
+	streams.insert(parent, "actor-1", 1, "b")
+	streams.record(parent, streamtypes.OperationTypeRemove, "actor-1", 0, "")
+	streams.insert(parent, "actor-2", 0, "c")
+	streams.insert(child, "actor-1", 2, "d")
+	streams.insert(child, "actor-2", 1, "e")
+
+	store := p.NewEventStore(nil, p.DefaultJournalTable)
+	checkpoints := p.NewMemoryCheckpointStore()
+	subscription := p.NewStreamSubscription(store, streams, "arn", checkpoints)
+	subscription.PollInterval = 10 * time.Millisecond
+
+	data := collect(t, subscription.Run, 5)
+	assert.Equal(t, []string{"actor-1/0/a", "actor-1/1/b", "actor-2/0/c", "actor-1/2/d", "actor-2/1/e"}, data)
+
+	// checkpointから再開すると、新しいrecordだけが届く
+	streams.insert(child, "actor-1", 3, "f")
+	subscription = p.NewStreamSubscription(store, streams, "arn", checkpoints)
+	subscription.PollInterval = 10 * time.Millisecond
+	data = collect(t, subscription.Run, 1)
+	assert.Equal(t, []string{"actor-1/3/f"}, data)
+}
+
+func TestStreamSubscription_StartFromLatest(t *testing.T) {
+	streams := &fakeStreams{opened: make(chan string, 10)}
+	closed := streams.addShard("shard-0", "")
+	closed.closed = true
+	open := streams.addShard("shard-1", "shard-0")
+	streams.insert(closed, "actor-1", 0, "old")
+	streams.insert(open, "actor-1", 1, "old")
+
+	store := p.NewEventStore(nil, p.DefaultJournalTable)
+	subscription := p.NewStreamSubscription(store, streams, "arn", p.NewMemoryCheckpointStore())
+	subscription.PollInterval = 10 * time.Millisecond
+	subscription.StartFromLatest = true
+
+	go func() {
+		// 開いているshardのiteratorが取られてから書く
+		for id := range streams.opened {
+			if id == "shard-1" {
+				streams.insert(open, "actor-1", 2, "new")
+				return
+			}
+		}
+	}()
+	data := collect(t, subscription.Run, 1)
+	assert.Equal(t, []string{"actor-1/2/new"}, data)
+}
+
+// discardCheckpoints is a CheckpointStore that saves nothing.
+type discardCheckpoints struct{}
+
+func (discardCheckpoints) Load(context.Context, string) (string, bool, error) { return "", false, nil }
+
+func (discardCheckpoints) Save(context.Context, string, string) error { return nil }
+
+func TestStreamSubscription_ExpiredIterator(t *testing.T) {
+	streams := &fakeStreams{opened: make(chan string, 10)}
+	shard := streams.addShard("shard-0", "")
+	streams.insert(shard, "actor-1", 0, "old")
+
+	store := p.NewEventStore(nil, p.DefaultJournalTable)
+	subscription := p.NewStreamSubscription(store, streams, "arn", discardCheckpoints{})
+	subscription.PollInterval = 10 * time.Millisecond
+	subscription.StartFromLatest = true
+
+	go func() {
+		<-streams.opened
+		streams.insert(shard, "actor-1", 1, "new")
+	}()
+	expired := false
+	run := func(ctx context.Context, sink p.Sink) error {
+		return subscription.Run(ctx, func(ctx context.Context, envelope p.EventEnvelope) error {
+			if !expired {
+				// checkpointのない位置でiteratorが切れても、最後に読んだrecordの後から読み直す
+				expired = true
+				streams.mu.Lock()
+				streams.expire = true
+				streams.mu.Unlock()
+				streams.insert(shard, "actor-1", 2, "after expiry")
+			}
+			return sink(ctx, envelope)
+		})
+	}
+	data := collect(t, run, 2)
+	assert.Equal(t, []string{"actor-1/1/new", "actor-1/2/after expiry"}, data)
+}
+
+// fakeJournal is an in-memory journal ordered by position.
+type fakeJournal struct {
+	mu     sync.Mutex
+	events []p.EventEnvelope
+}
+
+func (f *fakeJournal) append(actorName string, eventIndex int, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, p.EventEnvelope{ActorName: actorName, EventIndex: eventIndex, Event: &p.Event{Data: data}})
+}
+
+func (f *fakeJournal) poll(_ context.Context, position int64) ([]p.EventEnvelope, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := min(int(position)+2, len(f.events))
+	return f.events[position:end], int64(end), nil
+}
+
+func TestPollingSubscription(t *testing.T) {
+	journal := &fakeJournal{}
+	journal.append("actor-1", 0, "a")
+	journal.append("actor-2", 0, "b")
+	journal.append("actor-1", 1, "c")
+
+	checkpoints := p.NewMemoryCheckpointStore()
+	subscription := p.NewPollingSubscription(journal.poll, checkpoints)
+	subscription.PollInterval = 10 * time.Millisecond
+	data := collect(t, subscription.Run, 3)
+	assert.Equal(t, []string{"actor-1/0/a", "actor-2/0/b", "actor-1/1/c"}, data)
+
+	// checkpointから再開すると、新しいeventだけが届く
+	journal.append("actor-2", 1, "d")
+	subscription = p.NewPollingSubscription(journal.poll, checkpoints)
+	subscription.PollInterval = 10 * time.Millisecond
+	data = collect(t, subscription.Run, 1)
+	assert.Equal(t, []string{"actor-2/1/d"}, data)
+}
+
+func TestPIDSink(t *testing.T) {
+	system := actor.NewActorSystem()
+	received := make(chan *p.EventEnvelope, 1)
+	pid := system.Root.Spawn(actor.PropsFromFunc(func(ctx actor.Context) {
+		if envelope, ok := ctx.Message().(*p.EventEnvelope); ok {
+			received <- envelope
+		}
+	}))
+
+	sink := p.PIDSink(system.Root, pid)
+	require.NoError(t, sink(context.Background(), p.EventEnvelope{ActorName: "actor-1", Event: &p.Event{Data: "a"}}))
+
+	select {
+	case envelope := <-received:
+		assert.Equal(t, "actor-1", envelope.ActorName)
+	case <-time.After(time.Second):
+		t.Fatal("event was not delivered")
+	}
+}
+
+func TestStreamSubscription_LocalStack(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	require.NoError(t, p.CreateTables(ctx, client))
+
+	table, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(p.DefaultJournalTable)})
+	require.NoError(t, err)
+	require.NotNil(t, table.Table.LatestStreamArn, "journal has no stream")
+
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion("us-east-1"),
+		config.WithCredentialsProvider(aws.AnonymousCredentials{}),
+	)
+	require.NoError(t, err)
+	streams := dynamodbstreams.NewFromConfig(cfg, func(o *dynamodbstreams.Options) {
+		o.BaseEndpoint = aws.String("http://localhost:4566")
+	})
+
+	store := p.NewEventStore(client, p.DefaultJournalTable)
+	subscription := p.NewStreamSubscription(store, streams, aws.ToString(table.Table.LatestStreamArn), p.NewMemoryCheckpointStore())
+	subscription.PollInterval = 100 * time.Millisecond
+	subscription.StartFromLatest = true
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	events := make(chan p.EventEnvelope)
+	go subscription.Run(ctx, p.ChannelSink(events))
+
+	// subscriptionがLATESTの位置を取るまで待ってから書く
+	time.Sleep(time.Second)
+	actorName := "testSubscriptionActor"
+	store.PersistEvent(actorName, 0, &p.Event{Data: "event1"})
+
+	for {
+		select {
+		case envelope := <-events:
+			if envelope.ActorName != actorName {
+				continue
+			}
+			assert.Equal(t, "event1", envelope.Event.(*p.Event).Data)
+			deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+			return
+		case <-ctx.Done():
+			t.Fatal("event was not delivered")
+		}
+	}
+}
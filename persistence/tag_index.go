@@ -0,0 +1,222 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// TagTableSuffix is appended to the name of the journal table to name its tag table,
+	// which holds one row per tag of each event and is what EventsByTag queries.
+	// A global secondary index on the journal can index only one tag attribute per item,
+	// so events with several tags need a table of their own.
+	TagTableSuffix = "_tags"
+
+	attrTag       = "tag"
+	attrTagOffset = "tagOffset"
+
+	// offsetTimeFormat has a fixed width, so that offsets sort in the order of their write time.
+	offsetTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+	eventsByTagPageSize = 100
+)
+
+// TaggedEvent is an event found by EventsByTag with its offset in the tag.
+type TaggedEvent struct {
+	EventEnvelope
+	Offset string
+}
+
+// TaggedEventsPage is a page of EventsByTag.
+// NextOffset continues with the next page, and equals the requested offset when there are no more events for now.
+type TaggedEventsPage struct {
+	Events     []TaggedEvent
+	NextOffset string
+}
+
+// tagTableName returns the name of the tag table of the journal table journal.
+func tagTableName(journal string) string {
+	return journal + TagTableSuffix
+}
+
+// tagTable returns the name of the tag table of the journal.
+func (e *EventStore) tagTable() string {
+	return tagTableName(e.table)
+}
+
+// tagRowKey returns the key of the row of the tag table for an event written at writtenAt.
+// The offset ends with the actor name and the event index, so that it is unique even if two events are written at the same time.
+func tagRowKey(tag string, writtenAt time.Time, actorName string, eventIndex int) map[string]types.AttributeValue {
+	offset := fmt.Sprintf("%s#%s#%020d", writtenAt.UTC().Format(offsetTimeFormat), actorName, eventIndex)
+	return map[string]types.AttributeValue{
+		attrTag:       &types.AttributeValueMemberS{Value: tag},
+		attrTagOffset: &types.AttributeValueMemberS{Value: offset},
+	}
+}
+
+// tagRowKeys returns the keys of the rows of the tag table for a journal item, one for each of its tags.
+func tagRowKeys(item map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	tags, ok := item[attrTags].(*types.AttributeValueMemberSS)
+	if !ok {
+		return nil, nil
+	}
+	writtenAtAttr, ok := item[attrWrittenAt].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, fmt.Errorf("tagged item has no %s", attrWrittenAt)
+	}
+	writtenAt, err := time.Parse(time.RFC3339Nano, writtenAtAttr.Value)
+	if err != nil {
+		return nil, err
+	}
+	eventIndex, err := itemEventIndex(item)
+	if err != nil {
+		return nil, err
+	}
+	actorName := item["actorName"].(*types.AttributeValueMemberS).Value
+	keys := make([]map[string]types.AttributeValue, 0, len(tags.Value))
+	for _, tag := range tags.Value {
+		keys = append(keys, tagRowKey(tag, writtenAt, actorName, eventIndex))
+	}
+	return keys, nil
+}
+
+// tagWrites returns the writes of the rows of the tag table for a journal item, which are written in the transaction of the item.
+// The rows point to the item by its key, and expire with it under WithTTL.
+func (e *EventStore) tagWrites(item map[string]types.AttributeValue) ([]types.TransactWriteItem, error) {
+	keys, err := tagRowKeys(item)
+	if err != nil {
+		return nil, err
+	}
+	writes := make([]types.TransactWriteItem, 0, len(keys))
+	for _, row := range keys {
+		row["actorName"] = item["actorName"]
+		row["eventIndex"] = item["eventIndex"]
+		if e.options.ttl != nil {
+			if expiry, ok := e.options.ttl.expiry(item["actorName"].(*types.AttributeValueMemberS).Value, e.options.clock()); ok {
+				row[e.options.ttl.attribute] = expiry
+			}
+		}
+		writes = append(writes, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(e.tagTable()),
+				Item:      row,
+			},
+		})
+	}
+	return writes, nil
+}
+
+// deleteTagRows deletes the rows of the tag table for journal items that were deleted.
+func deleteTagRows(ctx context.Context, client *dynamodb.Client, table string, items []map[string]types.AttributeValue) error {
+	var requests []types.WriteRequest
+	for _, item := range items {
+		keys, err := tagRowKeys(item)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+		}
+	}
+	if err := batchWrite(ctx, client, table, requests); err != nil {
+		return fmt.Errorf("delete tags from %s: %w", table, err)
+	}
+	return nil
+}
+
+// EventsByTag returns the next page of events tagged with tag, in the order they were written, after fromOffset.
+// An empty fromOffset starts from the first event.
+//
+// Every tag returned by the Tagger is indexed in the tag table of the journal. Rows whose event has been deleted
+// are skipped, but still move NextOffset forward. Offsets come from the clocks of the writers, so events written
+// concurrently on nodes whose clocks differ may appear behind an offset that was already read.
+func (e *EventStore) EventsByTag(ctx context.Context, tag string, fromOffset string) (*TaggedEventsPage, error) {
+	keyConditionExpression := "#tag = :tag"
+	expressionAttributeValues := map[string]types.AttributeValue{
+		":tag": &types.AttributeValueMemberS{Value: tag},
+	}
+	if fromOffset != "" {
+		keyConditionExpression += " AND tagOffset > :fromOffset"
+		expressionAttributeValues[":fromOffset"] = &types.AttributeValueMemberS{Value: fromOffset}
+	}
+
+	resp, err := e.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(e.tagTable()),
+		KeyConditionExpression:    aws.String(keyConditionExpression),
+		ExpressionAttributeNames:  map[string]string{"#tag": attrTag},
+		ExpressionAttributeValues: expressionAttributeValues,
+		Limit:                     aws.Int32(eventsByTagPageSize),
+	})
+	if err != nil {
+		return nil, err
+	}
+	items, err := e.getItems(ctx, resp.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &TaggedEventsPage{NextOffset: fromOffset}
+	for _, row := range resp.Items {
+		offset := row[attrTagOffset].(*types.AttributeValueMemberS).Value
+		page.NextOffset = offset
+
+		item, ok := items[journalKey(row)]
+		if !ok {
+			continue
+		}
+		envelopes, err := e.envelopes(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		for _, envelope := range envelopes {
+			page.Events = append(page.Events, TaggedEvent{EventEnvelope: envelope, Offset: offset})
+		}
+	}
+	return page, nil
+}
+
+// journalKey identifies a journal item by the actor name and the event index of a row or an item.
+func journalKey(item map[string]types.AttributeValue) string {
+	return item["actorName"].(*types.AttributeValueMemberS).Value + "#" + item["eventIndex"].(*types.AttributeValueMemberN).Value
+}
+
+// getItems reads the journal items the rows of the tag table point to with BatchGetItem, keyed by journalKey.
+// Keys DynamoDB leaves unprocessed are read again with exponential backoff.
+func (e *EventStore) getItems(ctx context.Context, rows []map[string]types.AttributeValue) (map[string]map[string]types.AttributeValue, error) {
+	items := make(map[string]map[string]types.AttributeValue, len(rows))
+	keys := make([]map[string]types.AttributeValue, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, map[string]types.AttributeValue{
+			"actorName":  row["actorName"],
+			"eventIndex": row["eventIndex"],
+		})
+	}
+	backoff := batchWriteBackoff
+	for attempt := 1; len(keys) > 0; attempt++ {
+		if attempt > batchWriteAttempts {
+			return nil, fmt.Errorf("%d items left unprocessed after %d attempts", len(keys), batchWriteAttempts)
+		}
+		if attempt > 1 {
+			if err := sleep(ctx, backoff); err != nil {
+				return nil, err
+			}
+			backoff *= 2
+		}
+		out, err := e.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]types.KeysAndAttributes{e.table: {Keys: keys, ConsistentRead: aws.Bool(true)}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Responses[e.table] {
+			items[journalKey(item)] = item
+		}
+		keys = out.UnprocessedKeys[e.table].Keys
+	}
+	return items, nil
+}
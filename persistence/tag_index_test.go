@@ -0,0 +1,83 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+func TestProviderState_EventsByTag(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	// 1件ごとに1秒進む時計
+	now := time.Date(2024, 4, 13, 4, 54, 29, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	tagger := func(event interface{}) []string {
+		if e := event.(*p.Event); e.Type == "CreateUserAccount" {
+			return []string{"user", "user-registered"}
+		}
+		return []string{"user"}
+	}
+	opts := []p.Option{p.WithClock(clock), p.WithTagger(tagger)}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+
+	// 複数のactorのeventが書き込み順に並ぶ
+	provider.PersistEvent("testTagActor-1", 0, &p.Event{Type: "CreateUserAccount", Data: "alice"})
+	provider.PersistEvent("testTagActor-2", 0, &p.Event{Type: "CreateUserAccount", Data: "bob"})
+	provider.PersistEvent("testTagActor-1", 1, &p.Event{Type: "ChangeEmail", Data: "alice@example.com"})
+	provider.PersistEvent("testTagActor-1", 2, &p.Event{Type: "CreateUserAccount", Data: "alice again"})
+
+	// tagの行はeventと同じtransactionで書かれるので、すぐに読める
+	page, err := provider.EventsByTag(ctx, "user-registered", "")
+	require.NoError(t, err)
+	require.Len(t, page.Events, 3)
+
+	var data []string
+	for _, e := range page.Events {
+		data = append(data, e.Event.(*p.Event).Data)
+	}
+	assert.Equal(t, []string{"alice", "bob", "alice again"}, data)
+	assert.Equal(t, "testTagActor-2", page.Events[1].ActorName)
+	assert.Equal(t, 2, page.Events[2].EventIndex)
+	assert.Equal(t, page.Events[2].Offset, page.NextOffset)
+
+	// offsetから続きを読む
+	next, err := provider.EventsByTag(ctx, "user-registered", page.Events[0].Offset)
+	require.NoError(t, err)
+	require.Len(t, next.Events, 2)
+	assert.Equal(t, "bob", next.Events[0].Event.(*p.Event).Data)
+
+	// 最後まで読んだら空のpage
+	last, err := provider.EventsByTag(ctx, "user-registered", page.NextOffset)
+	require.NoError(t, err)
+	assert.Empty(t, last.Events)
+	assert.Equal(t, page.NextOffset, last.NextOffset)
+
+	// 1つ目以外のtagでも読める
+	users, err := provider.EventsByTag(ctx, "user", "")
+	require.NoError(t, err)
+	require.Len(t, users.Events, 4)
+	assert.Equal(t, "alice@example.com", users.Events[2].Event.(*p.Event).Data)
+
+	// 消したeventはtagの行も消える
+	provider.DeleteEvents("testTagActor-2", 0)
+	page, err = provider.EventsByTag(ctx, "user-registered", "")
+	require.NoError(t, err)
+	require.Len(t, page.Events, 2)
+	assert.Equal(t, "alice again", page.Events[1].Event.(*p.Event).Data)
+
+	// クリーンアップ
+	for _, actorName := range []string{"testTagActor-1", "testTagActor-2"} {
+		_, err := provider.PurgeActor(ctx, actorName)
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,108 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	attrDeleted       = "deleted"
+	attrDeletedReason = "deletedReason"
+	attrDeletedAt     = "deletedAt"
+)
+
+// Tombstone marks an event that was hidden by TombstoneEvents instead of being removed.
+type Tombstone struct {
+	Reason    string
+	DeletedAt time.Time
+}
+
+// TombstoneEvents hides the events of actorName up to inclusiveToIndex and returns how many it hid.
+// The items stay in the journal with a tombstone that records reason and the time. GetEvents replays them as SkippedEvents,
+// and ReadEvents, queries and subscriptions skip them; ReadEventsIncludingDeleted still returns them. Events that already have
+// a tombstone keep it. PurgeEvents removes them physically.
+func (e *EventStore) TombstoneEvents(ctx context.Context, actorName string, inclusiveToIndex int, reason string) (int, error) {
+	paginator := dynamodb.NewQueryPaginator(e.client, &dynamodb.QueryInput{
+		TableName:              aws.String(e.table),
+		KeyConditionExpression: aws.String("actorName = :actorName AND eventIndex <= :to"),
+		FilterExpression:       aws.String("attribute_not_exists(deleted)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actorName": &types.AttributeValueMemberS{Value: actorName},
+			":to":        &types.AttributeValueMemberN{Value: strconv.Itoa(inclusiveToIndex)},
+		},
+		ProjectionExpression: aws.String("actorName, eventIndex"),
+	})
+
+	deletedAt := &types.AttributeValueMemberS{Value: e.options.clock().UTC().Format(time.RFC3339Nano)}
+	tombstoned := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return tombstoned, err
+		}
+		for _, item := range page.Items {
+			_, err := e.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName: aws.String(e.table),
+				Key: map[string]types.AttributeValue{
+					"actorName":  item["actorName"],
+					"eventIndex": item["eventIndex"],
+				},
+				UpdateExpression: aws.String("SET deleted = :deleted, deletedReason = :reason, deletedAt = :deletedAt"),
+				// 並行してpurgeされたitemを作り直さない
+				ConditionExpression: aws.String("attribute_exists(actorName) AND attribute_not_exists(deleted)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":deleted":   &types.AttributeValueMemberBOOL{Value: true},
+					":reason":    &types.AttributeValueMemberS{Value: reason},
+					":deletedAt": deletedAt,
+				},
+			})
+			var conditionErr *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				continue
+			}
+			if err != nil {
+				return tombstoned, fmt.Errorf("tombstone events of %s: %w", actorName, err)
+			}
+			tombstoned++
+		}
+	}
+	return tombstoned, nil
+}
+
+// PurgeEvents removes the events of actorName up to inclusiveToIndex from the journal, whether they have a tombstone or not,
+// together with their chunks and blobs, and returns how many it removed. It is what DeleteEvents does without WithSoftDelete.
+func (e *EventStore) PurgeEvents(ctx context.Context, actorName string, inclusiveToIndex int) (int, error) {
+	return e.deleteEvents(ctx, actorName, inclusiveToIndex, nil)
+}
+
+// ReadEventsIncludingDeleted reads events like ReadEvents, including the events hidden by TombstoneEvents,
+// which carry their Tombstone in EventMetadata. It is meant for audits and administration, not for recovery.
+func (e *EventStore) ReadEventsIncludingDeleted(ctx context.Context, actorName string, eventIndexStart int, eventIndexEnd int, callback func(envelope EventEnvelope) error) error {
+	return e.readEvents(ctx, actorName, eventIndexStart, eventIndexEnd, true, skipping(callback))
+}
+
+// readTombstone reads the tombstone of a journal item, or nil if it has none.
+func readTombstone(item map[string]types.AttributeValue) (*Tombstone, error) {
+	if v, ok := item[attrDeleted].(*types.AttributeValueMemberBOOL); !ok || !v.Value {
+		return nil, nil
+	}
+	tombstone := &Tombstone{}
+	if v, ok := item[attrDeletedReason].(*types.AttributeValueMemberS); ok {
+		tombstone.Reason = v.Value
+	}
+	if v, ok := item[attrDeletedAt].(*types.AttributeValueMemberS); ok {
+		deletedAt, err := time.Parse(time.RFC3339Nano, v.Value)
+		if err != nil {
+			return nil, err
+		}
+		tombstone.DeletedAt = deletedAt
+	}
+	return tombstone, nil
+}
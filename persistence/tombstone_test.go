@@ -0,0 +1,115 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+func TestProviderState_SoftDelete(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	now := time.Date(2024, 4, 20, 9, 0, 0, 0, time.UTC)
+	opts := []p.Option{p.WithSoftDelete("retention"), p.WithClock(func() time.Time { return now })}
+	provider := p.NewProviderState(client, opts...)
+	eventStore := p.NewEventStore(client, p.DefaultJournalTable, opts...)
+
+	actorName := "testSoftDeleteActor"
+	for i, data := range []string{"event1", "event2", "event3", "event4"} {
+		provider.PersistEvent(actorName, i, &p.Event{Data: data})
+	}
+
+	// tombstoneされたeventは、indexを数えられるようにSkippedEventとしてreplayされる
+	provider.DeleteEvents(actorName, 1)
+	var replayed []interface{}
+	provider.GetEvents(actorName, 0, 0, func(e interface{}) {
+		replayed = append(replayed, e)
+	})
+	require.Len(t, replayed, 4)
+	assert.Equal(t, &p.SkippedEvent{ActorName: actorName, EventIndex: 0, Reason: p.SkipTombstoned}, replayed[0])
+	assert.Equal(t, &p.SkippedEvent{ActorName: actorName, EventIndex: 1, Reason: p.SkipTombstoned}, replayed[1])
+	assert.Equal(t, "event3", replayed[2].(*p.Event).Data)
+	assert.Equal(t, "event4", replayed[3].(*p.Event).Data)
+
+	// ReadEventsには現れない
+	var data []string
+	require.NoError(t, eventStore.ReadEvents(ctx, actorName, 0, 0, func(envelope p.EventEnvelope) error {
+		data = append(data, envelope.Event.(*p.Event).Data)
+		return nil
+	}))
+	assert.Equal(t, []string{"event3", "event4"}, data)
+
+	// 管理用には、tombstoneと一緒に読める
+	var envelopes []p.EventEnvelope
+	require.NoError(t, eventStore.ReadEventsIncludingDeleted(ctx, actorName, 0, 0, func(envelope p.EventEnvelope) error {
+		envelopes = append(envelopes, envelope)
+		return nil
+	}))
+	require.Len(t, envelopes, 4)
+	assert.Equal(t, "event1", envelopes[0].Event.(*p.Event).Data)
+	require.NotNil(t, envelopes[0].Metadata.Tombstone)
+	assert.Equal(t, "retention", envelopes[0].Metadata.Tombstone.Reason)
+	assert.True(t, envelopes[0].Metadata.Tombstone.DeletedAt.Equal(now))
+	assert.NotNil(t, envelopes[1].Metadata.Tombstone)
+	assert.Nil(t, envelopes[2].Metadata.Tombstone)
+
+	// 既にtombstoneされたeventは変わらない
+	now = now.Add(time.Hour)
+	hidden, err := provider.TombstoneEvents(ctx, actorName, 2, "legal hold")
+	require.NoError(t, err)
+	assert.Equal(t, 1, hidden)
+	envelopes = nil
+	require.NoError(t, eventStore.ReadEventsIncludingDeleted(ctx, actorName, 0, 2, func(envelope p.EventEnvelope) error {
+		envelopes = append(envelopes, envelope)
+		return nil
+	}))
+	require.Len(t, envelopes, 3)
+	assert.Equal(t, "retention", envelopes[0].Metadata.Tombstone.Reason)
+	assert.Equal(t, "legal hold", envelopes[2].Metadata.Tombstone.Reason)
+
+	// purgeはtombstoneされたeventも消す
+	purged, err := provider.PurgeEvents(ctx, actorName, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 3, purged)
+	data = nil
+	require.NoError(t, eventStore.ReadEventsIncludingDeleted(ctx, actorName, 0, 0, func(envelope p.EventEnvelope) error {
+		data = append(data, envelope.Event.(*p.Event).Data)
+		return nil
+	}))
+	assert.Equal(t, []string{"event4"}, data)
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+}
+
+func TestProviderState_SoftDeleteRecovery(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+	provider := p.NewProviderState(client, p.WithSoftDelete("retention"))
+
+	actorName := "testSoftDeleteRecoveryActor"
+	runJournalActor(t, provider, actorName, &p.Event{Data: "event1"}, &p.Event{Data: "event2"}, &p.Event{Data: "event3"})
+	provider.DeleteEvents(actorName, 1)
+
+	// tombstoneされたeventも1つずつreplayされるので、次のeventは続きのindexに書かれる
+	replayed := runJournalActor(t, provider, actorName, &p.Event{Data: "event4"})
+	require.Len(t, replayed, 3)
+	assert.Equal(t, &p.SkippedEvent{ActorName: actorName, EventIndex: 0, Reason: p.SkipTombstoned}, replayed[0])
+	assert.Equal(t, &p.SkippedEvent{ActorName: actorName, EventIndex: 1, Reason: p.SkipTombstoned}, replayed[1])
+	assert.Equal(t, "event3", replayed[2].(*p.Event).Data)
+
+	var indexes []int
+	require.NoError(t, p.NewEventStore(client, p.DefaultJournalTable).ReadEvents(ctx, actorName, 0, 0, func(envelope p.EventEnvelope) error {
+		indexes = append(indexes, envelope.EventIndex)
+		return nil
+	}))
+	assert.Equal(t, []int{2, 3}, indexes)
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+}
@@ -0,0 +1,83 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// transactWrite writes writes in one transaction. An update of the actor metadata fails its condition when the metadata
+// records a higher index already, which is still correct after the other writes, so it is dropped and the rest is written again.
+// Transactions that conflict with another transaction on the same items, e.g. compaction and a write updating
+// the metadata of the same actor, are written again with exponential backoff.
+func transactWrite(ctx context.Context, client *dynamodb.Client, writes []types.TransactWriteItem) error {
+	backoff := batchWriteBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+		if conflicted(err) && attempt < batchWriteAttempts {
+			if err := sleep(ctx, backoff); err != nil {
+				return err
+			}
+			backoff *= 2
+			continue
+		}
+		behind := metadataBehind(err, writes)
+		if behind == nil {
+			return err
+		}
+		kept := make([]types.TransactWriteItem, 0, len(writes))
+		for i, w := range writes {
+			if !behind[i] {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) == 0 {
+			return nil
+		}
+		writes = kept
+	}
+}
+
+// metadataBehind returns the writes of a canceled transaction that are updates of the actor metadata whose condition failed,
+// or nil if the transaction failed for any other reason.
+func metadataBehind(err error, writes []types.TransactWriteItem) map[int]bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) || len(canceled.CancellationReasons) != len(writes) {
+		return nil
+	}
+	var behind map[int]bool
+	for i, reason := range canceled.CancellationReasons {
+		switch code := aws.ToString(reason.Code); {
+		case code == "" || code == "None":
+		case code == "ConditionalCheckFailed" && isMetadataUpdate(writes[i]):
+			if behind == nil {
+				behind = map[int]bool{}
+			}
+			behind[i] = true
+		default:
+			return nil
+		}
+	}
+	return behind
+}
+
+// conflicted reports whether a transaction was canceled because another transaction was writing the same items.
+func conflicted(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if aws.ToString(reason.Code) == "TransactionConflict" {
+			return true
+		}
+	}
+	return false
+}
+
+func isMetadataUpdate(w types.TransactWriteItem) bool {
+	return w.Update != nil && aws.ToString(w.Update.ConditionExpression) == metadataCondition
+}
@@ -0,0 +1,195 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DefaultTTLAttribute is the attribute WithTTL writes the expiry to, unless another one is given.
+const DefaultTTLAttribute = "expireAt"
+
+// ErrJournalExpired is returned when events of an actor that recovery or a query needs have expired,
+// while later events have not. Replaying the rest would silently build a wrong state.
+var ErrJournalExpired = errors.New("journal partially expired")
+
+// TTLFunc returns how long the events and snapshots of actorName are kept after they are written, or 0 to keep them forever.
+type TTLFunc func(actorName string) time.Duration
+
+// FixedTTL keeps the items of every actor for ttl.
+func FixedTTL(ttl time.Duration) TTLFunc {
+	return func(string) time.Duration {
+		return ttl
+	}
+}
+
+// TTLRule keeps the items of actors whose name matches Pattern, in the syntax of path.Match, for TTL.
+type TTLRule struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// TTLByPattern uses the TTL of the first rule that matches the actor name, e.g. TTLRule{"test-*", time.Hour}.
+// Actors that match no rule are kept forever.
+func TTLByPattern(rules ...TTLRule) TTLFunc {
+	return func(actorName string) time.Duration {
+		for _, rule := range rules {
+			if ok, _ := path.Match(rule.Pattern, actorName); ok {
+				return rule.TTL
+			}
+		}
+		return 0
+	}
+}
+
+// ttlPolicy is how long items are kept, and the attribute the TTL of their table is enabled on.
+type ttlPolicy struct {
+	attribute string
+	ttl       TTLFunc
+}
+
+// expiry returns the expiry attribute of an item of actorName written at now, and false if it is kept forever.
+func (p *ttlPolicy) expiry(actorName string, now time.Time) (types.AttributeValue, bool) {
+	expiresAt := p.expiresAfter(actorName, now)
+	if expiresAt.IsZero() {
+		return nil, false
+	}
+	// TTLはepoch秒で指定する
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)}, true
+}
+
+// expiresAfter returns when an item of actorName written at now expires, or zero if it is kept forever.
+func (p *ttlPolicy) expiresAfter(actorName string, now time.Time) time.Time {
+	ttl := p.ttl(actorName)
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// expired reports whether an item has expired at now. DynamoDB deletes expired items only eventually,
+// so they are skipped by readers until then.
+func (p *ttlPolicy) expired(item map[string]types.AttributeValue, now time.Time) bool {
+	expiresAt := p.expiresAt(item)
+	return !expiresAt.IsZero() && !expiresAt.After(now)
+}
+
+// expiresAt returns when an item expires, or zero if it is kept forever.
+func (p *ttlPolicy) expiresAt(item map[string]types.AttributeValue) time.Time {
+	v, ok := item[p.attribute].(*types.AttributeValueMemberN)
+	if !ok {
+		return time.Time{}
+	}
+	expireAt, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(expireAt, 0)
+}
+
+// replayCheck makes sure a replay under TTL has no holes. TTL deletes the oldest items of an actor first,
+// so an expired event is followed by events that have not expired yet, and the replay would skip it without notice.
+type replayCheck struct {
+	policy    *ttlPolicy
+	actorName string
+	now       time.Time
+	// next is the index the next event must have, and last the highest index that must be read, or -1 if unknown.
+	next int
+	last int
+	// strict is set when the actor metadata tells which events must exist, so that every gap is a hole.
+	// Without it, a gap may be events deleted on purpose, and only a gap after expired events is a hole.
+	strict  bool
+	expired bool
+}
+
+// newReplayCheck starts a check of the replay of actorName from eventIndexStart to eventIndexEnd, or to the last event if it is 0.
+// With actor metadata, events deleted on purpose are not expected, and events that DynamoDB already removed
+// and missing events at the end are detected as well.
+func (e *EventStore) newReplayCheck(ctx context.Context, actorName string, eventIndexStart int, eventIndexEnd int) (*replayCheck, error) {
+	now := e.options.clock()
+	check := &replayCheck{policy: e.options.ttl, actorName: actorName, now: now, next: eventIndexStart, last: -1}
+	if e.options.actorMetadata == nil {
+		return check, nil
+	}
+	metadata, ok, err := e.options.actorMetadata.load(ctx, e.client, actorName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || (!metadata.ExpiresAt.IsZero() && !metadata.ExpiresAt.After(now)) {
+		return check, nil
+	}
+	check.next = max(check.next, metadata.DeletedToIndex+1)
+	check.last = metadata.HighestEventIndex
+	check.strict = true
+	if eventIndexEnd != 0 {
+		check.last = min(check.last, eventIndexEnd)
+	}
+	return check, nil
+}
+
+// newArchiveCheck starts a check of the archived events of actorName from eventIndexStart. The actor metadata does not
+// tell which events were archived, so only a gap after expired events is a hole.
+func (e *EventStore) newArchiveCheck(actorName string, eventIndexStart int) *replayCheck {
+	return &replayCheck{policy: e.options.ttl, actorName: actorName, now: e.options.clock(), next: eventIndexStart, last: -1}
+}
+
+// follow continues the check of the archived events in the journal. After expired archived events,
+// the journal must continue right after the last archived event that was replayed.
+func (c *replayCheck) follow(archived *replayCheck) {
+	if archived.expired {
+		c.next = archived.next
+		c.expired = true
+	}
+}
+
+// item reports whether a journal item is replayed, and fails if events before it have expired.
+func (c *replayCheck) item(item map[string]types.AttributeValue) (bool, error) {
+	if c.policy.expired(item, c.now) {
+		c.expired = true
+		return false, nil
+	}
+	eventIndex, err := itemEventIndex(item)
+	if err != nil {
+		return false, err
+	}
+	if eventIndex > c.next && (c.strict || c.expired) {
+		return false, fmt.Errorf("%w: events %d to %d of %s have expired", ErrJournalExpired, c.next, eventIndex-1, c.actorName)
+	}
+	c.next = max(c.next, eventIndex+1)
+	return true, nil
+}
+
+// done fails if events at the end of the replay have expired.
+func (c *replayCheck) done() error {
+	if c.last >= c.next {
+		return fmt.Errorf("%w: events %d to %d of %s have expired", ErrJournalExpired, c.next, c.last, c.actorName)
+	}
+	return nil
+}
+
+// enableTTL enables TTL on attribute of table, unless it is enabled already.
+func enableTTL(ctx context.Context, client *dynamodb.Client, table string, attribute string) error {
+	out, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(table)})
+	if err != nil {
+		return err
+	}
+	if d := out.TimeToLiveDescription; d != nil && aws.ToString(d.AttributeName) == attribute &&
+		(d.TimeToLiveStatus == types.TimeToLiveStatusEnabled || d.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		return nil
+	}
+	_, err = client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
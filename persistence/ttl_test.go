@@ -0,0 +1,171 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+)
+
+func TestTTLByPattern(t *testing.T) {
+	ttl := p.TTLByPattern(
+		p.TTLRule{Pattern: "test-*", TTL: time.Hour},
+		p.TTLRule{Pattern: "*", TTL: 24 * time.Hour},
+	)
+	assert.Equal(t, time.Hour, ttl("test-actor"))
+	assert.Equal(t, 24*time.Hour, ttl("userAccountActor-1"))
+	// "*"は"/"にmatchしない
+	assert.Equal(t, time.Duration(0), ttl("parent/child"))
+
+	assert.Equal(t, time.Minute, p.FixedTTL(time.Minute)("any"))
+}
+
+func TestProviderState_TTL(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	opts := []p.Option{
+		p.WithTTL("", p.TTLByPattern(p.TTLRule{Pattern: "testTTL*", TTL: time.Hour})),
+		p.WithActorMetadata(p.DefaultActorMetadataTable),
+		p.WithClock(clock),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+	eventStore := p.NewEventStore(client, p.DefaultJournalTable, opts...)
+
+	readEvents := func(actorName string, start int) ([]string, error) {
+		var data []string
+		err := eventStore.ReadEvents(ctx, actorName, start, 0, func(envelope p.EventEnvelope) error {
+			data = append(data, envelope.Event.(*p.Event).Data)
+			return nil
+		})
+		return data, err
+	}
+
+	actorName := "testTTLActor"
+	for i, data := range []string{"event1", "event2", "event3"} {
+		provider.PersistEvent(actorName, i, &p.Event{Data: data})
+	}
+	now = now.Add(30 * time.Minute)
+	provider.PersistEvent(actorName, 3, &p.Event{Data: "event4"})
+	provider.PersistSnapshot(actorName, 3, &p.Snapshot{Data: "snapshot"})
+	provider.PersistEvent(actorName, 4, &p.Event{Data: "event5"})
+
+	// 期限が書かれる
+	out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(p.DefaultJournalTable),
+		Key: map[string]types.AttributeValue{
+			"actorName":  &types.AttributeValueMemberS{Value: actorName},
+			"eventIndex": &types.AttributeValueMemberN{Value: "4"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out.Item, p.DefaultTTLAttribute)
+	metadata, ok, err := provider.ActorMetadata(ctx, actorName)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, now.Add(time.Hour).Unix(), metadata.ExpiresAt.Unix())
+
+	// 最初の3件だけ期限切れになる
+	now = now.Add(31 * time.Minute)
+	_, err = readEvents(actorName, 0)
+	assert.ErrorIs(t, err, p.ErrJournalExpired)
+
+	// snapshotからのreplayには期限切れのeventは要らない
+	snapshot, eventIndex, ok := provider.GetSnapshot(actorName)
+	require.True(t, ok)
+	assert.Equal(t, "snapshot", snapshot.(*p.Snapshot).Data)
+	data, err := readEvents(actorName, eventIndex)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"event4", "event5"}, data)
+
+	// 全て期限切れになれば、actorは初めからやり直す
+	now = now.Add(time.Hour)
+	_, _, ok = provider.GetSnapshot(actorName)
+	assert.False(t, ok)
+	data, err = readEvents(actorName, 0)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	// patternに合わないactorは期限を持たない
+	otherActor := "otherTTLActor"
+	provider.PersistEvent(otherActor, 0, &p.Event{Data: "event1"})
+	out, err = client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(p.DefaultJournalTable),
+		Key: map[string]types.AttributeValue{
+			"actorName":  &types.AttributeValueMemberS{Value: otherActor},
+			"eventIndex": &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	require.NoError(t, err)
+	assert.NotContains(t, out.Item, p.DefaultTTLAttribute)
+
+	// クリーンアップ
+	for _, name := range []string{actorName, otherActor} {
+		deleteActorItems(t, client, p.DefaultJournalTable, name)
+		deleteActorItems(t, client, p.DefaultSnapshotTable, name)
+		_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(p.DefaultActorMetadataTable),
+			Key:       map[string]types.AttributeValue{"actorName": &types.AttributeValueMemberS{Value: name}},
+		})
+		assert.NoError(t, err)
+	}
+}
+
+func TestProviderState_TTLWithoutMetadata(t *testing.T) {
+	ctx := context.Background()
+	client := InitializeDynamoDBClient()
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	opts := []p.Option{
+		p.WithTTL("", p.TTLByPattern(p.TTLRule{Pattern: "testTTL*", TTL: time.Hour})),
+		p.WithClock(clock),
+	}
+	require.NoError(t, p.CreateTables(ctx, client, opts...))
+	provider := p.NewProviderState(client, opts...)
+	eventStore := p.NewEventStore(client, p.DefaultJournalTable, opts...)
+
+	readEvents := func(actorName string) ([]string, error) {
+		var data []string
+		err := eventStore.ReadEvents(ctx, actorName, 0, 0, func(envelope p.EventEnvelope) error {
+			data = append(data, envelope.Event.(*p.Event).Data)
+			return nil
+		})
+		return data, err
+	}
+
+	// 消したeventの後ろは、期限切れとはみなさない
+	deletedActor := "testTTLDeletedActor"
+	for i, data := range []string{"event1", "event2", "event3", "event4"} {
+		provider.PersistEvent(deletedActor, i, &p.Event{Data: data})
+	}
+	provider.DeleteEvents(deletedActor, 1)
+	data, err := readEvents(deletedActor)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"event3", "event4"}, data)
+
+	// 期限切れのeventを飛ばす場合は失敗する
+	expiredActor := "testTTLExpiredActor"
+	provider.PersistEvent(expiredActor, 0, &p.Event{Data: "event1"})
+	provider.PersistEvent(expiredActor, 1, &p.Event{Data: "event2"})
+	now = now.Add(30 * time.Minute)
+	provider.PersistEvent(expiredActor, 2, &p.Event{Data: "event3"})
+	provider.DeleteEvents(expiredActor, 0)
+	now = now.Add(31 * time.Minute)
+	_, err = readEvents(expiredActor)
+	assert.ErrorIs(t, err, p.ErrJournalExpired)
+
+	// クリーンアップ
+	for _, name := range []string{deletedActor, expiredActor} {
+		deleteActorItems(t, client, p.DefaultJournalTable, name)
+	}
+}
@@ -0,0 +1,98 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const attrSchemaVersion = "schemaVersion"
+
+// ErrSplitUpcast is returned by GetEvents when an upcaster turns a stored event into several events.
+// persistence.Mixin counts the replayed events to find the index of its next event, so it would write over
+// the events after them. ReadEvents and GetEventEnvelopes replay split events with the index they are stored at.
+var ErrSplitUpcast = errors.New("event upcast into several events can not be replayed by GetEvents")
+
+// Upcaster turns an event stored with an old schema version into its form at the next version.
+// It may return several events, e.g. when an event is split, or none when the event is dropped.
+// GetEvents replays a dropped event as a SkippedEvent and fails on a split one, see ErrSplitUpcast.
+type Upcaster func(event interface{}) ([]interface{}, error)
+
+type versionKey struct {
+	typeName string
+	version  int
+}
+
+// UpcasterRegistry holds the upcasters of event types and the schema version events are written with.
+// Events without a recorded schema version are version 1.
+type UpcasterRegistry struct {
+	mu        sync.RWMutex
+	upcasters map[versionKey]Upcaster
+	versions  map[string]int
+}
+
+func NewUpcasterRegistry() *UpcasterRegistry {
+	return &UpcasterRegistry{
+		upcasters: map[versionKey]Upcaster{},
+		versions:  map[string]int{},
+	}
+}
+
+// Register adds an upcaster from fromVersion to fromVersion+1 for events of typeName,
+// which is the full name of a proto message or the %T name of other Go types.
+// The current version of typeName becomes fromVersion+1 unless a later upcaster is registered.
+// Events returned by the upcaster continue at fromVersion+1 of their own type.
+func (r *UpcasterRegistry) Register(typeName string, fromVersion int, upcaster Upcaster) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upcasters[versionKey{typeName, fromVersion}] = upcaster
+	if r.versions[typeName] < fromVersion+1 {
+		r.versions[typeName] = fromVersion + 1
+	}
+}
+
+// CurrentVersion is the schema version new events of typeName are written with.
+func (r *UpcasterRegistry) CurrentVersion(typeName string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if version, ok := r.versions[typeName]; ok {
+		return version
+	}
+	return 1
+}
+
+// Upcast applies upcasters to event, stored with version, until it reaches the current version.
+func (r *UpcasterRegistry) Upcast(event interface{}, version int) ([]interface{}, error) {
+	r.mu.RLock()
+	upcaster, ok := r.upcasters[versionKey{typeName(event), version}]
+	r.mu.RUnlock()
+	if !ok {
+		return []interface{}{event}, nil
+	}
+
+	upcasted, err := upcaster(event)
+	if err != nil {
+		return nil, fmt.Errorf("upcast %s from version %d: %w", typeName(event), version, err)
+	}
+	var events []interface{}
+	for _, e := range upcasted {
+		current, err := r.Upcast(e, version+1)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, current...)
+	}
+	return events, nil
+}
+
+// schemaVersion reads the schema version recorded with an item.
+func schemaVersion(item map[string]types.AttributeValue) (int, error) {
+	v, ok := item[attrSchemaVersion].(*types.AttributeValueMemberN)
+	if !ok {
+		return 1, nil
+	}
+	return strconv.Atoi(v.Value)
+}
@@ -0,0 +1,214 @@
+package persistence_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	p "github.com/tkhrk1010/protoactor-go-persistence-dynamodb/persistence"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const eventTypeName = "persistence.Event"
+
+// newUserAccountUpcasters describes the history of the Event schema used in these tests.
+//   - version 1: Dataに"name,email"を詰めていた
+//   - version 2: CreateUserAccountとChangeEmailに分けた
+//   - version 3: Typeを小文字にした
+func newUserAccountUpcasters() *p.UpcasterRegistry {
+	registry := p.NewUpcasterRegistry()
+	registry.Register(eventTypeName, 1, func(event interface{}) ([]interface{}, error) {
+		e := event.(*p.Event)
+		if e.Type != "CreateUserAccount" {
+			return []interface{}{e}, nil
+		}
+		name, email, ok := strings.Cut(e.Data, ",")
+		if !ok {
+			return nil, errors.New("malformed CreateUserAccount")
+		}
+		return []interface{}{
+			&p.Event{Id: e.Id, Type: "CreateUserAccount", Data: name},
+			&p.Event{Id: e.Id, Type: "ChangeEmail", Data: email},
+		}, nil
+	})
+	registry.Register(eventTypeName, 2, func(event interface{}) ([]interface{}, error) {
+		e := proto.Clone(event.(*p.Event)).(*p.Event)
+		e.Type = strings.ToLower(e.Type)
+		return []interface{}{e}, nil
+	})
+	return registry
+}
+
+func TestUpcasterRegistry_Upcast(t *testing.T) {
+	registry := newUserAccountUpcasters()
+	assert.Equal(t, 3, registry.CurrentVersion(eventTypeName))
+	assert.Equal(t, 1, registry.CurrentVersion("google.protobuf.StringValue"))
+
+	t.Run("one to many", func(t *testing.T) {
+		events, err := registry.Upcast(&p.Event{Id: "1", Type: "CreateUserAccount", Data: "alice,alice@example.com"}, 1)
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.True(t, proto.Equal(&p.Event{Id: "1", Type: "createuseraccount", Data: "alice"}, events[0].(*p.Event)))
+		assert.True(t, proto.Equal(&p.Event{Id: "1", Type: "changeemail", Data: "alice@example.com"}, events[1].(*p.Event)))
+	})
+
+	t.Run("from an intermediate version", func(t *testing.T) {
+		events, err := registry.Upcast(&p.Event{Type: "ChangeEmail"}, 2)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "changeemail", events[0].(*p.Event).Type)
+	})
+
+	t.Run("current version", func(t *testing.T) {
+		event := &p.Event{Type: "changeemail"}
+		events, err := registry.Upcast(event, 3)
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{event}, events)
+	})
+
+	t.Run("type change", func(t *testing.T) {
+		registry := p.NewUpcasterRegistry()
+		registry.Register("google.protobuf.StringValue", 1, func(event interface{}) ([]interface{}, error) {
+			return []interface{}{&p.Event{Data: event.(*wrapperspb.StringValue).Value}}, nil
+		})
+		events, err := registry.Upcast(wrapperspb.String("legacy"), 1)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.True(t, proto.Equal(&p.Event{Data: "legacy"}, events[0].(*p.Event)))
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		registry := p.NewUpcasterRegistry()
+		registry.Register(eventTypeName, 1, func(interface{}) ([]interface{}, error) { return nil, nil })
+		events, err := registry.Upcast(&p.Event{}, 1)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		_, err := registry.Upcast(&p.Event{Type: "CreateUserAccount", Data: "alice"}, 1)
+		assert.ErrorContains(t, err, "malformed CreateUserAccount")
+	})
+}
+
+func TestEventStore_GetEventsWithUpcasters(t *testing.T) {
+	ctx := context.Background()
+	tableName := "journal"
+
+	client := InitializeDynamoDBClient()
+	eventStore := p.NewEventStore(client, tableName, p.WithUpcasters(newUserAccountUpcasters()))
+
+	actorName := "testUpcastActor"
+
+	// version 1のitemはschemaVersionを持たない
+	seedData := []map[string]interface{}{
+		{
+			"actorName":  actorName,
+			"eventIndex": 1,
+			"payload":    encodeEvent(&p.Event{Id: "1", Type: "CreateUserAccount", Data: "alice,alice@example.com"}),
+		},
+		{
+			"actorName":     actorName,
+			"eventIndex":    2,
+			"schemaVersion": 2,
+			"payload":       encodeEvent(&p.Event{Id: "2", Type: "ChangeEmail", Data: "alice@example.net"}),
+		},
+	}
+	for _, item := range seedData {
+		av, err := attributevalue.MarshalMap(item)
+		require.NoError(t, err)
+		_, err = client.PutItem(ctx, &dynamodb.PutItemInput{Item: av, TableName: aws.String(tableName)})
+		require.NoError(t, err)
+	}
+	eventStore.PersistEvent(actorName, 3, &p.Event{Id: "3", Type: "changeemail", Data: "alice@example.org"})
+
+	// 新しいeventには現在のschemaVersionが記録される
+	key, err := attributevalue.MarshalMap(map[string]interface{}{
+		"actorName":  actorName,
+		"eventIndex": 3,
+	})
+	require.NoError(t, err)
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{Key: key, TableName: aws.String(tableName)})
+	require.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "3"}, result.Item["schemaVersion"])
+
+	var actualEvents []interface{}
+	var indexes []int
+	require.NoError(t, eventStore.ReadEvents(ctx, actorName, 1, 0, func(envelope p.EventEnvelope) error {
+		actualEvents = append(actualEvents, envelope.Event)
+		indexes = append(indexes, envelope.EventIndex)
+		return nil
+	}))
+
+	expectedEvents := []*p.Event{
+		{Id: "1", Type: "createuseraccount", Data: "alice"},
+		{Id: "1", Type: "changeemail", Data: "alice@example.com"},
+		{Id: "2", Type: "changeemail", Data: "alice@example.net"},
+		{Id: "3", Type: "changeemail", Data: "alice@example.org"},
+	}
+	require.Equal(t, len(expectedEvents), len(actualEvents))
+	for i, expected := range expectedEvents {
+		assert.True(t, proto.Equal(expected, actualEvents[i].(*p.Event)), "event %d", i)
+	}
+	// 分割されたeventは元のindexを持つ
+	assert.Equal(t, []int{1, 1, 2, 3}, indexes)
+
+	// Mixinはreplayしたeventを数えて次のindexを決めるので、分割されたeventはGetEventsでreplayできない
+	err = persistError(func() {
+		eventStore.GetEvents(actorName, 1, 0, func(interface{}) {})
+	})
+	assert.ErrorIs(t, err, p.ErrSplitUpcast)
+
+	// クリーンアップ
+	for _, eventIndex := range []int{1, 2, 3} {
+		key, err := attributevalue.MarshalMap(map[string]interface{}{
+			"actorName":  actorName,
+			"eventIndex": eventIndex,
+		})
+		require.NoError(t, err)
+		_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(tableName)})
+		require.NoError(t, err)
+	}
+}
+
+func TestProviderState_RecoveryWithDroppedEvents(t *testing.T) {
+	client := InitializeDynamoDBClient()
+	actorName := "testDroppedEventsActor"
+	runJournalActor(t, p.NewProviderState(client), actorName,
+		&p.Event{Data: "event1"}, &p.Event{Type: "Obsolete", Data: "event2"}, &p.Event{Data: "event3"})
+
+	registry := p.NewUpcasterRegistry()
+	registry.Register(eventTypeName, 1, func(event interface{}) ([]interface{}, error) {
+		if event.(*p.Event).Type == "Obsolete" {
+			return nil, nil
+		}
+		return []interface{}{event}, nil
+	})
+	provider := p.NewProviderState(client, p.WithUpcasters(registry))
+
+	// 捨てられたeventも1つとして数えられるので、次のeventは続きのindexに書かれる
+	replayed := runJournalActor(t, provider, actorName, &p.Event{Data: "event4"})
+	require.Len(t, replayed, 3)
+	assert.Equal(t, &p.SkippedEvent{ActorName: actorName, EventIndex: 1, Reason: p.SkipDropped}, replayed[1])
+	var data []string
+	var indexes []int
+	require.NoError(t, p.NewEventStore(client, p.DefaultJournalTable, p.WithUpcasters(registry)).ReadEvents(context.Background(), actorName, 0, 0,
+		func(envelope p.EventEnvelope) error {
+			data = append(data, envelope.Event.(*p.Event).Data)
+			indexes = append(indexes, envelope.EventIndex)
+			return nil
+		}))
+	assert.Equal(t, []string{"event1", "event3", "event4"}, data)
+	assert.Equal(t, []int{0, 2, 3}, indexes)
+
+	// クリーンアップ
+	deleteActorItems(t, client, p.DefaultJournalTable, actorName)
+}